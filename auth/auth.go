@@ -0,0 +1,217 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ScopeExecute   = "execute"
+	ScopeFileRead  = "file-read"
+	ScopeFileWrite = "file-write"
+
+	ErrCodeUnauthorized = "ERR_UNAUTHORIZED"
+	ErrCodeForbidden    = "ERR_FORBIDDEN"
+)
+
+var AllScopes = []string{ScopeExecute, ScopeFileRead, ScopeFileWrite}
+
+// Principal is the authenticated caller of a request, a TrustedGateway may pick the tenant with the tenant header
+type Principal struct {
+	Subject        string
+	Scopes         []string
+	Claims         map[string]interface{}
+	TrustedGateway bool
+}
+
+// HasScope reports whether the principal was granted scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, granted := range p.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator validates one kind of credential.
+// It returns errNoCredential if the request does not carry a credential it understands, so the next one can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+var errNoCredential = errors.New("no credential")
+
+type contextKey struct{}
+
+var (
+	authLock       sync.RWMutex
+	authenticators []Authenticator
+	// subjects of the principals trusted to set the tenant header
+	trustedGateways = map[string]bool{}
+)
+
+// RegisterAuthenticator enables authentication on every route wrapped with Require
+func RegisterAuthenticator(authenticator Authenticator) {
+	authLock.Lock()
+	defer authLock.Unlock()
+	authenticators = append(authenticators, authenticator)
+}
+
+// Enabled reports whether any authenticator is registered. Without one all requests are allowed.
+func Enabled() bool {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	return len(authenticators) > 0
+}
+
+// Configure registers the authenticators enabled in the config
+func Configure(cfg util.JupyterPythonConfig) error {
+	TrustGateways(cfg.TenantHeaderSubjects...)
+	if cfg.AuthStaticKey != "" {
+		util.RegisterSecret(cfg.AuthStaticKey)
+		RegisterAuthenticator(&StaticKeyAuthenticator{Key: cfg.AuthStaticKey, Scopes: scopesOrAll(cfg.AuthStaticKeyScopes)})
+		log.Info().Msg("Static bearer key authentication enabled")
+	}
+	if cfg.AuthHmacSecret != "" {
+		util.RegisterSecret(cfg.AuthHmacSecret)
+		// a signed body is spooled before the handler runs, so it is capped at the upload size
+		RegisterAuthenticator(&HMACAuthenticator{Secret: []byte(cfg.AuthHmacSecret), Scopes: scopesOrAll(cfg.AuthHmacScopes), MaxBodyBytes: cfg.UploadMaxRequestBytes})
+		log.Info().Msg("HMAC request signing authentication enabled")
+	}
+	if cfg.AuthJwksFile != "" {
+		keys, err := LoadJWKS(cfg.AuthJwksFile)
+		if err != nil {
+			return err
+		}
+		RegisterAuthenticator(&JWTAuthenticator{Keys: keys, Issuer: cfg.AuthJwtIssuer, Audience: cfg.AuthJwtAudience})
+		log.Info().Msgf("JWT authentication enabled with %d keys from %s", len(keys), cfg.AuthJwksFile)
+	}
+	return nil
+}
+
+// TrustGateways marks the principals with one of subjects as trusted gateways
+func TrustGateways(subjects ...string) {
+	authLock.Lock()
+	defer authLock.Unlock()
+	for _, subject := range subjects {
+		trustedGateways[subject] = true
+	}
+}
+
+func scopesOrAll(scopes []string) []string {
+	if len(scopes) == 0 {
+		return AllScopes
+	}
+	return scopes
+}
+
+// Authenticate tries every registered authenticator in order
+func Authenticate(r *http.Request) (*Principal, error) {
+	authLock.RLock()
+	defer authLock.RUnlock()
+
+	for _, authenticator := range authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if err == errNoCredential {
+			continue
+		}
+		if principal != nil {
+			principal.TrustedGateway = trustedGateways[principal.Subject]
+		}
+		return principal, err
+	}
+	return nil, fmt.Errorf("missing or unsupported credential")
+}
+
+// Require wraps a handler so it only runs for callers granted scope
+func Require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !Enabled() {
+			next(w, r)
+			return
+		}
+
+		principal, err := Authenticate(r)
+		// authenticators may replace the body with a verified copy, which is released with the request
+		if r.Body != nil {
+			defer r.Body.Close()
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("path", r.URL.Path).Msg("Unauthorized request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="jupyterpython"`)
+			util.SendHTTPResponse(w, http.StatusUnauthorized, ErrCodeUnauthorized+": "+sanitize(err.Error()), true)
+			return
+		}
+
+		if !principal.HasScope(scope) {
+			log.Warn().Str("subject", principal.Subject).Str("scope", scope).Str("path", r.URL.Path).Msg("Forbidden request")
+			util.SendHTTPResponse(w, http.StatusForbidden, ErrCodeForbidden+": missing scope "+scope, true)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, principal)))
+	}
+}
+
+// PrincipalFromContext returns the principal of an authenticated request, or nil
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(contextKey{}).(*Principal)
+	return principal
+}
+
+// error messages end up inside a JSON string
+func sanitize(message string) string {
+	return strings.NewReplacer(`"`, "'", `\`, "/").Replace(message)
+}
+
+// StaticKeyAuthenticator accepts a single shared key sent as a bearer token
+type StaticKeyAuthenticator struct {
+	Key    string
+	Scopes []string
+}
+
+func (a *StaticKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, errNoCredential
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.Key)) == 1 {
+		return &Principal{Subject: "static-key", Scopes: a.Scopes}, nil
+	}
+	// a key may look like a JWT, only a token that is not the key is left to the JWT authenticator
+	if strings.Count(token, ".") == 2 {
+		return nil, errNoCredential
+	}
+	return nil, fmt.Errorf("invalid bearer key")
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hmacScheme        = "HMAC-SHA256 "
+	ContentHashHeader = "X-Content-SHA256"
+	NonceHeader       = "X-Nonce"
+	maxClockSkew      = 5 * time.Minute
+	// bodies up to this size are verified in memory, larger ones are spooled to a temporary file
+	maxMemoryBodyBytes = 1 << 20
+	// spooled bodies are capped at this size unless MaxBodyBytes is set
+	defaultMaxBodyBytes = 1 << 30
+)
+
+// sha256 of an empty body, used when the client does not send a content hash
+var emptyContentHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// HMACAuthenticator verifies requests signed with a shared secret.
+// Clients send "Authorization: HMAC-SHA256 <unix timestamp>:<hex signature>" where the signature is
+// the HMAC-SHA256 of StringToSign. The body is read and verified before the handler runs, so a handler
+// never acts on content that was not signed.
+// A signature is only accepted once while its timestamp is within the clock skew. Clients sending the same
+// request twice within a second add a random X-Nonce header, appended to StringToSign as a fifth line.
+type HMACAuthenticator struct {
+	Secret []byte
+	Scopes []string
+	// largest body that is spooled and verified, 0 means defaultMaxBodyBytes
+	MaxBodyBytes int64
+
+	lock sync.Mutex
+	// signatures already used and when they leave the clock skew window
+	seen map[string]time.Time
+}
+
+// StringToSign is the canonical form of a request covered by the signature
+func StringToSign(method, requestURI, timestamp, contentHash string) string {
+	return strings.Join([]string{method, requestURI, timestamp, contentHash}, "\n")
+}
+
+// Sign returns the hex signature for the canonical request
+func Sign(secret []byte, stringToSign string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *HMACAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, hmacScheme) {
+		return nil, errNoCredential
+	}
+
+	timestamp, signature, ok := strings.Cut(strings.TrimSpace(header[len(hmacScheme):]), ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed HMAC authorization header")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HMAC timestamp")
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, fmt.Errorf("HMAC timestamp outside the allowed clock skew")
+	}
+
+	contentHash := strings.ToLower(r.Header.Get(ContentHashHeader))
+	if contentHash == "" {
+		contentHash = emptyContentHash
+	}
+
+	stringToSign := StringToSign(r.Method, r.URL.RequestURI(), timestamp, contentHash)
+	if nonce := r.Header.Get(NonceHeader); nonce != "" {
+		stringToSign += "\n" + nonce
+	}
+	signature = strings.ToLower(signature)
+	if !hmac.Equal([]byte(Sign(a.Secret, stringToSign)), []byte(signature)) {
+		return nil, fmt.Errorf("invalid HMAC signature")
+	}
+
+	// a replayed or oversized request is rejected before its body is read
+	if !a.useSignature(signature, time.Unix(seconds, 0).Add(maxClockSkew)) {
+		return nil, fmt.Errorf("HMAC signature was already used")
+	}
+	maxBodyBytes := a.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = defaultMaxBodyBytes
+	}
+	if r.ContentLength > maxBodyBytes {
+		return nil, fmt.Errorf("request body exceeds the maximum size of %d bytes", maxBodyBytes)
+	}
+
+	if r.Body != nil {
+		body, size, err := spoolVerifiedBody(r.Body, contentHash, maxBodyBytes)
+		if err != nil {
+			return nil, err
+		}
+		r.Body, r.ContentLength = body, size
+	}
+	return &Principal{Subject: "hmac", Scopes: a.Scopes}, nil
+}
+
+// useSignature records signature until expires and reports whether it was unused
+func (a *HMACAuthenticator) useSignature(signature string, expires time.Time) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	if a.seen == nil {
+		a.seen = map[string]time.Time{}
+	}
+	for used, usedExpires := range a.seen {
+		if now.After(usedExpires) {
+			delete(a.seen, used)
+		}
+	}
+	if _, ok := a.seen[signature]; ok {
+		return false
+	}
+	a.seen[signature] = expires
+	return true
+}
+
+// spoolVerifiedBody reads body and returns a replacement with the same content once it matches the
+// signed content hash. Large bodies are kept in a temporary file that is removed when the replacement is closed,
+// bodies over maxBytes are rejected.
+func spoolVerifiedBody(body io.ReadCloser, expected string, maxBytes int64) (io.ReadCloser, int64, error) {
+	defer body.Close()
+
+	digest := sha256.New()
+	buffer := &bytes.Buffer{}
+	size, err := io.Copy(io.MultiWriter(buffer, digest), io.LimitReader(body, maxMemoryBodyBytes+1))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading request body: %v", err)
+	}
+
+	var spooled io.ReadCloser = io.NopCloser(bytes.NewReader(buffer.Bytes()))
+	if size > maxMemoryBodyBytes {
+		file, err := os.CreateTemp("", "hmac-body-*")
+		if err != nil {
+			return nil, 0, fmt.Errorf("error spooling request body: %v", err)
+		}
+		spooled = &spooledFile{File: file}
+		// the buffered start of the body is already hashed
+		_, err = buffer.WriteTo(file)
+		rest := int64(0)
+		if err == nil {
+			rest, err = io.Copy(io.MultiWriter(file, digest), io.LimitReader(body, maxBytes-size+1))
+		}
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			spooled.Close()
+			return nil, 0, fmt.Errorf("error spooling request body: %v", err)
+		}
+		size += rest
+	}
+	if size > maxBytes {
+		spooled.Close()
+		return nil, 0, fmt.Errorf("request body exceeds the maximum size of %d bytes", maxBytes)
+	}
+
+	if hex.EncodeToString(digest.Sum(nil)) != expected {
+		spooled.Close()
+		return nil, 0, fmt.Errorf("request body does not match the signed %s", ContentHashHeader)
+	}
+	return spooled, size, nil
+}
+
+// spooledFile is a request body in a temporary file
+type spooledFile struct {
+	*os.File
+}
+
+func (f *spooledFile) Close() error {
+	defer os.Remove(f.File.Name())
+	return f.File.Close()
+}
@@ -0,0 +1,263 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const jwtLeeway = time.Minute
+
+// JSONWebKey is a public key from a JWKS file, only RSA and P-256 EC keys are supported
+type JSONWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	publicKey crypto.PublicKey
+}
+
+// JWTAuthenticator validates bearer JWTs signed by one of the keys of a local JWKS file
+type JWTAuthenticator struct {
+	Keys     []JSONWebKey
+	Issuer   string
+	Audience string
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// LoadJWKS reads the public keys of a JWKS file
+func LoadJWKS(path string) ([]JSONWebKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWKS file: %v", err)
+	}
+	return ParseJWKS(content)
+}
+
+func ParseJWKS(content []byte) ([]JSONWebKey, error) {
+	var jwks struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %v", err)
+	}
+
+	for i := range jwks.Keys {
+		key := &jwks.Keys[i]
+		switch key.Kty {
+		case "RSA":
+			n, err := decodeBigInt(key.N)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modulus of key '%s': %v", key.Kid, err)
+			}
+			e, err := decodeBigInt(key.E)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exponent of key '%s': %v", key.Kid, err)
+			}
+			key.publicKey = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			if key.Crv != "P-256" {
+				return nil, fmt.Errorf("unsupported curve '%s' of key '%s'", key.Crv, key.Kid)
+			}
+			x, err := decodeBigInt(key.X)
+			if err != nil {
+				return nil, fmt.Errorf("invalid x of key '%s': %v", key.Kid, err)
+			}
+			y, err := decodeBigInt(key.Y)
+			if err != nil {
+				return nil, fmt.Errorf("invalid y of key '%s': %v", key.Kid, err)
+			}
+			key.publicKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		default:
+			return nil, fmt.Errorf("unsupported key type '%s' of key '%s'", key.Kty, key.Kid)
+		}
+	}
+	return jwks.Keys, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return nil, errNoCredential
+	}
+
+	claims, err := a.Validate(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	return &Principal{Subject: subject, Scopes: scopesFromClaims(claims), Claims: claims}, nil
+}
+
+// Validate checks the signature and the registered claims of token and returns its claims
+func (a *JWTAuthenticator) Validate(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header")
+	}
+	key, err := a.findKey(header)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT signature encoding")
+	}
+	if err := verifySignature(header.Alg, key.publicKey, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims")
+	}
+
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("JWT is expired or has no exp claim")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("JWT is not valid yet")
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, fmt.Errorf("JWT issuer is not trusted")
+	}
+	if a.Audience != "" && !hasAudience(claims["aud"], a.Audience) {
+		return nil, fmt.Errorf("JWT audience does not match")
+	}
+	return claims, nil
+}
+
+func (a *JWTAuthenticator) findKey(header jwtHeader) (*JSONWebKey, error) {
+	for i := range a.Keys {
+		key := &a.Keys[i]
+		if header.Kid != "" && key.Kid != header.Kid {
+			continue
+		}
+		if key.Alg != "" && key.Alg != header.Alg {
+			continue
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("no key found for JWT kid '%s'", header.Kid)
+}
+
+func verifySignature(alg string, publicKey crypto.PublicKey, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported JWT algorithm '%s'", alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+			return fmt.Errorf("invalid JWT signature")
+		}
+	case *ecdsa.PublicKey:
+		// JWS encodes ES256 signatures as r || s
+		if alg != "ES256" || len(signature) != 64 {
+			return fmt.Errorf("invalid JWT signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid JWT signature")
+		}
+	default:
+		return fmt.Errorf("unsupported JWT key")
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, v)
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch value := aud.(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, item := range value {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scopes are read from the space separated "scope" claim or the "scp" claim, which may also be a list
+func scopesFromClaims(claims map[string]interface{}) []string {
+	var scopes []string
+	for _, name := range []string{"scope", "scp"} {
+		switch value := claims[name].(type) {
+		case string:
+			scopes = append(scopes, strings.Fields(value)...)
+		case []interface{}:
+			for _, item := range value {
+				if scope, ok := item.(string); ok {
+					scopes = append(scopes, scope)
+				}
+			}
+		}
+	}
+	return scopes
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/microsoft/jupyterpython/util"
+)
+
+const ErrCodeTenantRequired = "ERR_TENANT_REQUIRED"
+
+// tenant ids become directory names and Jupyter session paths
+var regexTenant = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,62}$`)
+
+// TenantFromRequest returns the tenant of the request, or "" when multi tenancy is disabled
+func TenantFromRequest(r *http.Request) (string, error) {
+	cfg := util.GetConfig()
+	if !cfg.MultiTenant {
+		return "", nil
+	}
+	return ResolveTenant(PrincipalFromContext(r.Context()), r, cfg.TenantClaim, cfg.TenantHeader)
+}
+
+// ResolveTenant takes the tenant from the claim of the authenticated principal. Only a principal marked as
+// a trusted gateway may name the tenant in header instead, other callers could pick any tenant with it.
+func ResolveTenant(principal *Principal, r *http.Request, claim string, header string) (string, error) {
+	tenant := ""
+	if principal != nil && claim != "" {
+		tenant, _ = principal.Claims[claim].(string)
+	}
+	if tenant == "" && header != "" && principal != nil && principal.TrustedGateway {
+		tenant = r.Header.Get(header)
+	}
+
+	if tenant == "" {
+		return "", fmt.Errorf("request does not identify a tenant")
+	}
+	if !regexTenant.MatchString(tenant) {
+		return "", fmt.Errorf("invalid tenant id")
+	}
+	return tenant, nil
+}
@@ -16,27 +16,36 @@ package codeexecution
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/microsoft/jupyterpython/auth"
+	"github.com/microsoft/jupyterpython/egress"
+	"github.com/microsoft/jupyterpython/fileservices"
 	"github.com/microsoft/jupyterpython/jupyterservices"
+	"github.com/microsoft/jupyterpython/metrics"
 	"github.com/microsoft/jupyterpython/util"
 	"github.com/rs/zerolog/log"
 )
 
 var (
-	interrupt    = make(chan os.Signal, 1)
 	ws           *websocket.Conn
+	wsKernelID   string
 	requestMsgID string
 )
 
+const (
+	timeoutErrorName    = "Timeout"
+	connectionErrorName = "ConnectionError"
+)
+
 type ExecutionRequest struct {
 	Code string `json:"code"`
 }
@@ -66,33 +75,99 @@ type ExecutionResponse struct {
 	Stdout          string                    `json:"stdout"`
 	Stderr          string                    `json:"stderr"`
 	DiagnosticInfo  ExecuteCodeDiagnosticInfo `json:"diagnosticInfo"`
+	Files           *fileservices.FileChanges `json:"files,omitempty"`
+	Sync            *fileservices.SyncReport  `json:"sync,omitempty"`
 	//ServiceData     *json.RawMessage          `json:"serviceData"`
 	ApproximateSize int `json:"-"`
 }
 
 type ExecuteCodeDiagnosticInfo struct {
-	ExecutionDuration int `json:"executionDuration"`
+	ExecutionDuration   int                     `json:"executionDuration"`
+	PeakMemoryBytes     int64                   `json:"peakMemoryBytes,omitempty"`
+	CPUTimeMilliseconds int64                   `json:"cpuTimeMilliseconds,omitempty"`
+	BlockedEgress       []egress.BlockedRequest `json:"blockedEgress,omitempty"`
+	PolicyViolations    []PolicyViolation       `json:"policyViolations,omitempty"`
 	//MessageId         string `json:"messageId"`
 }
 
-var lock sync.Mutex
+var (
+	lock sync.Mutex
+	// executions waiting for lock
+	queueDepth atomic.Int64
+	// true once the first kernel connection was dialed, later dials are reconnects
+	wsDialed bool
+
+	executionsTotal     = metrics.NewCounter("jupyterpython_executions_total", "Executions by outcome and HResult.", "outcome", "hresult")
+	executionDuration   = metrics.NewHistogram("jupyterpython_execution_duration_seconds", "Time executions ran on the kernel by outcome.", metrics.DefaultBuckets, "outcome")
+	queueWait           = metrics.NewHistogram("jupyterpython_execution_queue_wait_seconds", "Time executions waited for the running one to finish.", metrics.DefaultBuckets)
+	kernelTimeouts      = metrics.NewCounter("jupyterpython_kernel_timeouts_total", "Executions that got no response from the kernel in time.")
+	websocketReconnects = metrics.NewCounter("jupyterpython_websocket_reconnects_total", "Kernel WebSocket connections dialed after the first one.")
+	_                   = metrics.NewGaugeFunc("jupyterpython_execution_queue_depth", "Executions waiting for the running one to finish.", func() float64 {
+		return float64(QueueDepth())
+	})
+)
+
+const (
+	OutcomeSuccess         = "success"
+	OutcomeError           = "error"
+	OutcomeTimeout         = "timeout"
+	OutcomePolicyViolation = "policy_violation"
+	OutcomeResourceLimit   = "resource_limit"
+	OutcomeConnectionError = "connection_error"
+	// rejected executions never reached the kernel and have no HResult
+	OutcomeRejected = "rejected"
+)
+
+// executionOutcome groups responses for the execution metrics, HResult has the details
+func executionOutcome(response ExecutionResponse) string {
+	switch {
+	case response.HResult == 0 && response.ErrorName == "":
+		return OutcomeSuccess
+	case response.ErrorName == timeoutErrorName:
+		return OutcomeTimeout
+	case response.ErrorName == PolicyViolationErrorName:
+		return OutcomePolicyViolation
+	case response.ErrorName == ResourceLimitExceededErrorName:
+		return OutcomeResourceLimit
+	case response.ErrorName == connectionErrorName:
+		return OutcomeConnectionError
+	}
+	return OutcomeError
+}
+
+// QueueDepth is the number of executions waiting for the running one to finish
+func QueueDepth() int {
+	return int(queueDepth.Load())
+}
 
 func Execute(w http.ResponseWriter, r *http.Request) {
 	// read code from the request body
+	queueDepth.Add(1)
+	waitStart := time.Now()
 	lock.Lock()
-	defer lock.Unlock()
+	queueDepth.Add(-1)
+	queueWait.Observe(time.Since(waitStart).Seconds())
+	// released early once the kernel is no longer needed
+	unlock := sync.OnceFunc(lock.Unlock)
+	defer unlock()
+
+	// no new executions while shutting down, also for requests that waited for the lock
+	if Draining() {
+		respondDraining(w)
+		return
+	}
 
 	// handle if request does not have any data
 	if r.ContentLength == 0 || r.Body == nil {
 		log.Err(nil).Msg("Request body is empty")
-		util.SendHTTPResponse(w, http.StatusBadRequest, "request body is empty", true)
+		rejectExecution(w, http.StatusBadRequest, "request body is empty")
 		return
 	}
 
 	code, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Err(err).Msg("Error reading request body")
-		util.SendHTTPResponse(w, http.StatusBadRequest, "error reading request body"+err.Error(), true)
+		rejectExecution(w, http.StatusBadRequest, "error reading request body"+err.Error())
 		return
 	}
 
@@ -101,17 +176,64 @@ func Execute(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(code, &codeString)
 	if err != nil {
 		log.Err(err).Msg("Error unmarshaling JSON")
-		util.SendHTTPResponse(w, http.StatusBadRequest, "error unmarshaling JSON"+err.Error(), true)
+		rejectExecution(w, http.StatusBadRequest, "error unmarshaling JSON"+err.Error())
+		return
+	}
+
+	apiVersion, err := fileservices.APIVersion(r)
+	if err != nil {
+		rejectExecution(w, http.StatusBadRequest, fileservices.ErrCodeInvalidParameter+": "+err.Error())
+		return
+	}
+
+	// reject the code before it reaches the kernel if it violates the policy
+	rejected, flagged := CheckPreExecutionHooks(codeString.Code)
+	if len(rejected) > 0 {
+		log.Warn().Str("rule", rejected[0].Rule).Msg(rejected[0].Error())
+		sendExecutionResponse(w, ExecutionResponse{
+			HResult:        PolicyViolationHResult,
+			ErrorName:      PolicyViolationErrorName,
+			ErrorMessage:   rejected[0].Error(),
+			DiagnosticInfo: ExecuteCodeDiagnosticInfo{PolicyViolations: append(rejected, flagged...)},
+		})
+		return
+	}
+
+	// every tenant runs code in its own kernel
+	tenant, err := auth.TenantFromRequest(r)
+	if err != nil {
+		log.Err(err).Msg("Error resolving tenant")
+		rejectExecution(w, http.StatusBadRequest, auth.ErrCodeTenantRequired+": "+err.Error())
 		return
 	}
 
 	// get the kernelId
-	kernelId, sessionId, err := jupyterservices.CheckKernels("")
+	var kernelId, sessionId string
+	if tenant != "" {
+		kernelId, sessionId, err = jupyterservices.CheckTenantKernel(tenant)
+	} else {
+		kernelId, sessionId, err = jupyterservices.CheckKernels("")
+	}
 	if err != nil {
 		log.Err(err).Msg("Error checking kernels")
-		util.SendHTTPResponse(w, http.StatusInternalServerError, "error checking kernels"+err.Error(), true)
+		rejectExecution(w, http.StatusInternalServerError, "error checking kernels"+err.Error())
+		return
+	}
+	if !defaultDrainer.Begin(kernelId) {
+		respondDraining(w)
 		return
 	}
+	defer defaultDrainer.End(kernelId)
+
+	// tenant kernels run as the tenant's uid inside its root, code never runs in a kernel that is not isolated
+	kernelUID := os.Getuid()
+	if tenant != "" {
+		if kernelUID, err = isolateTenantKernel(kernelId, sessionId, tenant); err != nil {
+			log.Err(err).Str("tenant", tenant).Msg("Error isolating tenant kernel")
+			rejectExecution(w, http.StatusInternalServerError, "error isolating tenant kernel")
+			return
+		}
+	}
 
 	// This is just for testing purposes
 	// if code == nil {
@@ -120,39 +242,148 @@ func Execute(w http.ResponseWriter, r *http.Request) {
 	// 	code = []byte(sampleCode)
 	// }
 
+	// code can not run while its root is over the storage quota, files have to be deleted first
+	rootPath, err := fileservices.RootPath(r)
+	if err == nil && fileservices.QuotaEnabled() {
+		if status, err := fileservices.GetQuotaStatus(rootPath); err == nil && status.Exceeded {
+			log.Warn().Str("root", rootPath).Msg("Storage quota exceeded, execution rejected")
+			rejectExecution(w, http.StatusInsufficientStorage, fileservices.ErrCodeQuotaExceeded+": storage quota exceeded, delete files to continue")
+			return
+		}
+	}
+
+	// snapshot the data root to report the files the code wrote
+	var before *fileservices.Snapshot
+	cfg := util.GetConfig()
+	if err == nil && cfg.ExecutionFileChanges {
+		if before, err = fileservices.TakeSnapshot(rootPath, cfg.FileSnapshotMaxEntries); err != nil {
+			log.Err(err).Msg("Error taking file snapshot")
+		}
+	}
+
 	// execute the code
+	executionStart := time.Now()
 	response := executeCode(kernelId, sessionId, codeString.Code)
+	executionDuration.Observe(time.Since(executionStart).Seconds(), executionOutcome(response))
+	response.DiagnosticInfo.PolicyViolations = flagged
+	response.DiagnosticInfo.BlockedEgress = egress.BlockedSince(executionStart, kernelUID)
+
+	if before != nil {
+		if after, err := fileservices.TakeSnapshot(rootPath, cfg.FileSnapshotMaxEntries); err == nil {
+			changes := fileservices.Diff(before, after).ForAPIVersion(apiVersion)
+			response.Files = &changes
+			// the snapshot already has the new usage of the root, no need to wait for the next scan
+			if usage, complete := after.Usage(); complete {
+				fileservices.RecordUsage(rootPath, usage)
+			}
+		} else {
+			log.Err(err).Msg("Error taking file snapshot")
+		}
+	}
+
+	// push what the code wrote to the synced object storage, nothing to do if no file changed.
+	// The push does not use the kernel, so the next execution can start meanwhile.
+	unlock()
+	if rootPath != "" && (response.Files == nil || len(response.Files.Created)+len(response.Files.Modified) > 0) {
+		response.Sync = fileservices.PushAfterExecution(rootPath)
+	}
+
+	sendExecutionResponse(w, response)
+}
+
+// rejectExecution responds to an execution that never reached the kernel and counts it as rejected
+func rejectExecution(w http.ResponseWriter, statusCode int, message string) {
+	executionsTotal.Inc(OutcomeRejected, "")
+	util.SendHTTPResponse(w, statusCode, message, true)
+}
+
+func respondDraining(w http.ResponseWriter) {
+	log.Warn().Msg("Execution rejected, server is shutting down")
+	w.Header().Set("Connection", "close")
+	rejectExecution(w, http.StatusServiceUnavailable, "server is shutting down")
+}
+
+// convert the response to JSON and return
+func sendExecutionResponse(w http.ResponseWriter, response ExecutionResponse) {
+	executionsTotal.Inc(executionOutcome(response), strconv.Itoa(response.HResult))
 
-	// convert the response to JSON and return
 	jsonResponse, err := json.Marshal(response)
 	if err != nil {
 		log.Err(err).Msg("Error marshaling JSON")
 		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling JSON"+err.Error(), true)
+		return
 	}
 	util.SendHTTPResponse(w, http.StatusOK, string(jsonResponse), false)
 }
 
 func executeCode(kernelId, sessionId, code string) ExecutionResponse {
-	fmt.Println("Executing code in the session using WebSocket:")
+	log.Info().Str("kernel_id", kernelId).Msg("Executing code in the session using WebSocket")
+
+	// track the kernel's memory and cpu while the code runs
+	sampler := jupyterservices.StartExecutionSampler(kernelId)
 
 	responseChan := connectWebSocket(kernelId, sessionId, code)
 
+	// a nil channel never fires, so executions without a sampler are not limited
+	var exceeded <-chan struct{}
+	if sampler != nil {
+		exceeded = sampler.Exceeded()
+	}
+
 	// select to timeout if no response is received in 60 seconds, else return the response
+	var response ExecutionResponse
 	select {
+	case <-exceeded:
+		violation := sampler.Violation()
+		log.Error().Str("kernel_id", kernelId).Str("limit", violation.Limit).Msg(violation.Error())
+		if err := jupyterservices.RestartKernel(kernelId); err != nil {
+			log.Err(err).Str("kernel_id", kernelId).Msg("Error restarting kernel after limit was exceeded")
+		}
+		// the socket of the restarted kernel is reconnected by the next execution
+		onClose()
+		response = ExecutionResponse{
+			HResult:      ResourceLimitExceededHResult,
+			ErrorName:    ResourceLimitExceededErrorName,
+			ErrorMessage: violation.Error(),
+		}
 	case <-time.After(jupyterservices.Timeout):
-		fmt.Println("Timeout: No response received.")
-		return ExecutionResponse{
+		log.Warn().Str("kernel_id", kernelId).Msg("Timeout: No response received.")
+		kernelTimeouts.Inc()
+		response = ExecutionResponse{
 			HResult:      1,
 			Result:       nil,
-			ErrorName:    "Timeout",
+			ErrorName:    timeoutErrorName,
 			ErrorMessage: "No response received",
 			Stdout:       "",
 			Stderr:       "",
 		}
-	case response := <-responseChan:
-		fmt.Println("Received response:", response)
-		return response
+	case result, ok := <-responseChan:
+		log.Debug().Msgf("Received response: %v", result)
+		response = result
+		// closed without a result when the connection failed or was lost
+		if !ok {
+			response = ExecutionResponse{
+				HResult:      1,
+				ErrorName:    connectionErrorName,
+				ErrorMessage: "Connection to the kernel failed or was lost",
+			}
+		}
 	}
+
+	// the open files and address space rlimits fail the cell with a python error
+	if response.ErrorName != "" && response.ErrorName != ResourceLimitExceededErrorName {
+		if violation := jupyterservices.GetKernelLimits().CheckError(response.ErrorName, response.ErrorMessage); violation != nil {
+			log.Error().Str("kernel_id", kernelId).Str("limit", violation.Limit).Msg(violation.Error())
+			response.HResult = ResourceLimitExceededHResult
+			response.ErrorName = ResourceLimitExceededErrorName
+			response.ErrorMessage = violation.Error()
+		}
+	}
+
+	if sampler != nil {
+		response.DiagnosticInfo.PeakMemoryBytes, response.DiagnosticInfo.CPUTimeMilliseconds = sampler.Stop()
+	}
+	return response
 }
 
 func onMessage(message []byte) *ExecutePlainTextResult {
@@ -214,7 +445,7 @@ func onOpen(ws *websocket.Conn, sessionId string, code string) []byte {
 
 		// print the message in JSON format
 		jsonMessage, _ = json.Marshal(message)
-		fmt.Printf("JSON message: %s\n", jsonMessage)
+		log.Debug().Msgf("JSON message: %s", jsonMessage)
 
 		err := ws.WriteJSON(message)
 		if err != nil {
@@ -227,22 +458,31 @@ func onOpen(ws *websocket.Conn, sessionId string, code string) []byte {
 
 // connect via websocket and execute code and return the result
 func connectWebSocket(kernelID string, sessionID string, code string) <-chan ExecutionResponse {
-	responseChan := make(chan ExecutionResponse)
+	// buffered so the reader does not block forever when executeCode stopped waiting
+	responseChan := make(chan ExecutionResponse, 1)
 
-	u := url.URL{Scheme: "ws", Host: "localhost:8888", Path: "/api/kernels/" + kernelID + "/channels", RawQuery: "token=" + jupyterservices.Token}
+	u := jupyterservices.KernelChannelsURL(kernelID)
 	err := error(nil)
+	// the connection belongs to a single kernel, reconnect when another tenant's kernel is used
+	if ws != nil && wsKernelID != kernelID {
+		onClose()
+	}
 	if ws == nil {
-		ws, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
+		ws, _, err = websocket.DefaultDialer.Dial(u, jupyterservices.AuthHeader())
 		if err != nil {
 			log.Err(err).Msg("Error dialing WebSocket")
 			close(responseChan)
 			return responseChan
 		}
-		fmt.Printf("Connected to WebSocket %s\n", ws.RemoteAddr())
+		wsKernelID = kernelID
+		if wsDialed {
+			websocketReconnects.Inc()
+		}
+		wsDialed = true
+		log.Info().Msgf("Connected to WebSocket %s", ws.RemoteAddr())
 	}
 
 	ws.SetCloseHandler(func(code int, text string) error {
-		fmt.Println("WebSocket closed with code", code, text)
 		log.Info().Msgf("WebSocket closed with code %d: %s\n", code, text)
 		onClose()
 		return err
@@ -270,7 +510,6 @@ func connectWebSocket(kernelID string, sessionID string, code string) <-chan Exe
 
 			_, message, err := ws.ReadMessage()
 			if err != nil {
-				fmt.Println("Error reading message:", err)
 				log.Err(err).Msg("Error reading message")
 				ws = nil
 				return
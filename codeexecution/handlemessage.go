@@ -16,10 +16,12 @@ package codeexecution
 
 import (
 	"encoding/json"
-	"fmt"
 	"strings"
 	"time"
 	"unicode/utf8"
+
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
 )
 
 type ExecutePlainTextResultErrorCode int
@@ -31,6 +33,12 @@ const (
 	ExecutionAborted
 )
 
+const (
+	// returned when the kernel went over one of the configured resource limits and was restarted
+	ResourceLimitExceededHResult   = -2147205104
+	ResourceLimitExceededErrorName = "ResourceLimitExceeded"
+)
+
 type MessageHeader struct {
 	MsgId   string `json:"msg_id"`
 	MsgType string `json:"msg_type"`
@@ -100,7 +108,7 @@ func NewNotebookClientOptions() *NotebookClientOptions {
 	return &NotebookClientOptions{
 		Url:                    "http://localhost",
 		Token:                  "",
-		MaxStdoutMessageLength: 1024,
+		MaxStdoutMessageLength: util.GetConfig().OutputMaxLength,
 		IdleTimeout:            time.Minute * 30,
 	}
 }
@@ -122,7 +130,7 @@ func HandleAndProcessMessage(jsonMessage []byte, msg_id string) *ExecuteResultAn
 
 	err := json.Unmarshal(jsonMessage, &message)
 	if err != nil {
-		fmt.Println("Error unmarshalling message: ", err)
+		log.Err(err).Msg("Error unmarshalling message")
 		return nil
 	}
 
@@ -154,7 +162,7 @@ func HandleAndProcessMessage(jsonMessage []byte, msg_id string) *ExecuteResultAn
 // - status
 // - stream
 func ConvertToExecutionResponse(message GenericMessage) {
-	fmt.Println("Message Type: ", message.MsgType)
+	log.Debug().Str("msg_type", message.MsgType).Msg("Message received")
 	switch message.MsgType {
 	case "execute_reply":
 		HandleMessage_ExecuteReply(message)
@@ -337,8 +345,11 @@ var m_stdout strings.Builder
 var m_stderr strings.Builder
 
 func TransferOutputMessageToExecuteResult(result *ExecutePlainTextResult) {
+	// redact before trimming so a masked secret is never cut in half
+	redactOutputMessage(&m_stderr)
 	TrimAndAppendEllipses(&m_stderr, NewNotebookClientOptions().MaxStdoutMessageLength)
 	result.Stderr = m_stderr.String()
+	redactOutputMessage(&m_stdout)
 	TrimAndAppendEllipses(&m_stdout, NewNotebookClientOptions().MaxStdoutMessageLength)
 	result.Stdout = m_stdout.String()
 
@@ -347,6 +358,12 @@ func TransferOutputMessageToExecuteResult(result *ExecutePlainTextResult) {
 	m_stdout.Reset()
 }
 
+func redactOutputMessage(sb *strings.Builder) {
+	redacted := util.Redact(sb.String())
+	sb.Reset()
+	sb.WriteString(redacted)
+}
+
 func AppendOutputMessage(sb *strings.Builder, text string) {
 	if NewNotebookClientOptions().MaxStdoutMessageLength <= 0 {
 		// no output is allowed
@@ -431,6 +448,14 @@ func BuildOfficePyResultForImage(imageBase64Data string) string {
 func ConvertJupyterPlainResultToExecuteCodeResult(plainResult ExecutePlainTextResult, startTime time.Time) ExecutionResponse {
 	result := ExecutionResponse{}
 
+	// mask secrets in everything the kernel returned, image data is left untouched
+	plainResult.TextPlain = util.Redact(plainResult.TextPlain)
+	if plainResult.ImageBase64Data == "" {
+		plainResult.TextOfficePy = util.Redact(plainResult.TextOfficePy)
+	}
+	plainResult.ErrorMessage = util.Redact(plainResult.ErrorMessage)
+	plainResult.ErrorTraceback = util.Redact(plainResult.ErrorTraceback)
+
 	if plainResult.Success {
 		if plainResult.TextOfficePy != "" {
 			j, _ := json.RawMessage(plainResult.TextOfficePy).MarshalJSON()
@@ -462,10 +487,10 @@ func ConvertJupyterPlainResultToExecuteCodeResult(plainResult ExecutePlainTextRe
 		switch plainResult.ErrorCode {
 		case KernelRestarted:
 			result.HResult = -2147205111
-			fmt.Println("Kernel restarted")
+			log.Warn().Msg("Kernel restarted")
 		case ExecutionAborted:
 			result.HResult = -2147205113
-			fmt.Println("Execution aborted")
+			log.Warn().Msg("Execution aborted")
 		default:
 			if plainResult.ErrorName == "KeyboardInterrupt" {
 				result.HResult = -2147205110
@@ -476,7 +501,7 @@ func ConvertJupyterPlainResultToExecuteCodeResult(plainResult ExecutePlainTextRe
 					result.HResult = -2147205116
 				}
 			}
-			fmt.Println("Error: ", plainResult.ErrorName, " - ", plainResult.ErrorMessage, " - ", plainResult.ErrorTraceback)
+			log.Info().Msgf("Error: %s - %s - %v", plainResult.ErrorName, plainResult.ErrorMessage, plainResult.ErrorTraceback)
 		}
 
 		result.ErrorMessage = plainResult.ErrorMessage
@@ -489,7 +514,7 @@ func ConvertJupyterPlainResultToExecuteCodeResult(plainResult ExecutePlainTextRe
 			result.ErrorName = "Timeout"
 			result.ErrorMessage = "Timeout"
 		} else if result.ErrorName == "ProxyError" {
-			fmt.Println("Proxy error")
+			log.Warn().Msg("Proxy error")
 		}
 	}
 
@@ -15,43 +15,235 @@
 package codeexecution
 
 import (
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/microsoft/jupyterpython/fileservices"
 	"github.com/microsoft/jupyterpython/jupyterservices"
+	"github.com/microsoft/jupyterpython/metrics"
 	"github.com/microsoft/jupyterpython/util"
 	"github.com/rs/zerolog/log"
 )
 
-var lastCodeHealthCheck bool
+const (
+	HealthStatusReady    = "ready"
+	HealthStatusNotReady = "not_ready"
+	HealthStatusDraining = "draining"
+)
+
+// ProbeResult is the outcome of one run of the health probe code
+type ProbeResult struct {
+	Time                time.Time `json:"time"`
+	Success             bool      `json:"success"`
+	LatencyMilliseconds int64     `json:"latency_ms"`
+	Error               string    `json:"error,omitempty"`
+}
+
+// JupyterHealth is the state of the Jupyter API in the deep health report
+type JupyterHealth struct {
+	Reachable           bool   `json:"reachable"`
+	LatencyMilliseconds int64  `json:"latency_ms"`
+	Kernels             int    `json:"kernels"`
+	Connections         int    `json:"connections"`
+	Error               string `json:"error,omitempty"`
+}
+
+// DeepHealthReport is the response of /healthz/deep, KernelLatencyMilliseconds is the round trip of the last successful probe
+type DeepHealthReport struct {
+	Status                    string                  `json:"status"`
+	Jupyter                   JupyterHealth           `json:"jupyter"`
+	KernelLatencyMilliseconds *int64                  `json:"kernel_latency_ms"`
+	Probes                    []ProbeResult           `json:"probes"`
+	Disk                      *fileservices.DiskSpace `json:"disk,omitempty"`
+	DiskError                 string                  `json:"disk_error,omitempty"`
+	QueueDepth                int                     `json:"queue_depth"`
+}
+
+// Prober keeps the last results of the health probe. It is healthy once a probe succeeded
+// and as long as fewer than FailureThreshold probes failed in a row.
+type Prober struct {
+	FailureThreshold int
+	History          int
+
+	lock                sync.RWMutex
+	results             []ProbeResult
+	consecutiveFailures int
+	succeeded           bool
+}
+
+func NewProber(failureThreshold int, history int) *Prober {
+	return &Prober{FailureThreshold: failureThreshold, History: history}
+}
+
+var (
+	defaultProber = NewProber(util.GetConfig().HealthProbeFailureThreshold, util.GetConfig().HealthProbeHistory)
+
+	probeDuration = metrics.NewHistogram("jupyterpython_health_probe_duration_seconds", "Kernel round trip of the health probe by result.", metrics.DefaultBuckets, "success")
+)
+
+func (p *Prober) Record(result ProbeResult) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.results = append([]ProbeResult{result}, p.results[:min(len(p.results), p.History-1)]...)
+	if result.Success {
+		p.consecutiveFailures = 0
+		p.succeeded = true
+	} else {
+		p.consecutiveFailures++
+	}
+}
+
+// Results returns the kept results from the newest to the oldest
+func (p *Prober) Results() []ProbeResult {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return append([]ProbeResult{}, p.results...)
+}
+
+func (p *Prober) Healthy() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.succeeded && p.consecutiveFailures < p.FailureThreshold
+}
 
 func HealthHandler(w http.ResponseWriter, r *http.Request) {
-	if !lastCodeHealthCheck {
+	// taken out of rotation while running executions finish
+	if Draining() {
+		util.SendHTTPResponse(w, http.StatusServiceUnavailable, "draining", true)
+		return
+	}
+	if !defaultProber.Healthy() {
 		util.SendHTTPResponse(w, http.StatusInternalServerError, "unhealthy exec code failed", true)
 		return
 	}
 	util.SendHTTPResponse(w, http.StatusOK, "healthy", true)
 }
 
+// LiveHandler succeeds as long as the server answers, also while it drains
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	util.SendHTTPResponse(w, http.StatusOK, "alive", true)
+}
+
+// ReadyHandler succeeds while the server accepts executions and the health probe passes
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus()
+	if status != HealthStatusReady {
+		util.SendHTTPResponse(w, http.StatusServiceUnavailable, status, true)
+		return
+	}
+	util.SendHTTPResponse(w, http.StatusOK, status, true)
+}
+
+// DeepHealthHandler reports the Jupyter API, the last probes, the disk space of the data root and the queue depth
+func DeepHealthHandler(w http.ResponseWriter, r *http.Request) {
+	report := DeepHealthReport{
+		Status:     healthStatus(),
+		Probes:     defaultProber.Results(),
+		QueueDepth: QueueDepth(),
+	}
+
+	start := time.Now()
+	status, err := jupyterservices.GetAPIStatus()
+	report.Jupyter.LatencyMilliseconds = time.Since(start).Milliseconds()
+	if err != nil {
+		// the endpoint is not authenticated, details only go to the log
+		log.Err(err).Msg("Jupyter API unreachable")
+		report.Jupyter.Error = "Jupyter API unreachable"
+	} else {
+		report.Jupyter.Reachable = true
+		report.Jupyter.Kernels = status.Kernels
+		report.Jupyter.Connections = status.Connections
+	}
+
+	for _, probe := range report.Probes {
+		if probe.Success {
+			latency := probe.LatencyMilliseconds
+			report.KernelLatencyMilliseconds = &latency
+			break
+		}
+	}
+
+	if disk, err := fileservices.DataRootDiskSpace(); err != nil {
+		report.DiskError = err.Error()
+	} else {
+		report.Disk = &disk
+	}
+
+	response, err := json.Marshal(report)
+	if err != nil {
+		log.Err(err).Msg("Error marshaling JSON")
+		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling JSON"+err.Error(), true)
+		return
+	}
+	statusCode := http.StatusOK
+	if report.Status != HealthStatusReady {
+		statusCode = http.StatusServiceUnavailable
+	}
+	util.SendHTTPResponse(w, statusCode, string(response), false)
+}
+
+func healthStatus() string {
+	switch {
+	case Draining():
+		return HealthStatusDraining
+	case !defaultProber.Healthy():
+		return HealthStatusNotReady
+	}
+	return HealthStatusReady
+}
+
+// PeriodicCodeExecution runs the health probe code every HEALTH_PROBE_INTERVAL until the server drains
 func PeriodicCodeExecution() {
-	time.Sleep(30 * time.Second)
-	ticker := time.NewTicker(15 * time.Second)
+	cfg := util.GetConfig()
+	time.Sleep(cfg.HealthProbeInitialDelay)
+	ticker := time.NewTicker(cfg.HealthProbeInterval)
 	defer ticker.Stop()
 
-	sampleCode := "1+1"
-	for range ticker.C {
-		kernelId, sessionId, err := jupyterservices.CheckKernels("")
-		if err != nil {
-			log.Error().Msg("Failed to check kernels: " + err.Error())
-			panic("Health Ping Failed with error: " + err.Error())
+	for ; ; <-ticker.C {
+		result, ok := probe(cfg.HealthProbeCode)
+		if !ok {
+			return
 		}
-		response := executeCode(kernelId, sessionId, sampleCode)
-		if response.ErrorName == "" || response.Stderr == "" {
-			lastCodeHealthCheck = true
+		defaultProber.Record(result)
+		probeDuration.Observe(float64(result.LatencyMilliseconds)/1000, strconv.FormatBool(result.Success))
+		if result.Success {
 			log.Info().Msg("Periodic code execution successful")
 		} else {
-			lastCodeHealthCheck = false
-			log.Error().Msg("Failed to execute code")
+			log.Error().Str("error", result.Error).Msg("Failed to execute code")
 		}
 	}
 }
+
+// probe runs code on the default kernel after the queued executions, false once the server drains
+func probe(code string) (ProbeResult, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	start := time.Now()
+	result := ProbeResult{Time: start.UTC()}
+	if Draining() {
+		return result, false
+	}
+	kernelId, sessionId, err := jupyterservices.CheckKernels("")
+	if err != nil {
+		result.Error = util.Redact("error checking kernels: " + err.Error())
+		result.LatencyMilliseconds = time.Since(start).Milliseconds()
+		return result, true
+	}
+	if !defaultDrainer.Begin(kernelId) {
+		return result, false
+	}
+	defer defaultDrainer.End(kernelId)
+
+	start = time.Now()
+	response := executeCode(kernelId, sessionId, code)
+	result.LatencyMilliseconds = time.Since(start).Milliseconds()
+	result.Success = response.HResult == 0 && response.ErrorName == ""
+	if !result.Success {
+		result.Error = util.Redact(response.ErrorName + ": " + response.ErrorMessage)
+	}
+	return result, true
+}
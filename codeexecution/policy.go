@@ -0,0 +1,250 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codeexecution
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PolicyActionReject = "reject"
+	PolicyActionFlag   = "flag"
+
+	PolicyRuleImport      = "import"
+	PolicyRuleShellEscape = "shell_escape"
+	PolicyRuleRegex       = "regex"
+	PolicyRuleMaxSize     = "max_size"
+
+	// returned when the code was rejected before it reached the kernel
+	PolicyViolationHResult   = -2147205103
+	PolicyViolationErrorName = "PolicyViolation"
+)
+
+// PolicyViolation is a rule matched by the code about to be executed
+type PolicyViolation struct {
+	Rule   string `json:"rule"`
+	Type   string `json:"type"`
+	Action string `json:"action"`
+	Match  string `json:"match"`
+	Line   int    `json:"line,omitempty"`
+}
+
+func (v PolicyViolation) Error() string {
+	if v.Line > 0 {
+		return fmt.Sprintf("code violates policy rule '%s' (%s) at line %d: %s", v.Rule, v.Type, v.Line, v.Match)
+	}
+	return fmt.Sprintf("code violates policy rule '%s' (%s): %s", v.Rule, v.Type, v.Match)
+}
+
+// PreExecutionHook inspects code before it is sent to the kernel
+type PreExecutionHook func(code string) []PolicyViolation
+
+var (
+	hooksLock          sync.RWMutex
+	preExecutionHooks  []PreExecutionHook
+	regexImport        = regexp.MustCompile(`^\s*import\s+(.+)$`)
+	regexFromImport    = regexp.MustCompile(`^\s*from\s+([\w.]+)\s+import\b`)
+	regexDynamicImport = regexp.MustCompile(`(?:__import__|import_module)\(\s*['"]([\w.]+)['"]`)
+	regexShellEscape   = regexp.MustCompile(`^\s*(!|%%?(bash|sh|script|system|sx|perl|ruby)\b)|get_ipython\(\)\.(system|getoutput)\(`)
+)
+
+// RegisterPreExecutionHook adds a hook that runs before every execution
+func RegisterPreExecutionHook(hook PreExecutionHook) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	preExecutionHooks = append(preExecutionHooks, hook)
+}
+
+// CheckPreExecutionHooks runs every registered hook and returns the violations that reject the code and the ones that only flag it
+func CheckPreExecutionHooks(code string) ([]PolicyViolation, []PolicyViolation) {
+	hooksLock.RLock()
+	defer hooksLock.RUnlock()
+
+	var rejected, flagged []PolicyViolation
+	for _, hook := range preExecutionHooks {
+		for _, violation := range hook(code) {
+			if violation.Action == PolicyActionFlag {
+				flagged = append(flagged, violation)
+			} else {
+				rejected = append(rejected, violation)
+			}
+		}
+	}
+	return rejected, flagged
+}
+
+// CodePolicy is the set of rules loaded from the policy file
+type CodePolicy struct {
+	Rules []CodePolicyRule `json:"rules" yaml:"rules"`
+}
+
+// CodePolicyRule is a single rule of the policy file.
+// Values holds module names for import rules, magics for shell_escape rules and patterns for regex rules.
+type CodePolicyRule struct {
+	Name   string   `json:"name" yaml:"name"`
+	Type   string   `json:"type" yaml:"type"`
+	Action string   `json:"action" yaml:"action"`
+	Values []string `json:"values" yaml:"values"`
+	Limit  int      `json:"limit" yaml:"limit"`
+
+	patterns []*regexp.Regexp
+}
+
+// LoadCodePolicy reads a YAML or JSON policy file
+func LoadCodePolicy(path string) (*CodePolicy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading code policy file: %v", err)
+	}
+	return ParseCodePolicy(content)
+}
+
+// ParseCodePolicy parses and validates a policy. JSON is accepted since it is a subset of YAML.
+func ParseCodePolicy(content []byte) (*CodePolicy, error) {
+	policy := &CodePolicy{}
+	if err := yaml.Unmarshal(content, policy); err != nil {
+		return nil, fmt.Errorf("error parsing code policy: %v", err)
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%s-%d", rule.Type, i)
+		}
+		if rule.Action == "" {
+			rule.Action = PolicyActionReject
+		}
+		if rule.Action != PolicyActionReject && rule.Action != PolicyActionFlag {
+			return nil, fmt.Errorf("rule '%s' has unknown action '%s'", rule.Name, rule.Action)
+		}
+
+		switch rule.Type {
+		case PolicyRuleImport, PolicyRuleShellEscape:
+		case PolicyRuleRegex:
+			for _, value := range rule.Values {
+				pattern, err := regexp.Compile(value)
+				if err != nil {
+					return nil, fmt.Errorf("rule '%s' has invalid pattern '%s': %v", rule.Name, value, err)
+				}
+				rule.patterns = append(rule.patterns, pattern)
+			}
+		case PolicyRuleMaxSize:
+			if rule.Limit <= 0 {
+				return nil, fmt.Errorf("rule '%s' needs a positive limit", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule '%s' has unknown type '%s'", rule.Name, rule.Type)
+		}
+	}
+	return policy, nil
+}
+
+// Check returns every rule the code matches, at most one violation per rule
+func (p *CodePolicy) Check(code string) []PolicyViolation {
+	var violations []PolicyViolation
+	lines := strings.Split(code, "\n")
+	for _, rule := range p.Rules {
+		if violation, ok := rule.check(code, lines); ok {
+			violations = append(violations, violation)
+		}
+	}
+	return violations
+}
+
+func (rule *CodePolicyRule) check(code string, lines []string) (PolicyViolation, bool) {
+	violation := PolicyViolation{Rule: rule.Name, Type: rule.Type, Action: rule.Action}
+
+	if rule.Type == PolicyRuleMaxSize {
+		if len(code) > rule.Limit {
+			violation.Match = fmt.Sprintf("code is %d bytes, limit is %d", len(code), rule.Limit)
+			return violation, true
+		}
+		return violation, false
+	}
+
+	for i, line := range lines {
+		if match := rule.matchLine(line); match != "" {
+			violation.Match = match
+			violation.Line = i + 1
+			return violation, true
+		}
+	}
+	return violation, false
+}
+
+func (rule *CodePolicyRule) matchLine(line string) string {
+	switch rule.Type {
+	case PolicyRuleImport:
+		for _, module := range importedModules(line) {
+			for _, blocked := range rule.Values {
+				if module == blocked || strings.HasPrefix(module, blocked+".") {
+					return module
+				}
+			}
+		}
+	case PolicyRuleShellEscape:
+		match := regexShellEscape.FindString(line)
+		if match == "" {
+			return ""
+		}
+		match = strings.TrimSpace(match)
+		// an empty list blocks every shell escape, otherwise only the listed ones
+		if len(rule.Values) == 0 {
+			return match
+		}
+		for _, value := range rule.Values {
+			if match == value {
+				return match
+			}
+		}
+	case PolicyRuleRegex:
+		for _, pattern := range rule.patterns {
+			if match := pattern.FindString(line); match != "" {
+				return match
+			}
+		}
+	}
+	return ""
+}
+
+// importedModules returns the modules a line of python imports, both through statements and dynamic imports
+func importedModules(line string) []string {
+	var modules []string
+	// statements can be chained with ';' on a single line
+	for _, statement := range strings.Split(line, ";") {
+		if match := regexImport.FindStringSubmatch(statement); match != nil {
+			names := strings.SplitN(match[1], "#", 2)[0]
+			for _, part := range strings.Split(names, ",") {
+				fields := strings.Fields(part)
+				if len(fields) > 0 {
+					modules = append(modules, fields[0])
+				}
+			}
+		}
+		if match := regexFromImport.FindStringSubmatch(statement); match != nil {
+			modules = append(modules, match[1])
+		}
+	}
+	for _, match := range regexDynamicImport.FindAllStringSubmatch(line, -1) {
+		modules = append(modules, match[1])
+	}
+	return modules
+}
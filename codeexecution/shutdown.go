@@ -0,0 +1,152 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codeexecution
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/microsoft/jupyterpython/jupyterservices"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// time interrupted cells get to return after the grace period
+	drainInterruptWait = 10 * time.Second
+	// time CloseWebSocket waits for an execution still using the connection
+	closeWebSocketWait = 5 * time.Second
+)
+
+// Drainer tracks the running executions so a shutdown can stop accepting new ones and wait for them
+type Drainer struct {
+	// Interrupt stops the cell running on a kernel
+	Interrupt func(kernelId string) error
+
+	lock     sync.Mutex
+	draining bool
+	running  map[string]int
+	count    int
+	idle     chan struct{}
+}
+
+func NewDrainer(interrupt func(kernelId string) error) *Drainer {
+	return &Drainer{Interrupt: interrupt, running: map[string]int{}, idle: make(chan struct{})}
+}
+
+var defaultDrainer = NewDrainer(jupyterservices.InterruptKernel)
+
+// Begin registers an execution on kernelId, false once draining started
+func (d *Drainer) Begin(kernelId string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.draining {
+		return false
+	}
+	d.running[kernelId]++
+	d.count++
+	return true
+}
+
+// End unregisters an execution started with Begin
+func (d *Drainer) End(kernelId string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.running[kernelId]--; d.running[kernelId] <= 0 {
+		delete(d.running, kernelId)
+	}
+	d.count--
+	if d.draining && d.count == 0 {
+		close(d.idle)
+	}
+}
+
+func (d *Drainer) Draining() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.draining
+}
+
+// Drain stops accepting executions and waits up to gracePeriod for the running ones to finish.
+// Kernels still running a cell after that are interrupted, it returns the number of interrupted kernels.
+func (d *Drainer) Drain(gracePeriod time.Duration) int {
+	d.lock.Lock()
+	if !d.draining {
+		d.draining = true
+		if d.count == 0 {
+			close(d.idle)
+		}
+	}
+	d.lock.Unlock()
+
+	select {
+	case <-d.idle:
+		return 0
+	case <-time.After(gracePeriod):
+	}
+
+	d.lock.Lock()
+	kernels := make([]string, 0, len(d.running))
+	for kernelId := range d.running {
+		kernels = append(kernels, kernelId)
+	}
+	d.lock.Unlock()
+	for _, kernelId := range kernels {
+		log.Warn().Str("kernel_id", kernelId).Msg("Interrupting execution still running after the shutdown grace period")
+		if err := d.Interrupt(kernelId); err != nil {
+			log.Err(err).Str("kernel_id", kernelId).Msg("Error interrupting kernel")
+		}
+	}
+
+	select {
+	case <-d.idle:
+	case <-time.After(drainInterruptWait):
+		log.Warn().Msg("Interrupted executions did not finish")
+	}
+	return len(kernels)
+}
+
+// Drain stops accepting executions, lets the running ones finish within gracePeriod and interrupts them after that
+func Drain(gracePeriod time.Duration) int {
+	return defaultDrainer.Drain(gracePeriod)
+}
+
+// Draining reports whether the server is shutting down and no longer accepts executions
+func Draining() bool {
+	return defaultDrainer.Draining()
+}
+
+// CloseWebSocket closes the kernel connection with a normal close frame.
+// The connection belongs to the execution holding lock, so it is left open while one still runs after closeWebSocketWait.
+func CloseWebSocket() {
+	deadline := time.Now().Add(closeWebSocketWait)
+	for !lock.TryLock() {
+		if time.Now().After(deadline) {
+			log.Warn().Msg("Execution still running, not closing the kernel WebSocket")
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer lock.Unlock()
+
+	if ws == nil {
+		return
+	}
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "server shutting down")
+	if err := ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+		log.Err(err).Msg("Error sending WebSocket close")
+	}
+	onClose()
+}
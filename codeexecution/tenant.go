@@ -0,0 +1,60 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codeexecution
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/microsoft/jupyterpython/fileservices"
+)
+
+// tenantIsolationCode drops the root privileges of a tenant kernel to the uid owning the tenant root and
+// moves it into that root, so it can not read or write the files of other tenants. A kernel that already
+// dropped them must be running as the same uid, anything else is rejected. The Jupyter token is removed from
+// the environment, with it tenant code could run code in the kernels of other tenants.
+const tenantIsolationCode = `import os as _os
+_os.environ.pop("JUPYTER_TOKEN", None)
+_os.environ.pop("JUPYTER_GEN_TOKEN", None)
+if _os.getuid() == 0:
+    _os.setgroups([])
+    _os.setgid(%[1]d)
+    _os.setuid(%[1]d)
+elif _os.getuid() != %[1]d or _os.getgid() != %[1]d:
+    raise PermissionError("kernel runs as uid %%d, not the tenant uid %[1]d" %% _os.getuid())
+_os.chdir(%[2]s)
+_os.environ["HOME"] = %[2]s
+del _os`
+
+// isolateTenantKernel runs tenantIsolationCode on the kernel of tenant before every execution and returns the
+// uid the kernel runs as, a restarted kernel runs as root again until it is isolated
+func isolateTenantKernel(kernelId string, sessionId string, tenant string) (int, error) {
+	root, uid, err := fileservices.TenantUser(tenant)
+	if err != nil {
+		return 0, err
+	}
+	response := executeCode(kernelId, sessionId, TenantIsolationCode(root, uid))
+	if response.HResult != 0 || response.ErrorName != "" {
+		return 0, errors.New(response.ErrorName + ": " + response.ErrorMessage)
+	}
+	return uid, nil
+}
+
+// TenantIsolationCode returns the python code isolating a kernel in the tenant root owned by uid
+func TenantIsolationCode(root string, uid int) string {
+	quotedRoot, _ := json.Marshal(root)
+	return fmt.Sprintf(tenantIsolationCode, uid, quotedRoot)
+}
@@ -0,0 +1,348 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ModeAllowAll  = "allow-all"
+	ModeDenyAll   = "deny-all"
+	ModeAllowList = "allow-list"
+
+	// keep the last blocked attempts so executions can report them
+	maxBlockedHistory = 100
+	dialTimeout       = 10 * time.Second
+)
+
+// Policy decides which hosts executed code may connect to
+type Policy struct {
+	Mode      string
+	Hostnames []string
+	Networks  []*net.IPNet
+}
+
+// BlockedRequest is an outbound connection the proxy refused
+type BlockedRequest struct {
+	Host   string    `json:"host"`
+	Port   string    `json:"port"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+	// uid owning the client connection, -1 if unknown
+	uid int
+}
+
+var (
+	blockedLock sync.Mutex
+	blocked     []BlockedRequest
+)
+
+// ParsePolicy builds a policy from a mode and an allow list of hostnames and CIDRs.
+// Hostnames starting with "*." or "." also match all subdomains.
+func ParsePolicy(mode string, allowList []string) (*Policy, error) {
+	policy := &Policy{Mode: mode}
+	switch mode {
+	case ModeAllowAll, ModeDenyAll:
+		return policy, nil
+	case ModeAllowList:
+	default:
+		return nil, fmt.Errorf("unknown egress policy '%s', expected one of %s, %s, %s", mode, ModeAllowAll, ModeDenyAll, ModeAllowList)
+	}
+
+	for _, entry := range allowList {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR '%s' in egress allow list: %v", entry, err)
+			}
+			policy.Networks = append(policy.Networks, network)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			policy.Networks = append(policy.Networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			policy.Hostnames = append(policy.Hostnames, entry)
+		}
+	}
+	return policy, nil
+}
+
+// GetPolicy returns the policy configured through the environment
+func GetPolicy() (*Policy, error) {
+	cfg := util.GetConfig()
+	return ParsePolicy(cfg.EgressPolicy, cfg.EgressAllowList)
+}
+
+// AllowsHostname reports whether host matches one of the allowed hostnames
+func (p *Policy) AllowsHostname(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.Hostnames {
+		if strings.HasPrefix(allowed, "*.") || strings.HasPrefix(allowed, ".") {
+			suffix := allowed[strings.Index(allowed, "."):]
+			if strings.HasSuffix(host, suffix) || host == suffix[1:] {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether ip is inside one of the allowed networks
+func (p *Policy) AllowsIP(ip net.IP) bool {
+	for _, network := range p.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the addresses the proxy may dial for host, or an error explaining why it is blocked.
+// Addresses are resolved once and dialed directly so DNS can not be changed between the check and the dial.
+func (p *Policy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if p.Mode == ModeDenyAll {
+		return nil, fmt.Errorf("egress policy is %s", ModeDenyAll)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	if p.Mode == ModeAllowAll || p.AllowsHostname(host) {
+		return ips, nil
+	}
+
+	var allowed []net.IP
+	for _, ip := range ips {
+		if p.AllowsIP(ip) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("host '%s' is not in the egress allow list", host)
+	}
+	return allowed, nil
+}
+
+// Proxy is an HTTP/HTTPS forward proxy that only lets through traffic allowed by its policy.
+// Kernels are pointed at it with HTTP_PROXY and HTTPS_PROXY.
+type Proxy struct {
+	policy    *Policy
+	transport *http.Transport
+}
+
+func NewProxy(policy *Policy) *Proxy {
+	proxy := &Proxy{policy: policy}
+	proxy.transport = &http.Transport{
+		Proxy:                 nil,
+		DialContext:           proxy.dial,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+	return proxy
+}
+
+// Start runs the proxy on address until the process exits
+func Start(address string, policy *Policy) {
+	log.Info().Str("policy", policy.Mode).Msg("Starting egress proxy on " + address)
+	err := http.ListenAndServe(address, NewProxy(policy))
+	if err != nil {
+		log.Error().Msg("Egress Proxy Error: " + err.Error())
+	}
+}
+
+// dial connects to the first reachable address that the policy allows
+func (p *Proxy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := p.policy.resolve(ctx, host)
+	if err != nil {
+		recordBlocked(clientUID(ctx), host, port, err.Error())
+		return nil, &blockedError{err: err}
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+type blockedError struct {
+	err error
+}
+
+func (e *blockedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *blockedError) Unwrap() error {
+	return e.err
+}
+
+// clientAddrKey keeps the address of the proxy client in the request context, the dial of a blocked request
+// looks up who owns the connection with it
+type clientAddrKey struct{}
+
+// clientUID returns the uid of the kernel that sent the proxy request of ctx, -1 if unknown
+func clientUID(ctx context.Context) int {
+	remoteAddr, _ := ctx.Value(clientAddrKey{}).(string)
+	client, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	server, ok := ctx.Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if err != nil || !ok {
+		return -1
+	}
+	return connectionOwner(client, server)
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(context.WithValue(r.Context(), clientAddrKey{}, r.RemoteAddr))
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+
+	if r.URL.Host == "" {
+		util.SendHTTPResponse(w, http.StatusBadRequest, "egress proxy only accepts proxy requests", true)
+		return
+	}
+
+	// hop-by-hop proxy headers must not be forwarded
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Connection")
+	r.Header.Del("Proxy-Authorization")
+
+	response, err := p.transport.RoundTrip(r)
+	if err != nil {
+		p.respondError(w, r.URL.Host, err)
+		return
+	}
+	defer response.Body.Close()
+
+	for key, values := range response.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
+
+// serveConnect tunnels a TLS connection after checking the target against the policy
+func (p *Proxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	target, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.respondError(w, r.Host, err)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		target.Close()
+		util.SendHTTPResponse(w, http.StatusInternalServerError, "connection can not be hijacked", true)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		target.Close()
+		log.Error().Err(err).Msg("Unable to hijack egress connection")
+		return
+	}
+
+	client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	go tunnel(target, client)
+	go tunnel(client, target)
+}
+
+func tunnel(dst net.Conn, src net.Conn) {
+	defer dst.Close()
+	defer src.Close()
+	io.Copy(dst, src)
+}
+
+func (p *Proxy) respondError(w http.ResponseWriter, host string, err error) {
+	var blockedErr *blockedError
+	if errors.As(err, &blockedErr) {
+		util.SendHTTPResponse(w, http.StatusForbidden, "egress to "+host+" blocked: "+blockedErr.Error(), true)
+		return
+	}
+	log.Error().Err(err).Str("host", host).Msg("Egress proxy request failed")
+	util.SendHTTPResponse(w, http.StatusBadGateway, "error connecting to "+host, true)
+}
+
+func recordBlocked(uid int, host, port, reason string) {
+	log.Warn().Int("uid", uid).Str("host", host).Str("port", port).Str("reason", reason).Msg("Blocked egress attempt")
+
+	blockedLock.Lock()
+	defer blockedLock.Unlock()
+	blocked = append(blocked, BlockedRequest{Host: host, Port: port, Reason: reason, Time: time.Now(), uid: uid})
+	if len(blocked) > maxBlockedHistory {
+		blocked = blocked[len(blocked)-maxBlockedHistory:]
+	}
+}
+
+// BlockedSince returns the attempts of kernels running as uid blocked at or after since. Tenant kernels run
+// as uids of their own, so an execution never reports the attempts of another tenant.
+func BlockedSince(since time.Time, uid int) []BlockedRequest {
+	blockedLock.Lock()
+	defer blockedLock.Unlock()
+
+	var result []BlockedRequest
+	for _, request := range blocked {
+		if request.uid == uid && !request.Time.Before(since) {
+			result = append(result, request)
+		}
+	}
+	return result
+}
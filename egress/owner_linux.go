@@ -0,0 +1,66 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package egress
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// connectionOwner returns the uid owning the local tcp socket connected from client to server as listed in
+// /proc/net/tcp and /proc/net/tcp6, -1 if there is none, e.g. for a client on another host
+func connectionOwner(client *net.TCPAddr, server *net.TCPAddr) int {
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		content, err := os.ReadFile(table)
+		if err != nil {
+			continue
+		}
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid ...
+		for _, line := range strings.Split(string(content), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 8 || !procAddrEqual(fields[1], client) || !procAddrEqual(fields[2], server) {
+				continue
+			}
+			if uid, err := strconv.Atoi(fields[7]); err == nil {
+				return uid
+			}
+		}
+	}
+	return -1
+}
+
+// procAddrEqual compares an address of /proc/net/tcp, written as hex 32 bit words in host byte order, to addr
+func procAddrEqual(procAddr string, addr *net.TCPAddr) bool {
+	hexIP, hexPort, ok := strings.Cut(procAddr, ":")
+	raw, err := hex.DecodeString(hexIP)
+	if !ok || err != nil || len(raw)%4 != 0 {
+		return false
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil || int(port) != addr.Port {
+		return false
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	return ip.Equal(addr.IP)
+}
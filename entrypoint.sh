@@ -2,14 +2,51 @@
 
 JUPYTER_GEN_TOKEN=$(uuidgen | tr 'A-Z' 'a-z')
 export JUPYTER_GEN_TOKEN
-echo "JUPYTER_GEN_TOKEN: $JUPYTER_GEN_TOKEN"
+
+# Jupyter reads the token from a private config file, in its environment every kernel would inherit it
+JUPYTER_TOKEN_CONFIG=$(mktemp --suffix=.py)
+chmod 600 "$JUPYTER_TOKEN_CONFIG"
+cat > "$JUPYTER_TOKEN_CONFIG" <<EOF
+c.NotebookApp.token = "$JUPYTER_GEN_TOKEN"
+c.ServerApp.token = "$JUPYTER_GEN_TOKEN"
+EOF
 
 # Verify the installation
 conda --version
 
+# Route kernel traffic through the egress proxy started by the Go app unless egress is unrestricted.
+# The Go app resolves the settings, so EGRESS_POLICY set in CONFIG_FILE is honoured as well.
+if ! EGRESS_POLICY=$(./goclientapp config egress_policy) || ! EGRESS_PROXY_ADDRESS=$(./goclientapp config egress_proxy_address); then
+    echo "Unable to read the egress settings, not starting"
+    exit 1
+fi
+PROXY_ENV=""
+if [ "$EGRESS_POLICY" != "allow-all" ]; then
+    EGRESS_PROXY_URL="http://$EGRESS_PROXY_ADDRESS"
+    # local addresses go through the proxy as well, the kernel has no business with Jupyter or the Go app
+    PROXY_ENV="HTTP_PROXY=$EGRESS_PROXY_URL HTTPS_PROXY=$EGRESS_PROXY_URL http_proxy=$EGRESS_PROXY_URL https_proxy=$EGRESS_PROXY_URL"
+    echo "Routing kernel egress through $EGRESS_PROXY_URL"
+fi
+
+# Tenant kernels drop root for a uid from TENANT_UID_BASE up, they must not reach Jupyter or the Go app
+# on a local address, with either they could run code in the kernels of other tenants.
+if ! MULTI_TENANT=$(./goclientapp config multi_tenant) || ! TENANT_UID_BASE=$(./goclientapp config tenant_uid_base) || ! LISTEN_ADDRESS=$(./goclientapp config listen_address); then
+    echo "Unable to read the tenant settings, not starting"
+    exit 1
+fi
+if [ "$MULTI_TENANT" = "true" ]; then
+    for IPTABLES in iptables ip6tables; do
+        if ! $IPTABLES -A OUTPUT -p tcp -m addrtype --dst-type LOCAL -m owner --uid-owner "$TENANT_UID_BASE-4294967294" \
+            -m multiport --dports "8888,${LISTEN_ADDRESS##*:}" -j REJECT; then
+            echo "Unable to block tenant kernels from Jupyter and the Go app, MULTI_TENANT needs root and NET_ADMIN, not starting"
+            exit 1
+        fi
+    done
+fi
+
 # Start Jupyter notebook
 echo "Starting Jupyter.."
-conda run -p /app/condaapp env JUPYTER_TOKEN=$JUPYTER_GEN_TOKEN jupyter notebook --ip=0.0.0.0 --port=8888 --no-browser --allow-root &
+conda run -p /app/condaapp env -u JUPYTER_GEN_TOKEN $PROXY_ENV jupyter notebook --config="$JUPYTER_TOKEN_CONFIG" --ip=0.0.0.0 --port=8888 --no-browser --allow-root &
 
 # sleep for 10 seconds to allow Jupyter notebook to start
 sleep 10
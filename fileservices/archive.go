@@ -0,0 +1,498 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrCodeInvalidArchive   = "ERR_INVALID_ARCHIVE"
+	ErrCodeUnsafeArchive    = "ERR_UNSAFE_ARCHIVE"
+	ErrCodeArchiveTooLarge  = "ERR_ARCHIVE_TOO_LARGE"
+	ArchiveFormatZip        = "zip"
+	ArchiveFormatTarGz      = "tar.gz"
+	archiveFormatTar        = "tar"
+	archiveFormatSniffBytes = 512
+)
+
+// ArchiveError is a rejected or unreadable archive, nothing of it is extracted
+type ArchiveError struct {
+	Code    string
+	Message string
+}
+
+func (e *ArchiveError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func newArchiveError(code string, format string, args ...interface{}) *ArchiveError {
+	return &ArchiveError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// ExtractLimits cap the total uncompressed size and the number of entries of an extracted archive, 0 means unlimited
+type ExtractLimits struct {
+	MaxTotalBytes int64
+	MaxEntries    int
+}
+
+func GetExtractLimits() ExtractLimits {
+	cfg := util.GetConfig()
+	return ExtractLimits{MaxTotalBytes: cfg.ExtractMaxTotalBytes, MaxEntries: cfg.ExtractMaxEntries}
+}
+
+// ArchiveHandler streams a zip or tar.gz of the directory in the path, symlinks are left out
+func ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ArchiveFormatZip
+	}
+	if format != ArchiveFormatZip && format != ArchiveFormatTarGz {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid format '%s', expected %s or %s", format, ArchiveFormatZip, ArchiveFormatTarGz))
+		return
+	}
+
+	targetPath, err := ResolveTargetPath(rootPath, mux.Vars(r)["path"])
+	if err != nil {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Unable to clean and verify target path")
+		return
+	}
+
+	fileInfo, err := os.Lstat(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logAndRespond(w, http.StatusNotFound, ErrCodeDirNotFound, "Directory not found")
+		} else {
+			logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error accessing directory")
+		}
+		return
+	}
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeSymlinkNotAllowed, "Symlinks not allowed")
+		return
+	}
+	if !fileInfo.IsDir() {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Path is not a directory")
+		return
+	}
+
+	name := filepath.Base(targetPath)
+	if targetPath == rootPath {
+		name = "data"
+	}
+	contentType := "application/zip"
+	if format == ArchiveFormatTarGz {
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", ContentDisposition(name+"."+format))
+	w.WriteHeader(http.StatusOK)
+
+	// the status is already sent, a failure can only be signaled by the truncated archive
+	if format == ArchiveFormatZip {
+		err = WriteZipArchive(countingResponseWriter{w}, targetPath)
+	} else {
+		err = WriteTarGzArchive(countingResponseWriter{w}, targetPath)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("path", targetPath).Msg("Unable to write archive")
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("Archive of %s sent successfully.\n", targetPath))
+}
+
+// WriteZipArchive writes a zip of dir to w while walking it
+func WriteZipArchive(w io.Writer, dir string) error {
+	archive := zip.NewWriter(w)
+	err := walkArchiveTree(dir, func(name string, path string, fileInfo os.FileInfo) error {
+		header, err := zip.FileInfoHeader(fileInfo)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if fileInfo.IsDir() {
+			header.Name += "/"
+			_, err = archive.CreateHeader(header)
+			return err
+		}
+		header.Method = zip.Deflate
+		writer, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		return copyFileTo(writer, path)
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// WriteTarGzArchive writes a gzip compressed tar of dir to w while walking it
+func WriteTarGzArchive(w io.Writer, dir string) error {
+	compressor := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressor)
+	err := walkArchiveTree(dir, func(name string, path string, fileInfo os.FileInfo) error {
+		header, err := tar.FileInfoHeader(fileInfo, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		header.Uname, header.Gname = "", ""
+		if fileInfo.IsDir() {
+			header.Name += "/"
+			return archive.WriteHeader(header)
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		return copyFileTo(archive, path)
+	})
+	if err != nil {
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// walkArchiveTree calls add for every regular file and directory below dir with its slash separated relative name,
+// the file versions of a root are left out
+func walkArchiveTree(dir string, add func(name string, path string, fileInfo os.FileInfo) error) error {
+	versionsPath := ""
+	if isDataRoot(dir) {
+		versionsPath = filepath.Join(dir, versionsDirName)
+	}
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == versionsPath && entry.IsDir() {
+			return filepath.SkipDir
+		}
+		if path == dir || !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return add(filepath.ToSlash(relativePath), path, fileInfo)
+	})
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// archiveEntry is one member of a zip or tar archive
+type archiveEntry struct {
+	name string
+	mode fs.FileMode
+	open func() (io.ReadCloser, error)
+}
+
+// ExtractArchive unpacks the zip, tar or tar.gz at archivePath into targetPath and returns the extracted files.
+// The archive is first unpacked into a staging directory in the hidden version history of rootPath, so an
+// archive with an entry escaping targetPath, a symlink, a link or device, an entry deeper than dirPathMaxDepth
+// below rootPath, more data than the limits allow or an entry conflicting with an existing path is rejected
+// without changing targetPath.
+func ExtractArchive(archivePath string, rootPath string, targetPath string, limits ExtractLimits) ([]FileMetadata, error) {
+	if err := os.MkdirAll(targetPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := ownPath(rootPath, targetPath); err != nil {
+		return nil, err
+	}
+	// the version history is on the same file system as targetPath, so staged files can be renamed into place
+	versionsRoot := filepath.Join(rootPath, versionsDirName)
+	if err := os.MkdirAll(versionsRoot, os.ModePerm); err != nil {
+		return nil, err
+	}
+	stagingPath, err := os.MkdirTemp(versionsRoot, ".extract-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(versionsRoot)
+	defer os.RemoveAll(stagingPath)
+
+	var totalBytes int64
+	entries := 0
+	err = readArchive(archivePath, func(entry archiveEntry) error {
+		entries++
+		if limits.MaxEntries > 0 && entries > limits.MaxEntries {
+			return newArchiveError(ErrCodeArchiveTooLarge, "Archive has more than %d entries", limits.MaxEntries)
+		}
+
+		name, err := cleanArchiveName(entry.name)
+		if err != nil {
+			return err
+		}
+		entryPath := filepath.Join(targetPath, name)
+		if inVersions(rootPath, entryPath) {
+			return newArchiveError(ErrCodeUnsafeArchive, "Entry '%s' is reserved for file versions", entry.name)
+		}
+		if _, err := CleanAndVerifyTargetPath(rootPath, entryPath); err != nil {
+			return newArchiveError(ErrCodeUnsafeArchive, "Entry '%s' exceeds the maximum directory depth of %d", entry.name, dirPathMaxDepth)
+		}
+
+		stagedPath := filepath.Join(stagingPath, name)
+		switch {
+		case entry.mode.IsDir():
+			return os.MkdirAll(stagedPath, os.ModePerm)
+		case entry.mode.IsRegular():
+		default:
+			return newArchiveError(ErrCodeUnsafeArchive, "Entry '%s' is not a regular file or directory", entry.name)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(stagedPath), os.ModePerm); err != nil {
+			return err
+		}
+		src, err := entry.open()
+		if err != nil {
+			return newArchiveError(ErrCodeInvalidArchive, "Unable to read entry '%s'", entry.name)
+		}
+		defer src.Close()
+		dst, err := os.OpenFile(stagedPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0777)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+
+		// declared sizes can not be trusted, the cap applies to the bytes actually written
+		var reader io.Reader = src
+		if limits.MaxTotalBytes > 0 {
+			reader = io.LimitReader(src, limits.MaxTotalBytes-totalBytes+1)
+		}
+		written, err := io.Copy(dst, reader)
+		totalBytes += written
+		if err != nil {
+			return newArchiveError(ErrCodeInvalidArchive, "Unable to read entry '%s'", entry.name)
+		}
+		if limits.MaxTotalBytes > 0 && totalBytes > limits.MaxTotalBytes {
+			return newArchiveError(ErrCodeArchiveTooLarge, "Archive exceeds the maximum extracted size of %d bytes", limits.MaxTotalBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return moveStagedTree(stagingPath, rootPath, targetPath)
+}
+
+// cleanArchiveName rejects absolute names and names escaping the destination (zip slip)
+func cleanArchiveName(name string) (string, error) {
+	slashed := strings.ReplaceAll(name, "\\", "/")
+	cleaned := path.Clean("/" + slashed)
+	if slashed == "" || strings.HasPrefix(slashed, "/") || filepath.VolumeName(name) != "" || cleaned == "/" {
+		return "", newArchiveError(ErrCodeUnsafeArchive, "Entry '%s' has an invalid name", name)
+	}
+	for _, segment := range strings.Split(slashed, "/") {
+		if segment == ".." {
+			return "", newArchiveError(ErrCodeUnsafeArchive, "Entry '%s' escapes the destination directory", name)
+		}
+	}
+	return filepath.FromSlash(strings.TrimPrefix(cleaned, "/")), nil
+}
+
+// readArchive detects the format of the archive from its content and calls extract for every entry
+func readArchive(archivePath string, extract func(entry archiveEntry) error) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	head, _ := reader.Peek(archiveFormatSniffBytes)
+
+	switch sniffArchiveFormat(head) {
+	case ArchiveFormatZip:
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		archive, err := zip.NewReader(file, fileInfo.Size())
+		if err != nil {
+			return newArchiveError(ErrCodeInvalidArchive, "Invalid zip archive")
+		}
+		for _, member := range archive.File {
+			if err := extract(archiveEntry{name: member.Name, mode: member.Mode(), open: member.Open}); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ArchiveFormatTarGz:
+		decompressor, err := gzip.NewReader(reader)
+		if err != nil {
+			return newArchiveError(ErrCodeInvalidArchive, "Invalid gzip archive")
+		}
+		defer decompressor.Close()
+		return readTar(tar.NewReader(decompressor), extract)
+	case archiveFormatTar:
+		return readTar(tar.NewReader(reader), extract)
+	}
+	return newArchiveError(ErrCodeInvalidArchive, "Unsupported archive format, expected zip, tar or tar.gz")
+}
+
+func readTar(archive *tar.Reader, extract func(entry archiveEntry) error) error {
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return newArchiveError(ErrCodeInvalidArchive, "Invalid tar archive")
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		// hard links look like empty regular files in their mode, so the type flag decides
+		mode := header.FileInfo().Mode()
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir {
+			mode |= fs.ModeIrregular
+		}
+		entry := archiveEntry{
+			name: header.Name,
+			mode: mode,
+			open: func() (io.ReadCloser, error) { return io.NopCloser(archive), nil },
+		}
+		if err := extract(entry); err != nil {
+			return err
+		}
+	}
+}
+
+func sniffArchiveFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return ArchiveFormatZip
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return ArchiveFormatTarGz
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return archiveFormatTar
+	}
+	return ""
+}
+
+// moveStagedTree merges the staged files into targetPath, replacing existing files but never following symlinks.
+// Every destination is checked before the first file is moved, so a conflict leaves targetPath unchanged.
+func moveStagedTree(stagingPath string, rootPath string, targetPath string) ([]FileMetadata, error) {
+	err := filepath.WalkDir(stagingPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == stagingPath {
+			return err
+		}
+		relativePath, err := filepath.Rel(stagingPath, path)
+		if err != nil {
+			return err
+		}
+		return checkStagedDestination(filepath.Join(targetPath, relativePath), entry.IsDir(), relativePath)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var extracted []FileMetadata
+	err = filepath.WalkDir(stagingPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == stagingPath {
+			return err
+		}
+		relativePath, err := filepath.Rel(stagingPath, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(targetPath, relativePath)
+
+		// the destination may have changed since it was checked
+		if err := checkStagedDestination(dstPath, entry.IsDir(), relativePath); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if err := os.MkdirAll(dstPath, os.ModePerm); err != nil {
+				return err
+			}
+			return ownPath(rootPath, dstPath)
+		}
+		if err := os.Chmod(path, 0777); err != nil {
+			return err
+		}
+		if err := SaveVersion(rootPath, dstPath); err != nil {
+			log.Error().Err(err).Str("path", dstPath).Msg("Unable to save file version")
+		}
+		if err := os.Rename(path, dstPath); err != nil {
+			return err
+		}
+		if err := ownPath(rootPath, dstPath); err != nil {
+			return err
+		}
+
+		fileInfo, err := os.Stat(dstPath)
+		if err != nil {
+			return err
+		}
+		extracted = append(extracted, describeFile(rootPath, dstPath, newFileMetadata(filepath.ToSlash(relativePath), fileInfo), MetadataOptions{}))
+		return nil
+	})
+	return extracted, err
+}
+
+// checkStagedDestination rejects a destination that is a symlink or a file where a directory is staged or the other way round
+func checkStagedDestination(dstPath string, isDir bool, relativePath string) error {
+	existing, err := os.Lstat(dstPath)
+	switch {
+	case err != nil:
+		return nil
+	case existing.Mode()&os.ModeSymlink != 0:
+		return newArchiveError(ErrCodeSymlinkNotAllowed, "Destination '%s' is a symlink", filepath.ToSlash(relativePath))
+	case isDir && !existing.IsDir():
+		return newArchiveError(ErrCodeFileExists, "Destination '%s' is a file", filepath.ToSlash(relativePath))
+	case !isDir && existing.IsDir():
+		return newArchiveError(ErrCodeFileExists, "Destination '%s' is a directory", filepath.ToSlash(relativePath))
+	}
+	return nil
+}
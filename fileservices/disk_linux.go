@@ -0,0 +1,33 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package fileservices
+
+import "golang.org/x/sys/unix"
+
+func diskSpace(path string) (DiskSpace, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return DiskSpace{}, err
+	}
+	blockSize := uint64(stat.Bsize)
+	return DiskSpace{
+		Path:           path,
+		TotalBytes:     stat.Blocks * blockSize,
+		FreeBytes:      stat.Bfree * blockSize,
+		AvailableBytes: stat.Bavail * blockSize,
+	}, nil
+}
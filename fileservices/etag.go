@@ -0,0 +1,189 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ErrCodePreconditionFailed = "ERR_PRECONDITION_FAILED"
+
+	maxETagCacheEntries = 4096
+)
+
+type etagCacheEntry struct {
+	size    int64
+	modTime time.Time
+	digest  []byte
+}
+
+// digests are cached by path and only reused while size and mtime are unchanged
+var (
+	etagCacheLock sync.Mutex
+	etagCache     = map[string]etagCacheEntry{}
+)
+
+// ETag is the strong entity tag of a file, the quoted hex sha256 of its content
+func ETag(digest []byte) string {
+	return `"` + hex.EncodeToString(digest) + `"`
+}
+
+// FileDigest returns the sha256 of the file at path, reading it only if its size or mtime changed since the last call
+func FileDigest(path string, fileInfo os.FileInfo) ([]byte, error) {
+	etagCacheLock.Lock()
+	entry, ok := etagCache[path]
+	etagCacheLock.Unlock()
+	if ok && entry.size == fileInfo.Size() && entry.modTime.Equal(fileInfo.ModTime()) {
+		return entry.digest, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	digest := hash.Sum(nil)
+
+	etagCacheLock.Lock()
+	if len(etagCache) >= maxETagCacheEntries {
+		etagCache = map[string]etagCacheEntry{}
+	}
+	etagCache[path] = etagCacheEntry{size: fileInfo.Size(), modTime: fileInfo.ModTime(), digest: digest}
+	etagCacheLock.Unlock()
+	return digest, nil
+}
+
+// Preconditions are the If-Match and If-None-Match headers of a request that changes a file
+type Preconditions struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+func PreconditionsFromRequest(r *http.Request) Preconditions {
+	return Preconditions{IfMatch: r.Header.Get("If-Match"), IfNoneMatch: r.Header.Get("If-None-Match")}
+}
+
+// Check compares the current state of path with the preconditions.
+// If-Match uses the strong comparison, so a weak tag never matches; If-None-Match: * only allows creating a new file.
+func (p Preconditions) Check(path string) error {
+	if p.IfMatch == "" && p.IfNoneMatch == "" {
+		return nil
+	}
+
+	etag := ""
+	fileInfo, err := os.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+	if exists && fileInfo.Mode().IsRegular() && (etagListContainsTag(p.IfMatch) || etagListContainsTag(p.IfNoneMatch)) {
+		digest, err := FileDigest(path, fileInfo)
+		if err != nil {
+			return err
+		}
+		etag = ETag(digest)
+	}
+
+	if p.IfMatch != "" && (!exists || !etagListMatches(p.IfMatch, etag, false)) {
+		return fmt.Errorf("If-Match precondition failed")
+	}
+	if p.IfNoneMatch != "" && exists && etagListMatches(p.IfNoneMatch, etag, true) {
+		return fmt.Errorf("If-None-Match precondition failed")
+	}
+	return nil
+}
+
+// etagListMatches reports whether the header is * or one of its tags matches etag
+func etagListMatches(header string, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if etag != "" && tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func etagListContainsTag(header string) bool {
+	return header != "" && strings.TrimSpace(header) != "*"
+}
+
+// ServeFileWithETag serves the file with a strong ETag, a Digest and an attachment Content-Disposition.
+// Conditional and range requests, including multiple ranges, are answered by http.ServeContent.
+func ServeFileWithETag(w http.ResponseWriter, r *http.Request, filePath string, filename string) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error accessing file")
+		return
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil || fileInfo.IsDir() {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeFileAccess, "Path is not a file")
+		return
+	}
+
+	digest, err := FileDigest(filePath, fileInfo)
+	if err != nil {
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error reading file")
+		return
+	}
+
+	w.Header().Set("ETag", ETag(digest))
+	w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(digest))
+	w.Header().Set("Content-Disposition", ContentDisposition(filename))
+	http.ServeContent(countingResponseWriter{w}, r, filename, fileInfo.ModTime(), file)
+}
+
+// ContentDisposition returns an attachment header with an ASCII fallback and the RFC 5987 encoded UTF-8 filename
+func ContentDisposition(filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '%' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	if fallback == filename {
+		return `attachment; filename="` + filename + `"`
+	}
+	return `attachment; filename="` + fallback + `"; filename*=UTF-8''` + strings.ReplaceAll(url.PathEscape(filename), "'", "%27")
+}
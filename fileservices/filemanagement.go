@@ -0,0 +1,440 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrCodeFileExists  = "ERR_FILE_EXISTS"
+	ErrCodeDirNotEmpty = "ERR_DIR_NOT_EMPTY"
+)
+
+// body of the move and copy endpoints, paths are relative to the data root and escaped like URL paths
+type TransferRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Overwrite   bool   `json:"overwrite"`
+}
+
+// CreateDirectoryHandler creates the directory in the path, including missing parents
+func CreateDirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+	version, ok := resolveAPIVersion(w, r)
+	if !ok {
+		return
+	}
+
+	targetPath, err := ResolveTargetPath(rootPath, mux.Vars(r)["path"])
+	if err != nil || targetPath == rootPath {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid directory path")
+		return
+	}
+
+	if fileInfo, err := os.Lstat(targetPath); err == nil {
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			logAndRespond(w, http.StatusBadRequest, ErrCodeSymlinkNotAllowed, "Symlinks not allowed")
+		} else {
+			logAndRespond(w, http.StatusConflict, ErrCodeFileExists, "Path already exists")
+		}
+		return
+	}
+
+	err = os.MkdirAll(targetPath, os.ModePerm)
+	if err == nil {
+		err = ownPath(rootPath, targetPath)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to create directory")
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error creating directory")
+		return
+	}
+
+	respondWithMetadata(w, http.StatusCreated, rootPath, targetPath, version)
+}
+
+// a validated move or copy, replace is set when an existing destination is overwritten
+type transfer struct {
+	rootPath    string
+	source      string
+	destination string
+	replace     bool
+	// usage of the destination that is replaced
+	replaced Usage
+}
+
+// MoveFileHandler moves or renames a file or directory
+func MoveFileHandler(w http.ResponseWriter, r *http.Request) {
+	version, ok := resolveAPIVersion(w, r)
+	if !ok {
+		return
+	}
+	t, ok := resolveTransferRequest(w, r)
+	if !ok {
+		return
+	}
+	rootPath, source, destination := t.rootPath, t.source, t.destination
+
+	if !prepareDestination(w, t) {
+		return
+	}
+	if err := replaceDestination(t, source); err != nil {
+		log.Error().Err(err).Msg("Unable to move file")
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error moving file")
+		return
+	}
+
+	log.Info().Msg(fmt.Sprintf("Moved %s to %s successfully.\n", source, destination))
+	respondWithMetadata(w, http.StatusOK, rootPath, destination, version)
+}
+
+// CopyFileHandler copies a file, or a directory with everything below it
+func CopyFileHandler(w http.ResponseWriter, r *http.Request) {
+	version, ok := resolveAPIVersion(w, r)
+	if !ok {
+		return
+	}
+	t, ok := resolveTransferRequest(w, r)
+	if !ok {
+		return
+	}
+	rootPath, source, destination := t.rootPath, t.source, t.destination
+
+	// a replaced file is kept as a version and still counts against the quota, a replaced directory does not
+	freed := t.replaced
+	if destinationInfo, err := os.Lstat(destination); err == nil && destinationInfo.Mode().IsRegular() && MaxFileVersions > 0 {
+		freed = Usage{}
+	}
+	usage, err := treeUsage(source)
+	if err == nil {
+		err = ReserveQuota(rootPath, usage.Bytes-freed.Bytes, usage.Files-freed.Files)
+	}
+	if err != nil {
+		respondQuotaExceeded(w, err)
+		return
+	}
+
+	if !prepareDestination(w, t) {
+		AddUsage(rootPath, freed.Bytes-usage.Bytes, freed.Files-usage.Files)
+		return
+	}
+	// the copy is staged next to the destination, a failed copy is removed without touching the destination
+	stage, err := os.MkdirTemp(filepath.Dir(destination), "."+filepath.Base(destination)+".copy-*")
+	if err == nil {
+		defer os.RemoveAll(stage)
+		staged := filepath.Join(stage, filepath.Base(destination))
+		if err = copyTree(source, staged); err == nil {
+			if err = ownTree(rootPath, staged); err == nil {
+				err = replaceDestination(t, staged)
+			}
+		}
+	}
+	if err != nil {
+		AddUsage(rootPath, freed.Bytes-usage.Bytes, freed.Files-usage.Files)
+		log.Error().Err(err).Msg("Unable to copy file")
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error copying file")
+		return
+	}
+
+	// the reservation already took the freed space into account, replaceDestination gave back what was replaced
+	AddUsage(rootPath, freed.Bytes, freed.Files)
+	log.Info().Msg(fmt.Sprintf("Copied %s to %s successfully.\n", source, destination))
+	respondWithMetadata(w, http.StatusOK, rootPath, destination, version)
+}
+
+// DeletePathHandler deletes a file, or a directory when it is empty or recursive=true is passed
+func DeletePathHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+
+	recursive := false
+	if value := r.URL.Query().Get("recursive"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid recursive value")
+			return
+		}
+		recursive = parsed
+	}
+
+	targetPath, err := ResolveTargetPath(rootPath, mux.Vars(r)["path"])
+	if err != nil || targetPath == rootPath {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid path")
+		return
+	}
+
+	fileInfo, err := os.Lstat(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logAndRespond(w, http.StatusNotFound, ErrCodeFileNotFound, "File not found")
+		} else {
+			logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error accessing file")
+		}
+		return
+	}
+
+	if err := PreconditionsFromRequest(r).Check(targetPath); err != nil {
+		logAndRespond(w, http.StatusPreconditionFailed, ErrCodePreconditionFailed, err.Error())
+		return
+	}
+
+	usage, _ := treeUsage(targetPath)
+	if fileInfo.IsDir() && recursive {
+		err = os.RemoveAll(targetPath)
+	} else {
+		err = os.Remove(targetPath)
+	}
+	if err != nil {
+		if fileInfo.IsDir() && !recursive && isDirNotEmpty(targetPath) {
+			logAndRespond(w, http.StatusConflict, ErrCodeDirNotEmpty, "Directory is not empty, pass recursive=true to delete it")
+			return
+		}
+		log.Error().Err(err).Msg("Unable to delete path")
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error deleting file")
+		return
+	}
+
+	AddUsage(rootPath, -usage.Bytes, -usage.Files)
+	log.Info().Msg(fmt.Sprintf("Path %s deleted successfully.\n", targetPath))
+	util.SendHTTPResponse(w, http.StatusOK, "file deleted successfully", true)
+}
+
+// resolveTransferRequest validates source and destination of a move or copy and responds on error.
+// Nothing is changed on disk, an existing destination is only replaced by replaceDestination.
+func resolveTransferRequest(w http.ResponseWriter, r *http.Request) (transfer, bool) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return transfer{}, false
+	}
+
+	var request TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid request body")
+		return transfer{}, false
+	}
+
+	source, err := ResolveTargetPath(rootPath, request.Source)
+	if err != nil || request.Source == "" || source == rootPath {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid source path")
+		return transfer{}, false
+	}
+	destination, err := ResolveTargetPath(rootPath, request.Destination)
+	if err != nil || request.Destination == "" || destination == rootPath {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid destination path")
+		return transfer{}, false
+	}
+	if destination == source || strings.HasPrefix(destination, source+string(filepath.Separator)) {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Destination can not be inside the source")
+		return transfer{}, false
+	}
+
+	sourceInfo, err := os.Lstat(source)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logAndRespond(w, http.StatusNotFound, ErrCodeFileNotFound, "File not found")
+		} else {
+			logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error accessing file")
+		}
+		return transfer{}, false
+	}
+	if sourceInfo.Mode()&os.ModeSymlink != 0 {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeSymlinkNotAllowed, "Symlinks not allowed")
+		return transfer{}, false
+	}
+
+	replace, replaced := false, Usage{}
+	if destinationInfo, err := os.Lstat(destination); err == nil {
+		if destinationInfo.Mode()&os.ModeSymlink != 0 {
+			logAndRespond(w, http.StatusBadRequest, ErrCodeSymlinkNotAllowed, "Symlinks not allowed")
+			return transfer{}, false
+		}
+		if !request.Overwrite {
+			logAndRespond(w, http.StatusConflict, ErrCodeFileExists, "Destination already exists")
+			return transfer{}, false
+		}
+		if destinationInfo.IsDir() != sourceInfo.IsDir() {
+			logAndRespond(w, http.StatusConflict, ErrCodeFileExists, "Destination exists with a different type")
+			return transfer{}, false
+		}
+		replace = true
+		if replaced, err = treeUsage(destination); err != nil {
+			logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error accessing file")
+			return transfer{}, false
+		}
+	}
+
+	// a directory moved below the destination must not end up deeper than allowed
+	if sourceInfo.IsDir() {
+		if err := verifyTreeDepth(rootPath, source, destination); err != nil {
+			logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+			return transfer{}, false
+		}
+	}
+
+	return transfer{rootPath: rootPath, source: source, destination: destination, replace: replace, replaced: replaced}, true
+}
+
+// prepareDestination saves the version of the destination a transfer overwrites and creates the missing parents
+// of the destination. It is called once every check of the transfer passed, the destination is not changed yet.
+func prepareDestination(w http.ResponseWriter, t transfer) bool {
+	if t.replace {
+		// without its version the replaced file would be lost, the transfer is not worth it
+		if err := SaveVersion(t.rootPath, t.destination); err != nil {
+			log.Error().Err(err).Str("path", t.destination).Msg("Unable to save file version")
+			logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error saving file version")
+			return false
+		}
+	}
+	err := os.MkdirAll(filepath.Dir(t.destination), os.ModePerm)
+	if err == nil {
+		err = ownPath(t.rootPath, filepath.Dir(t.destination))
+	}
+	if err != nil {
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error creating destination directory")
+		return false
+	}
+	return true
+}
+
+// replaceDestination renames staged to the destination of t. A replaced directory is moved aside first and only
+// removed once staged took its place, a failed transfer leaves the destination as it was.
+func replaceDestination(t transfer, staged string) error {
+	if info, err := os.Lstat(t.destination); err != nil || !info.IsDir() {
+		// the rename replaces a file atomically
+		err := os.Rename(staged, t.destination)
+		if err == nil && t.replace {
+			// the saved version is accounted by SaveVersion
+			AddUsage(t.rootPath, -t.replaced.Bytes, -t.replaced.Files)
+		}
+		return err
+	}
+
+	// a directory can not be renamed onto another one, the replaced one is moved aside first
+	backupDir, err := os.MkdirTemp(filepath.Dir(t.destination), "."+filepath.Base(t.destination)+".replaced-*")
+	if err != nil {
+		return err
+	}
+	backup := filepath.Join(backupDir, filepath.Base(t.destination))
+	if err := os.Rename(t.destination, backup); err != nil {
+		os.Remove(backupDir)
+		return err
+	}
+	if err := os.Rename(staged, t.destination); err != nil {
+		if restoreErr := os.Rename(backup, t.destination); restoreErr != nil {
+			log.Error().Err(restoreErr).Str("path", t.destination).Str("backup", backup).Msg("Unable to restore replaced directory")
+			return err
+		}
+		os.Remove(backupDir)
+		return err
+	}
+	AddUsage(t.rootPath, -t.replaced.Bytes, -t.replaced.Files)
+	if err := os.RemoveAll(backupDir); err != nil {
+		log.Error().Err(err).Str("path", backupDir).Msg("Unable to remove replaced directory")
+	}
+	return nil
+}
+
+func verifyTreeDepth(rootPath string, source string, destination string) error {
+	return filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, _ := filepath.Rel(source, path)
+		if _, err := CleanAndVerifyTargetPath(rootPath, filepath.Join(destination, relativePath)); err != nil {
+			return fmt.Errorf("destination would exceed the maximum directory depth of %d", dirPathMaxDepth)
+		}
+		return nil
+	})
+}
+
+// copyTree copies source to destination, symlinks inside a copied directory are skipped
+func copyTree(source string, destination string) error {
+	return filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type()&os.ModeSymlink != 0 {
+			log.Info().Str("file", path).Msg("Skipping symlink while copying")
+			return nil
+		}
+
+		relativePath, _ := filepath.Rel(source, path)
+		target := filepath.Join(destination, relativePath)
+		if entry.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(source string, destination string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	return os.Chmod(destination, 0777)
+}
+
+func isDirNotEmpty(path string) bool {
+	entries, err := os.ReadDir(path)
+	return err == nil && len(entries) > 0
+}
+
+func respondWithMetadata(w http.ResponseWriter, statusCode int, rootPath string, path string, version int) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error accessing file")
+		return
+	}
+
+	relativePath, _ := filepath.Rel(rootPath, path)
+	metadata := describeFile(rootPath, path, newFileMetadata(filepath.ToSlash(relativePath), fileInfo), MetadataOptions{})
+	response, err := json.Marshal(metadata.ForAPIVersion(version))
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to marshal response")
+		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
+		return
+	}
+	util.SendHTTPResponse(w, statusCode, string(response), false)
+}
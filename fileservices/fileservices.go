@@ -19,42 +19,67 @@ import (
 	"fmt"
 	"io"
 	"mime"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/microsoft/jupyterpython/auth"
+	"github.com/microsoft/jupyterpython/metrics"
 	"github.com/microsoft/jupyterpython/util"
 	"github.com/rs/zerolog/log"
 )
 
+// FileMetadata describes a file or directory. Filename and MIMEType duplicate Name and ContentType,
+// they are deprecated and left out from api-version 2 on.
 type FileMetadata struct {
-	Name        string    `json:"name"`
-	Type        string    `json:"type"`
-	Filename    string    `json:"filename"` // remove this after CP change since we have name
-	Size        int64     `json:"size"`
-	LastModTime time.Time `json:"last_modified_time"`
-	MIMEType    string    `json:"mime_type"` // remove this after CP change since we have type
+	Name        string     `json:"name"`
+	Path        string     `json:"path,omitempty"`
+	Type        string     `json:"type"`
+	Filename    string     `json:"filename,omitempty"`
+	Size        int64      `json:"size"`
+	LastModTime time.Time  `json:"last_modified_time"`
+	CreatedTime *time.Time `json:"created_time,omitempty"`
+	MIMEType    string     `json:"mime_type,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Permissions string     `json:"permissions,omitempty"`
+	SHA256      string     `json:"sha256,omitempty"`
 }
 
 const (
 	fileType                 = "file"
-	dirPath                  = "/mnt/data"
 	dirType                  = "directory"
 	ErrCodeFileNotFound      = "ERR_FILE_NOT_FOUND"
 	ErrCodeDirNotFound       = "ERR_DIR_NOT_FOUND"
 	ErrCodeFileAccess        = "ERR_FILE_ACCESS"
 	ErrCodeSymlinkNotAllowed = "ERR_SYMLINK_NOT_ALLOWED"
+	ErrCodeQuotaExceeded     = "ERR_QUOTA_EXCEEDED"
 	dirPathMaxDepth          = 5
+	// the depth limit counts the data root as two segments, like the former fixed /mnt/data
+	dataRootDepth = 2
 )
 
+// dirPath is the data root, DATA_ROOT
+var dirPath = filepath.Clean(util.GetConfig().DataRoot)
+
+// SetDataRoot serves the files from path instead of DATA_ROOT and returns the previous data root
+func SetDataRoot(path string) string {
+	previous := dirPath
+	dirPath = filepath.Clean(path)
+	return previous
+}
+
 func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	targetPath := dirPath
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+	targetPath := rootPath
 
 	// supports both listFiles and listFiles/{path}
 	if customPath, ok := vars["path"]; ok && customPath != "" {
@@ -65,8 +90,8 @@ func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Unable to url decode path", http.StatusBadRequest)
 			return
 		}
-		targetPath = filepath.Join(dirPath, decodedPath)
-		targetPath, err = CleanAndVerifyTargetPath(targetPath)
+		targetPath = filepath.Join(rootPath, decodedPath)
+		targetPath, err = CleanAndVerifyTargetPath(rootPath, targetPath)
 		if err != nil {
 			log.Error().Err(err).Msg("Unable to clean and verify target path")
 			http.Error(w, "Unable to clean and verify target path", http.StatusBadRequest)
@@ -74,7 +99,22 @@ func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	files, err := os.ReadDir(targetPath)
+	options, err := ParseListOptions(r.URL.Query())
+	if err != nil {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+	metadataOptions, err := ParseMetadataOptions(r.URL.Query())
+	if err != nil {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+	version, ok := resolveAPIVersion(w, r)
+	if !ok {
+		return
+	}
+
+	metadataList, err := ListDirectory(rootPath, targetPath, options)
 	if err != nil {
 		if os.IsNotExist(err) {
 			logAndRespond(w, http.StatusNotFound, ErrCodeDirNotFound, "File path not found")
@@ -85,46 +125,16 @@ func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var metadataList []FileMetadata
-	for _, f := range files {
-		// Ignore if it is a symlink
-		if f.Type()&os.ModeSymlink != 0 {
-			continue
-		}
-
-		fullPath := filepath.Join(targetPath, f.Name())
-		fileInfo, err := os.Stat(fullPath)
-		if err != nil {
-			log.Error().Err(err).Str("file", f.Name()).Msg("Unable to get file info")
-			continue
-		}
-
-		mimeType := mime.TypeByExtension(filepath.Ext(f.Name()))
-		if mimeType == "" {
-			mimeType = "application/octet-stream" // default MIME type
-		}
-
-		if fileInfo.IsDir() {
-			metadataList = append(metadataList, FileMetadata{
-				Name:        f.Name(),
-				Type:        dirType,
-				Filename:    f.Name(), // remove this after CP change since we have Name
-				Size:        fileInfo.Size(),
-				LastModTime: fileInfo.ModTime(),
-				MIMEType:    mimeType, // remove this after CP change since we have type
-			})
-		} else {
-			metadataList = append(metadataList, FileMetadata{
-				Name:        f.Name(),
-				Type:        fileType,
-				Filename:    f.Name(), // remove this after CP change since we have Name
-				Size:        fileInfo.Size(),
-				LastModTime: fileInfo.ModTime(),
-				MIMEType:    mimeType, // remove this after CP change since we have type
-			})
-		}
+	// the body stays a plain array for existing clients, the next page is announced in a header
+	metadataList, nextPageToken := Paginate(metadataList, options)
+	if nextPageToken != "" {
+		w.Header().Set(NextPageTokenHeader, nextPageToken)
+	}
+	// only the returned page is read for content types and digests
+	for i, metadata := range metadataList {
+		path := filepath.Join(targetPath, filepath.FromSlash(metadata.Name))
+		metadataList[i] = describeFile(rootPath, path, metadata, metadataOptions).ForAPIVersion(version)
 	}
-
 	response, err := json.Marshal(metadataList)
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to marshal response")
@@ -132,15 +142,22 @@ func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info().Msg("List files successfully.\n")
-	log.Info().Msg(fmt.Sprintf("List files successfully" + string(response)))
+	log.Info().Msg(fmt.Sprintf("List files successfully, returned %d entries.\n", len(metadataList)))
 	util.SendHTTPResponse(w, http.StatusOK, string(response), false)
 }
 
 func UploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	// get custom path from URL
 	vars := mux.Vars(r)
-	targetPath := dirPath
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+	version, ok := resolveAPIVersion(w, r)
+	if !ok {
+		return
+	}
+	targetPath := rootPath
 
 	// supports both uploadFile and uploadFile/{path}
 	if customPath, ok := vars["path"]; ok && customPath != "" {
@@ -151,8 +168,8 @@ func UploadFileHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Unable to url decode path", http.StatusBadRequest)
 			return
 		}
-		targetPath = filepath.Join(dirPath, decodedPath)
-		targetPath, err = CleanAndVerifyTargetPath(targetPath)
+		targetPath = filepath.Join(rootPath, decodedPath)
+		targetPath, err = CleanAndVerifyTargetPath(rootPath, targetPath)
 		if err != nil {
 			log.Error().Err(err).Msg("Unable to clean and verify target path")
 			http.Error(w, "Unable to clean and verify target path", http.StatusBadRequest)
@@ -160,79 +177,83 @@ func UploadFileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err := r.ParseMultipartForm(250 << 20) // 250MB limit
+	// reject uploads that can not fit before reading the body
+	if err := CheckQuota(rootPath, max(r.ContentLength, 0), 1); err != nil {
+		respondQuotaExceeded(w, err)
+		return
+	}
+	quotaBytes, quotaFiles, err := RemainingQuota(rootPath)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to parse form")
-		util.SendHTTPResponse(w, http.StatusBadRequest, "error parsing form"+err.Error(), true)
+		respondQuotaExceeded(w, err)
 		return
 	}
 
-	files := r.MultipartForm.File["file"]
-	var metadataList []FileMetadata
-
-	for _, file := range files {
-		if err := processFile(file, &metadataList, targetPath); err != nil {
-			log.Error().Err(err).Str("filename", file.Filename).Send()
-			// choose to continue?
+	options := UploadOptions{
+		RootPath:      rootPath,
+		TargetPath:    targetPath,
+		Limits:        GetUploadLimits(),
+		Preconditions: PreconditionsFromRequest(r),
+		ExtractLimits: GetExtractLimits(),
+		QuotaBytes:    quotaBytes,
+		QuotaFiles:    quotaFiles,
+	}
+	if extract := r.URL.Query().Get("extract"); extract != "" {
+		value, err := strconv.ParseBool(extract)
+		if err != nil {
+			logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid extract value")
+			return
 		}
+		options.Extract = value
 	}
-
-	response, err := json.Marshal(metadataList)
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to marshal response")
-		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
-		return
+	if overwrite := r.URL.Query().Get("overwrite"); overwrite != "" {
+		value, err := strconv.ParseBool(overwrite)
+		if err != nil {
+			logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid overwrite value")
+			return
+		}
+		options.FailIfExists = !value
 	}
-
-	log.Info().Msg("Upload files successfully.\n")
-	util.SendHTTPResponse(w, http.StatusOK, string(response), false)
-}
-
-// processFile handles the processing of each individual file and updates the metadata list.
-func processFile(file *multipart.FileHeader, metadataList *[]FileMetadata, path string) error {
-	src, err := file.Open()
-	if err != nil {
-		return err
+	if options.Extract && options.FailIfExists {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "overwrite=false can not be combined with extract")
+		return
 	}
-	defer src.Close()
-
-	// url decode filename
-	decodedFilename, err := url.QueryUnescape(file.Filename)
-	if err != nil {
-		log.Error().Err(err).Str("filename", file.Filename).Msg("Error decoding file name")
-		return err
+	if options.Limits.MaxRequestBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, options.Limits.MaxRequestBytes)
 	}
-	file.Filename = decodedFilename
 
-	// create the directory if it doesn't exist
-	os.MkdirAll(path, os.ModePerm)
-
-	dstPath := filepath.Join(path, filepath.Base(file.Filename))
-	dst, err := os.Create(dstPath)
+	reader, err := r.MultipartReader()
 	if err != nil {
-		return err
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Request is not a multipart form")
+		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, src); err != nil {
-		return err
+	statusCode := http.StatusOK
+	results, err := StreamUpload(reader, options)
+	if err == errRequestTooLarge {
+		statusCode = http.StatusRequestEntityTooLarge
+	} else if err == nil && failedPrecondition(results) {
+		statusCode = http.StatusPreconditionFailed
+	} else if err == nil && options.FailIfExists && hasErrorCode(results, ErrCodeFileExists) {
+		statusCode = http.StatusConflict
+	} else if err != nil {
+		log.Error().Err(err).Msg("Unable to read multipart form")
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Error reading multipart form")
+		return
 	}
 
-	if fileInfo, err := dst.Stat(); err == nil {
-		*metadataList = append(*metadataList, FileMetadata{
-			Filename:    file.Filename,
-			Size:        fileInfo.Size(),
-			LastModTime: fileInfo.ModTime(),
-		})
-	} else {
-		return err
+	for i := range results {
+		results[i].FileMetadata = results[i].FileMetadata.ForAPIVersion(version)
+		MetadataForAPIVersion(results[i].Extracted, version)
 	}
-
-	if err := os.Chmod(dstPath, 0777); err != nil {
-		return err
+	response, err := json.Marshal(results)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to marshal response")
+		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
+		return
 	}
 
-	return nil
+	log.Info().Msgf("Upload of %d files finished.\n", len(results))
+	util.SendHTTPResponse(w, statusCode, string(response), false)
 }
 
 func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
@@ -250,7 +271,11 @@ func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	// Use the decoded filename for further processing
 	filename := filepath.Base(decodedFilename)
 
-	targetPath := dirPath
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+	targetPath := rootPath
 	// supports both dowloadFile and dowloadFile/{path}/{fileName}
 	if customPath, ok := vars["path"]; ok && customPath != "" {
 		// clean the path to prevent directory traversal attacks
@@ -260,8 +285,8 @@ func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Unable to url decode path", http.StatusBadRequest)
 			return
 		}
-		targetPath = filepath.Join(dirPath, decodedPath)
-		targetPath, err = CleanAndVerifyTargetPath(targetPath)
+		targetPath = filepath.Join(rootPath, decodedPath)
+		targetPath, err = CleanAndVerifyTargetPath(rootPath, targetPath)
 		if err != nil {
 			log.Error().Err(err).Msg("Unable to clean and verify target path")
 			http.Error(w, "Unable to clean and verify target path", http.StatusBadRequest)
@@ -286,15 +311,70 @@ func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.ServeFile(w, r, filePath)
+	ServeFileWithETag(w, r, filePath, filename)
+}
+
+// newFileMetadata guesses the MIME type from the extension only, describeFile reads the content
+func newFileMetadata(name string, fileInfo os.FileInfo) FileMetadata {
+	mimeType := mimeTypeOrDefault(mime.TypeByExtension(filepath.Ext(name)))
+	entryType := fileType
+	if fileInfo.IsDir() {
+		entryType = dirType
+		mimeType = dirMIMEType
+	}
+
+	return FileMetadata{
+		Name:        name,
+		Type:        entryType,
+		Filename:    name,
+		Size:        fileInfo.Size(),
+		LastModTime: fileInfo.ModTime(),
+		MIMEType:    mimeType,
+		ContentType: mimeType,
+	}
+}
+
+var (
+	fileErrors    = metrics.NewCounter("jupyterpython_file_errors_total", "Failed file operations by error code.", "code")
+	uploadBytes   = metrics.NewCounter("jupyterpython_upload_bytes_total", "File bytes received by uploads.")
+	downloadBytes = metrics.NewCounter("jupyterpython_download_bytes_total", "File bytes sent by downloads and archives.")
+)
+
+// countingResponseWriter adds the bytes of the response body to downloadBytes
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	downloadBytes.Add(float64(n))
+	return n, err
+}
+
+// ReadFrom keeps the io.ReaderFrom of the wrapped writer, which serves files with sendfile
+func (w countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if readerFrom, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, r)
+	}
+	downloadBytes.Add(float64(n))
+	return n, err
 }
 
 func logAndRespond(w http.ResponseWriter, statusCode int, errCode, errMsg string) {
+	fileErrors.Inc(errCode)
 	log.Error().Str("error_code", errCode).Msg(errMsg)
 	util.SendHTTPResponse(w, statusCode, fmt.Sprintf("%s: %s", errCode, errMsg), true)
 }
 
 func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
 	vars := mux.Vars(r)
 	encodedFilename := vars["filename"]
 
@@ -308,10 +388,18 @@ func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Use the decoded filename in further processing
 	filename := filepath.Base(decodedFilename)
-	filePath := filepath.Join(dirPath, filename)
+
+	// supports both delete/{fileName} and delete/{path}/{fileName}
+	targetPath, err := ResolveTargetPath(rootPath, vars["path"])
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to clean and verify target path")
+		http.Error(w, "Unable to clean and verify target path", http.StatusBadRequest)
+		return
+	}
+	filePath := filepath.Join(targetPath, filename)
 
 	// Check if the file exists
-	_, err = os.Lstat(filePath)
+	fileInfo, err := os.Lstat(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			logAndRespond(w, http.StatusNotFound, ErrCodeFileNotFound, "File not found")
@@ -321,6 +409,11 @@ func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := PreconditionsFromRequest(r).Check(filePath); err != nil {
+		logAndRespond(w, http.StatusPreconditionFailed, ErrCodePreconditionFailed, err.Error())
+		return
+	}
+
 	// File exists, proceed with deletion
 	err = os.Remove(filePath)
 	if err != nil {
@@ -329,11 +422,18 @@ func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if fileInfo.Mode().IsRegular() {
+		AddUsage(rootPath, -fileInfo.Size(), -1)
+	}
 	log.Info().Msg(fmt.Sprintf("File %s deleted successfully.\n", filename))
 	util.SendHTTPResponse(w, http.StatusOK, "file deleted successfully", true)
 }
 
 func GetFileHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
 	vars := mux.Vars(r)
 	encodedFilename := vars["filename"]
 
@@ -347,7 +447,25 @@ func GetFileHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Use the decoded filename in further processing
 	filename := filepath.Base(decodedFilename)
-	filePath := filepath.Join(dirPath, filename)
+
+	version, ok := resolveAPIVersion(w, r)
+	if !ok {
+		return
+	}
+	metadataOptions, err := ParseMetadataOptions(r.URL.Query())
+	if err != nil {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+
+	// supports both get/{fileName} and get/{path}/{fileName}
+	targetPath, err := ResolveTargetPath(rootPath, vars["path"])
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to clean and verify target path")
+		http.Error(w, "Unable to clean and verify target path", http.StatusBadRequest)
+		return
+	}
+	filePath := filepath.Join(targetPath, filename)
 
 	// if file exists, retrieve file information using os.Stat
 	fileInfo, err := os.Lstat(filePath)
@@ -361,19 +479,8 @@ func GetFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mimeType := mime.TypeByExtension(filepath.Ext(filename))
-	if mimeType == "" {
-		mimeType = "application/octet-stream" // default MIME type
-	}
-
-	fileMetadata := FileMetadata{
-		Filename:    filename,
-		Size:        fileInfo.Size(),
-		LastModTime: fileInfo.ModTime(),
-		MIMEType:    mimeType,
-	}
-
-	response, err := json.Marshal(fileMetadata)
+	fileMetadata := describeFile(rootPath, filePath, newFileMetadata(filename, fileInfo), metadataOptions)
+	response, err := json.Marshal(fileMetadata.ForAPIVersion(version))
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to marshal response")
 		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
@@ -406,15 +513,100 @@ func UnescapeAndCleanPath(path string) (string, error) {
 	return decodedPath, nil
 }
 
-func CleanAndVerifyTargetPath(path string) (string, error) {
-	cleanedDirPath := filepath.Clean(dirPath)
+// ResolveTargetPath unescapes customPath and verifies it stays inside rootPath, an empty path resolves to rootPath
+func ResolveTargetPath(rootPath string, customPath string) (string, error) {
+	if customPath == "" {
+		return rootPath, nil
+	}
+
+	// clean the path to prevent directory traversal attacks
+	decodedPath, err := UnescapeAndCleanPath(customPath)
+	if err != nil {
+		return "", err
+	}
+	return CleanAndVerifyTargetPath(rootPath, filepath.Join(rootPath, decodedPath))
+}
+
+// CleanAndVerifyTargetPath makes sure path stays inside rootPath, which is the data root or a tenant's directory under it.
+// The depth limit applies to the path below the data root so tenants get the same depth as a single tenant install.
+func CleanAndVerifyTargetPath(rootPath string, path string) (string, error) {
+	cleanedDirPath := filepath.Clean(rootPath)
 	cleaned := filepath.Clean(path)
-	if !strings.HasPrefix(cleaned, cleanedDirPath) {
+	if cleaned != cleanedDirPath && !strings.HasPrefix(cleaned, cleanedDirPath+string(filepath.Separator)) {
 		return "", fmt.Errorf("failed to properly verify destination file path '%s'. filepath did not end up in the '%s' directory", cleaned, cleanedDirPath)
 	}
-	totalSegments := len(strings.Split(cleaned[1:], string(filepath.Separator)))
+	if inVersions(cleanedDirPath, cleaned) {
+		return "", fmt.Errorf("destination file path '%s' is reserved for file versions", cleaned)
+	}
+	totalSegments := pathDepth(cleanedDirPath, cleaned)
 	if totalSegments > dirPathMaxDepth {
 		return "", fmt.Errorf("destination file path '%s' is too long. directory depth should not exceed '%v', was '%v'", cleaned, dirPathMaxDepth, totalSegments)
 	}
+	if err := verifyResolvedPath(cleanedDirPath, cleaned); err != nil {
+		return "", err
+	}
 	return cleaned, nil
 }
+
+// verifyResolvedPath follows the symlinks of the existing part of path and checks it still ends up inside rootPath.
+// Executed code can create symlinks in its root, the server must not follow them out of it.
+func verifyResolvedPath(rootPath string, path string) error {
+	resolvedRoot, err := filepath.EvalSymlinks(rootPath)
+	if err != nil {
+		// nothing exists below a missing root
+		return nil
+	}
+	for existing := path; ; existing = filepath.Dir(existing) {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if resolved != resolvedRoot && !strings.HasPrefix(resolved, resolvedRoot+string(filepath.Separator)) {
+				return fmt.Errorf("destination file path '%s' resolves outside of the '%s' directory", path, rootPath)
+			}
+			return nil
+		}
+		// a dangling symlink could still be created below, e.g. by MkdirAll
+		if _, lstatErr := os.Lstat(existing); lstatErr == nil || !os.IsNotExist(err) {
+			return fmt.Errorf("unable to resolve destination file path '%s'", path)
+		}
+		if existing == rootPath {
+			return nil
+		}
+	}
+}
+
+func pathSegments(path string) int {
+	return len(strings.Split(path[1:], string(filepath.Separator)))
+}
+
+// pathDepth is the number of segments of path, not counting the tenant directory of rootPath
+func pathDepth(rootPath string, path string) int {
+	return pathSegments(filepath.Clean(path)) - pathSegments(filepath.Clean(rootPath)) + dataRootDepth
+}
+
+// RootPath returns the directory a request may access: the data root, or <data root>/<tenant> when multi tenancy is enabled
+func RootPath(r *http.Request) (string, error) {
+	tenant, err := auth.TenantFromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	return TenantRootPath(tenant)
+}
+
+// TenantRootPath returns the directory of tenant and creates it, the data root itself without a tenant
+func TenantRootPath(tenant string) (string, error) {
+	if tenant == "" {
+		return dirPath, nil
+	}
+
+	root, _, err := TenantUser(tenant)
+	return root, err
+}
+
+func resolveRootPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	rootPath, err := RootPath(r)
+	if err != nil {
+		logAndRespond(w, http.StatusBadRequest, auth.ErrCodeTenantRequired, err.Error())
+		return "", false
+	}
+	return rootPath, true
+}
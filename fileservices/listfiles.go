@@ -0,0 +1,257 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrCodeInvalidParameter = "ERR_INVALID_PARAMETER"
+	NextPageTokenHeader     = "X-Next-Page-Token"
+
+	sortByName  = "name"
+	sortBySize  = "size"
+	sortByMtime = "mtime"
+	orderAsc    = "asc"
+	orderDesc   = "desc"
+	maxPageSize = 5000
+)
+
+// ListOptions are the query parameters of the list files endpoints
+type ListOptions struct {
+	Recursive bool
+	Glob      string
+	Type      string
+	Sort      string
+	Order     string
+	Limit     int
+	PageToken *pageToken
+}
+
+// pageToken is the position of the last returned item, so pages stay stable when files are added or removed
+type pageToken struct {
+	Sort        string `json:"s"`
+	Order       string `json:"o"`
+	Name        string `json:"n"`
+	Size        int64  `json:"z"`
+	LastModTime int64  `json:"t"`
+}
+
+// ParseListOptions reads recursive, glob, type, sort, order, limit and pageToken
+func ParseListOptions(query url.Values) (ListOptions, error) {
+	options := ListOptions{
+		Glob:  query.Get("glob"),
+		Type:  query.Get("type"),
+		Sort:  query.Get("sort"),
+		Order: query.Get("order"),
+	}
+
+	if recursive := query.Get("recursive"); recursive != "" {
+		value, err := strconv.ParseBool(recursive)
+		if err != nil {
+			return options, fmt.Errorf("invalid recursive value '%s'", recursive)
+		}
+		options.Recursive = value
+	}
+
+	if options.Glob != "" {
+		if _, err := filepath.Match(options.Glob, ""); err != nil {
+			return options, fmt.Errorf("invalid glob '%s'", options.Glob)
+		}
+	}
+
+	if options.Type != "" && options.Type != fileType && options.Type != dirType {
+		return options, fmt.Errorf("invalid type '%s', expected %s or %s", options.Type, fileType, dirType)
+	}
+
+	if options.Sort == "" {
+		options.Sort = sortByName
+	}
+	if options.Sort != sortByName && options.Sort != sortBySize && options.Sort != sortByMtime {
+		return options, fmt.Errorf("invalid sort '%s', expected %s, %s or %s", options.Sort, sortByName, sortBySize, sortByMtime)
+	}
+
+	if options.Order == "" {
+		options.Order = orderAsc
+	}
+	if options.Order != orderAsc && options.Order != orderDesc {
+		return options, fmt.Errorf("invalid order '%s', expected %s or %s", options.Order, orderAsc, orderDesc)
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 {
+			return options, fmt.Errorf("invalid limit '%s'", limit)
+		}
+		if value > maxPageSize {
+			value = maxPageSize
+		}
+		options.Limit = value
+	}
+
+	if token := query.Get("pageToken"); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return options, fmt.Errorf("invalid pageToken")
+		}
+		options.PageToken = &pageToken{}
+		if err := json.Unmarshal(decoded, options.PageToken); err != nil {
+			return options, fmt.Errorf("invalid pageToken")
+		}
+		if options.PageToken.Sort != options.Sort || options.PageToken.Order != options.Order {
+			return options, fmt.Errorf("pageToken was created with a different sort or order")
+		}
+	}
+
+	return options, nil
+}
+
+// ListDirectory returns the entries of targetPath matching the options, sorted but not paginated.
+// Names are relative to targetPath so entries of subdirectories can be told apart in recursive listings.
+// Recursion stops at dirPathMaxDepth and symlinks are never followed.
+func ListDirectory(rootPath string, targetPath string, options ListOptions) ([]FileMetadata, error) {
+	var metadataList []FileMetadata
+	versionsPath := filepath.Join(rootPath, versionsDirName)
+
+	err := filepath.WalkDir(targetPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// the target itself must exist, unreadable entries below it are skipped
+			if path == targetPath {
+				return err
+			}
+			log.Error().Err(err).Str("file", path).Msg("Unable to read directory entry")
+			return nil
+		}
+		if path == targetPath {
+			return nil
+		}
+		// file versions are listed by their own endpoint
+		if path == versionsPath && entry.IsDir() {
+			return filepath.SkipDir
+		}
+
+		// Ignore if it is a symlink
+		if entry.Type()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			log.Error().Err(err).Str("file", entry.Name()).Msg("Unable to get file info")
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(targetPath, path)
+		if err != nil {
+			return nil
+		}
+		if options.matches(entry.Name(), fileInfo.IsDir()) {
+			metadataList = append(metadataList, newFileMetadata(filepath.ToSlash(relativePath), fileInfo))
+		}
+
+		if entry.IsDir() && (!options.Recursive || pathDepth(rootPath, path) >= dirPathMaxDepth) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	SortFileMetadata(metadataList, options.Sort, options.Order)
+	return metadataList, nil
+}
+
+func (options ListOptions) matches(name string, isDir bool) bool {
+	if options.Type == fileType && isDir || options.Type == dirType && !isDir {
+		return false
+	}
+	if options.Glob != "" {
+		if matched, _ := filepath.Match(options.Glob, name); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// SortFileMetadata sorts by name, size or mtime, ties are broken by name so the order is total
+func SortFileMetadata(metadataList []FileMetadata, sortBy string, order string) {
+	sort.SliceStable(metadataList, func(i, j int) bool {
+		return lessFileMetadata(metadataList[i], metadataList[j], sortBy, order)
+	})
+}
+
+func lessFileMetadata(a FileMetadata, b FileMetadata, sortBy string, order string) bool {
+	compare := 0
+	switch sortBy {
+	case sortBySize:
+		compare = cmp.Compare(a.Size, b.Size)
+	case sortByMtime:
+		compare = cmp.Compare(a.LastModTime.UnixNano(), b.LastModTime.UnixNano())
+	}
+	if compare == 0 {
+		compare = cmp.Compare(a.Name, b.Name)
+	}
+	if order == orderDesc {
+		return compare > 0
+	}
+	return compare < 0
+}
+
+// Paginate returns the page after the token and the token of the next page, which is empty on the last page
+func Paginate(metadataList []FileMetadata, options ListOptions) ([]FileMetadata, string) {
+	start := 0
+	if options.PageToken != nil {
+		last := FileMetadata{
+			Name:        options.PageToken.Name,
+			Size:        options.PageToken.Size,
+			LastModTime: time.Unix(0, options.PageToken.LastModTime),
+		}
+		start = sort.Search(len(metadataList), func(i int) bool {
+			return lessFileMetadata(last, metadataList[i], options.Sort, options.Order)
+		})
+	}
+
+	if options.Limit == 0 || start+options.Limit >= len(metadataList) {
+		if start >= len(metadataList) {
+			return nil, ""
+		}
+		return metadataList[start:], ""
+	}
+
+	page := metadataList[start : start+options.Limit]
+	last := page[len(page)-1]
+	token, _ := json.Marshal(pageToken{
+		Sort:        options.Sort,
+		Order:       options.Order,
+		Name:        last.Name,
+		Size:        last.Size,
+		LastModTime: last.LastModTime.UnixNano(),
+	})
+	return page, base64.RawURLEncoding.EncodeToString(token)
+}
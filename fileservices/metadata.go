@@ -0,0 +1,269 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/jupyterpython/util"
+)
+
+const (
+	// APIVersion1 returns the deprecated filename and mime_type fields next to name and content_type, APIVersion2 drops them
+	APIVersion1 = 1
+	APIVersion2 = 2
+
+	APIVersionQueryParameter = "api-version"
+
+	dirMIMEType           = "inode/directory"
+	defaultMIMEType       = "application/octet-stream"
+	mimeSniffBytes        = 512
+	maxMIMETypeCacheEntry = 4096
+)
+
+// magic numbers of data formats http.DetectContentType does not know
+var mimeMagicNumbers = []struct {
+	offset   int
+	magic    string
+	mimeType string
+}{
+	{0, parquetMagic, "application/vnd.apache.parquet"},
+	{0, "ARROW1", "application/vnd.apache.arrow.file"},
+	{0, "\x89HDF\r\n\x1a\n", "application/x-hdf5"},
+	{0, "SQLite format 3\x00", "application/vnd.sqlite3"},
+	{0, "\x93NUMPY", "application/x-npy"},
+	{0, "Obj\x01", "application/vnd.apache.avro"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "\x28\xb5\x2f\xfd", "application/zstd"},
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"},
+	{257, "ustar", "application/x-tar"},
+}
+
+// office documents are zip archives, they are told apart by the part that holds the document
+var officeDocumentParts = map[string]string{
+	"xl/workbook.xml":      xlsxMIMEType,
+	"word/document.xml":    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"ppt/presentation.xml": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+type mimeTypeCacheEntry struct {
+	size     int64
+	modTime  time.Time
+	mimeType string
+}
+
+// sniffed types are cached by path and only reused while size and mtime are unchanged
+var (
+	mimeTypeCacheLock sync.Mutex
+	mimeTypeCache     = map[string]mimeTypeCacheEntry{}
+)
+
+// MetadataOptions select the FileMetadata fields that are expensive to compute
+type MetadataOptions struct {
+	SHA256 bool
+}
+
+// ParseMetadataOptions reads sha256
+func ParseMetadataOptions(query url.Values) (MetadataOptions, error) {
+	var options MetadataOptions
+	if value := query.Get("sha256"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid sha256 value '%s'", value)
+		}
+		options.SHA256 = parsed
+	}
+	return options, nil
+}
+
+// DetectMIMEType detects the type of a file from its content. Magic numbers of data formats are checked first,
+// then http.DetectContentType. The extension refines text types, e.g. text/csv, and types the content does not tell.
+func DetectMIMEType(path string, fileInfo os.FileInfo) string {
+	if fileInfo.IsDir() {
+		return dirMIMEType
+	}
+	byExtension := mime.TypeByExtension(filepath.Ext(path))
+	if !fileInfo.Mode().IsRegular() || fileInfo.Size() == 0 {
+		return mimeTypeOrDefault(byExtension)
+	}
+
+	mimeTypeCacheLock.Lock()
+	entry, ok := mimeTypeCache[path]
+	mimeTypeCacheLock.Unlock()
+	if ok && entry.size == fileInfo.Size() && entry.modTime.Equal(fileInfo.ModTime()) {
+		return entry.mimeType
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return mimeTypeOrDefault(byExtension)
+	}
+	defer file.Close()
+	head := make([]byte, mimeSniffBytes)
+	n, _ := io.ReadFull(file, head)
+	mimeType := sniffMIMEType(file, fileInfo.Size(), head[:n], byExtension)
+
+	mimeTypeCacheLock.Lock()
+	if len(mimeTypeCache) >= maxMIMETypeCacheEntry {
+		mimeTypeCache = map[string]mimeTypeCacheEntry{}
+	}
+	mimeTypeCache[path] = mimeTypeCacheEntry{size: fileInfo.Size(), modTime: fileInfo.ModTime(), mimeType: mimeType}
+	mimeTypeCacheLock.Unlock()
+	return mimeType
+}
+
+func sniffMIMEType(file io.ReaderAt, size int64, head []byte, byExtension string) string {
+	for _, magic := range mimeMagicNumbers {
+		if len(head) >= magic.offset+len(magic.magic) && string(head[magic.offset:magic.offset+len(magic.magic)]) == magic.magic {
+			// legacy office documents share one container format, their extension tells them apart
+			if magic.mimeType == "application/x-ole-storage" && byExtension != "" {
+				return byExtension
+			}
+			return magic.mimeType
+		}
+	}
+
+	sniffed := http.DetectContentType(head)
+	switch {
+	case sniffed == "application/zip":
+		return zipMIMEType(file, size, head, byExtension)
+	case sniffed == defaultMIMEType:
+		return mimeTypeOrDefault(byExtension)
+	case strings.HasPrefix(sniffed, "text/") && byExtension != "":
+		return byExtension
+	}
+	return sniffed
+}
+
+// zipMIMEType detects office and OpenDocument files, other zip based formats like wheels keep their extension type
+func zipMIMEType(file io.ReaderAt, size int64, head []byte, byExtension string) string {
+	// OpenDocument files start with an uncompressed entry named mimetype holding their type
+	if len(head) > 38 && string(head[30:38]) == "mimetype" {
+		content := head[38:]
+		if end := bytes.Index(content, []byte("PK")); end > 0 {
+			return string(content[:end])
+		}
+	}
+
+	if reader, err := zip.NewReader(file, size); err == nil {
+		for _, entry := range reader.File {
+			if mimeType, ok := officeDocumentParts[entry.Name]; ok {
+				return mimeType
+			}
+		}
+	}
+	if byExtension != "" && byExtension != "application/zip" && !strings.HasPrefix(byExtension, "text/") {
+		return byExtension
+	}
+	return "application/zip"
+}
+
+func mimeTypeOrDefault(mimeType string) string {
+	if mimeType == "" {
+		return defaultMIMEType
+	}
+	return mimeType
+}
+
+// describeFile adds the path relative to rootPath and the fields read from the file itself to metadata:
+// the content sniffed MIME type, permissions, creation time where the file system records it and the optional sha256
+func describeFile(rootPath string, path string, metadata FileMetadata, options MetadataOptions) FileMetadata {
+	if relativePath, err := filepath.Rel(rootPath, path); err == nil {
+		metadata.Path = filepath.ToSlash(relativePath)
+	}
+
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		return metadata
+	}
+	metadata.Permissions = fmt.Sprintf("%04o", fileInfo.Mode().Perm())
+	if createdTime, ok := fileCreatedTime(path); ok {
+		metadata.CreatedTime = &createdTime
+	}
+
+	mimeType := DetectMIMEType(path, fileInfo)
+	metadata.ContentType = mimeType
+	if metadata.MIMEType != "" {
+		metadata.MIMEType = mimeType
+	}
+
+	if options.SHA256 && fileInfo.Mode().IsRegular() {
+		if digest, err := FileDigest(path, fileInfo); err == nil {
+			metadata.SHA256 = hex.EncodeToString(digest)
+		}
+	}
+	return metadata
+}
+
+// APIVersion returns the api-version of the request, or the configured default without one
+func APIVersion(r *http.Request) (int, error) {
+	value := r.URL.Query().Get(APIVersionQueryParameter)
+	if value == "" {
+		return util.GetConfig().DefaultAPIVersion, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < APIVersion1 || version > APIVersion2 {
+		return 0, fmt.Errorf("invalid %s '%s', expected %d or %d", APIVersionQueryParameter, value, APIVersion1, APIVersion2)
+	}
+	return version, nil
+}
+
+func resolveAPIVersion(w http.ResponseWriter, r *http.Request) (int, bool) {
+	version, err := APIVersion(r)
+	if err != nil {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return 0, false
+	}
+	return version, true
+}
+
+// ForAPIVersion removes the fields deprecated in version
+func (m FileMetadata) ForAPIVersion(version int) FileMetadata {
+	if version >= APIVersion2 {
+		m.Filename = ""
+		m.MIMEType = ""
+	}
+	return m
+}
+
+// MetadataForAPIVersion removes the fields deprecated in version from every entry of metadataList
+func MetadataForAPIVersion(metadataList []FileMetadata, version int) []FileMetadata {
+	for i := range metadataList {
+		metadataList[i] = metadataList[i].ForAPIVersion(version)
+	}
+	return metadataList
+}
+
+// ForAPIVersion removes the fields deprecated in version from every changed file
+func (c FileChanges) ForAPIVersion(version int) FileChanges {
+	MetadataForAPIVersion(c.Created, version)
+	MetadataForAPIVersion(c.Modified, version)
+	MetadataForAPIVersion(c.Deleted, version)
+	return c
+}
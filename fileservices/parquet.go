@@ -0,0 +1,873 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// A minimal parquet reader for previews. It reads the schema and row count from the footer and
+// the first rows of flat files with PLAIN or dictionary encoded pages, uncompressed, snappy or gzip.
+// Everything else, nested columns, the DELTA encodings and other codecs, is reported as unsupported
+// rather than decoded, a full reader would be a dependency the server does not need otherwise.
+// Files are untrusted: every size read from the file is checked against the bytes it claims to describe
+// before it sizes an allocation, and only as many values as the preview shows are decoded per page.
+
+const (
+	parquetMagic          = "PAR1"
+	parquetMaxFooterBytes = 16 << 20
+	parquetMaxPageBytes   = 64 << 20
+
+	parquetBoolean           = 0
+	parquetInt32             = 1
+	parquetInt64             = 2
+	parquetInt96             = 3
+	parquetFloat             = 4
+	parquetDouble            = 5
+	parquetByteArray         = 6
+	parquetFixedLenByteArray = 7
+
+	parquetOptional = 1
+	parquetRepeated = 2
+
+	parquetEncodingPlain          = 0
+	parquetEncodingPlainDictonary = 2
+	parquetEncodingRLEDictionary  = 8
+
+	parquetCodecUncompressed = 0
+	parquetCodecSnappy       = 1
+	parquetCodecGzip         = 2
+
+	parquetPageData       = 0
+	parquetPageDictionary = 2
+	parquetPageDataV2     = 3
+
+	// converted types that change how a value is shown
+	parquetConvertedUTF8            = 0
+	parquetConvertedDate            = 6
+	parquetConvertedTimestampMillis = 9
+	parquetConvertedTimestampMicros = 10
+)
+
+var parquetTypeNames = map[int64]string{
+	parquetBoolean:           "boolean",
+	parquetInt32:             "int32",
+	parquetInt64:             "int64",
+	parquetInt96:             "int96",
+	parquetFloat:             "float",
+	parquetDouble:            "double",
+	parquetByteArray:         "byte_array",
+	parquetFixedLenByteArray: "fixed_len_byte_array",
+}
+
+type parquetColumn struct {
+	name          string
+	physicalType  int64
+	typeLength    int64
+	optional      bool
+	convertedType int64
+	timeUnit      time.Duration
+	displayType   string
+}
+
+// ParquetPreview is the schema, total row count and first rows of a parquet file.
+// Rows is nil when the file has nested columns, which are not decoded.
+type ParquetPreview struct {
+	Columns   []PreviewColumn
+	Rows      [][]interface{}
+	TotalRows int64
+}
+
+// ReadParquetPreview reads the footer and up to limit rows of the parquet file at path
+func ReadParquetPreview(path string, limit int) (*ParquetPreview, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := readParquetFooter(file, fileInfo.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	columns, flat, err := parquetSchema(metadata)
+	if err != nil {
+		return nil, err
+	}
+	preview := &ParquetPreview{TotalRows: metadata.int(3)}
+	for _, column := range columns {
+		preview.Columns = append(preview.Columns, PreviewColumn{Name: column.name, Type: column.displayType})
+	}
+	if !flat {
+		return preview, nil
+	}
+
+	preview.Rows = [][]interface{}{}
+	for _, rowGroup := range metadata.list(4) {
+		group, ok := rowGroup.(thriftStruct)
+		if !ok {
+			return nil, errors.New("invalid parquet row group")
+		}
+		rows := int(min(group.int(3), int64(limit-len(preview.Rows))))
+		if rows <= 0 {
+			break
+		}
+
+		chunks := group.list(1)
+		if len(chunks) != len(columns) {
+			return nil, fmt.Errorf("row group has %d columns, schema has %d", len(chunks), len(columns))
+		}
+		values := make([][]interface{}, len(columns))
+		for i, item := range chunks {
+			chunk, ok := item.(thriftStruct)
+			if !ok {
+				return nil, errors.New("invalid parquet column chunk")
+			}
+			if values[i], err = readParquetColumnChunk(file, chunk.structure(3), columns[i], rows); err != nil {
+				return nil, fmt.Errorf("column '%s': %v", columns[i].name, err)
+			}
+		}
+		for row := 0; row < rows; row++ {
+			record := make([]interface{}, len(columns))
+			for i := range columns {
+				if row < len(values[i]) {
+					record[i] = values[i][row]
+				}
+			}
+			preview.Rows = append(preview.Rows, record)
+		}
+	}
+	return preview, nil
+}
+
+func readParquetFooter(file io.ReaderAt, size int64) (thriftStruct, error) {
+	tail := make([]byte, 8)
+	if size < 12 {
+		return nil, errors.New("file is too small to be parquet")
+	}
+	if _, err := file.ReadAt(tail, size-8); err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != parquetMagic {
+		return nil, errors.New("missing parquet magic number")
+	}
+	footerLength := int64(binary.LittleEndian.Uint32(tail[:4]))
+	if footerLength > parquetMaxFooterBytes || footerLength > size-12 {
+		return nil, errors.New("invalid parquet footer length")
+	}
+
+	footer := make([]byte, footerLength)
+	if _, err := file.ReadAt(footer, size-8-footerLength); err != nil {
+		return nil, err
+	}
+	return newThriftReader(bytes.NewReader(footer)).readStruct(0)
+}
+
+// parquetSchema returns the leaf columns and whether the schema is flat, i.e. has no groups or repeated fields
+func parquetSchema(metadata thriftStruct) ([]parquetColumn, bool, error) {
+	schema := metadata.list(2)
+	if len(schema) == 0 {
+		return nil, false, errors.New("parquet file has no schema")
+	}
+
+	var columns []parquetColumn
+	flat := true
+	for _, item := range schema[1:] {
+		element, ok := item.(thriftStruct)
+		if !ok {
+			return nil, false, errors.New("invalid parquet schema element")
+		}
+		if element.int(5) > 0 {
+			flat = false
+			continue
+		}
+		column := parquetColumn{
+			name:          string(element.bytes(4)),
+			physicalType:  element.int(1),
+			typeLength:    element.int(2),
+			optional:      element.int(3) == parquetOptional,
+			convertedType: -1,
+		}
+		if element.int(3) == parquetRepeated {
+			flat = false
+		}
+		if _, ok := element[6]; ok {
+			column.convertedType = element.int(6)
+		}
+		column.displayType = parquetTypeNames[column.physicalType]
+
+		logicalType := element.structure(10)
+		switch {
+		case logicalType.has(1) || column.convertedType == parquetConvertedUTF8:
+			column.displayType = "string"
+		case logicalType.has(6) || column.convertedType == parquetConvertedDate:
+			column.displayType = "date"
+		case logicalType.has(8) || column.convertedType == parquetConvertedTimestampMillis || column.convertedType == parquetConvertedTimestampMicros:
+			column.displayType = "timestamp"
+			column.timeUnit = time.Millisecond
+			unit := logicalType.structure(8).structure(2)
+			if unit.has(2) || column.convertedType == parquetConvertedTimestampMicros {
+				column.timeUnit = time.Microsecond
+			} else if unit.has(3) {
+				column.timeUnit = time.Nanosecond
+			}
+		case column.physicalType == parquetInt96:
+			column.displayType = "timestamp"
+		}
+		columns = append(columns, column)
+	}
+	return columns, flat, nil
+}
+
+// readParquetColumnChunk decodes the first rows values of a column chunk, nulls are nil
+func readParquetColumnChunk(file io.ReaderAt, metadata thriftStruct, column parquetColumn, rows int) ([]interface{}, error) {
+	codec := metadata.int(4)
+	offset := metadata.int(9)
+	if dictionaryOffset := metadata.int(11); dictionaryOffset > 0 && dictionaryOffset < offset {
+		offset = dictionaryOffset
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, math.MaxInt64-offset))
+	totalValues := metadata.int(5)
+
+	var dictionary []interface{}
+	values := []interface{}{}
+	var read int64
+	for len(values) < rows && read < totalValues {
+		header, err := newThriftReader(reader).readStruct(0)
+		if err != nil {
+			return nil, err
+		}
+		compressedSize := header.int(3)
+		if compressedSize < 0 || compressedSize > parquetMaxPageBytes || header.int(2) > parquetMaxPageBytes {
+			return nil, errors.New("parquet page is too large")
+		}
+		page := make([]byte, compressedSize)
+		if _, err := io.ReadFull(reader, page); err != nil {
+			return nil, err
+		}
+
+		switch header.int(1) {
+		case parquetPageDictionary:
+			data, err := decompressParquetPage(codec, page, header.int(2))
+			if err != nil {
+				return nil, err
+			}
+			dictionary, _, err = decodeParquetPlain(data, column, header.structure(7).int(1))
+			if err != nil {
+				return nil, err
+			}
+		case parquetPageData:
+			pageHeader := header.structure(5)
+			data, err := decompressParquetPage(codec, page, header.int(2))
+			if err != nil {
+				return nil, err
+			}
+			numValues := pageHeader.int(1)
+			if numValues < 0 {
+				return nil, errors.New("invalid parquet page value count")
+			}
+			// only the values still missing from the preview are decoded
+			wanted := int(min(numValues, int64(rows-len(values))))
+			var definitionLevels []int
+			if column.optional {
+				if len(data) < 4 {
+					return nil, errors.New("truncated definition levels")
+				}
+				length := int(binary.LittleEndian.Uint32(data[:4]))
+				if length > len(data)-4 {
+					return nil, errors.New("truncated definition levels")
+				}
+				if definitionLevels, err = decodeRLEHybrid(data[4:4+length], 1, wanted); err != nil {
+					return nil, err
+				}
+				data = data[4+length:]
+			}
+			pageValues, err := decodeParquetValues(data, pageHeader.int(2), column, dictionary, wanted, definitionLevels)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, pageValues...)
+			read += numValues
+		case parquetPageDataV2:
+			pageHeader := header.structure(8)
+			numValues := pageHeader.int(1)
+			if numValues < 0 {
+				return nil, errors.New("invalid parquet page value count")
+			}
+			wanted := int(min(numValues, int64(rows-len(values))))
+			definitionLength := int(pageHeader.int(5))
+			repetitionLength := int(pageHeader.int(6))
+			if definitionLength < 0 || repetitionLength < 0 || definitionLength+repetitionLength > len(page) {
+				return nil, errors.New("truncated levels")
+			}
+			var definitionLevels []int
+			if column.optional {
+				if definitionLevels, err = decodeRLEHybrid(page[repetitionLength:repetitionLength+definitionLength], 1, wanted); err != nil {
+					return nil, err
+				}
+			}
+			data := page[repetitionLength+definitionLength:]
+			if !pageHeader.has(7) || pageHeader.bool(7) {
+				if data, err = decompressParquetPage(codec, data, header.int(2)-int64(repetitionLength+definitionLength)); err != nil {
+					return nil, err
+				}
+			}
+			pageValues, err := decodeParquetValues(data, pageHeader.int(4), column, dictionary, wanted, definitionLevels)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, pageValues...)
+			read += numValues
+		}
+	}
+
+	if len(values) > rows {
+		values = values[:rows]
+	}
+	return values, nil
+}
+
+func decompressParquetPage(codec int64, page []byte, uncompressedSize int64) ([]byte, error) {
+	switch codec {
+	case parquetCodecUncompressed:
+		return page, nil
+	case parquetCodecSnappy:
+		return decodeSnappy(page)
+	case parquetCodecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(page))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(io.LimitReader(reader, max(uncompressedSize, 0)))
+	}
+	return nil, fmt.Errorf("unsupported parquet compression codec %d", codec)
+}
+
+// decodeParquetValues decodes the non-null values of the first numValues of a data page and spreads them
+// over the definition levels
+func decodeParquetValues(data []byte, encoding int64, column parquetColumn, dictionary []interface{}, numValues int, definitionLevels []int) ([]interface{}, error) {
+	present := numValues
+	if definitionLevels != nil {
+		present = 0
+		for _, level := range definitionLevels {
+			present += level
+		}
+	}
+
+	var decoded []interface{}
+	switch encoding {
+	case parquetEncodingPlain:
+		var err error
+		if decoded, _, err = decodeParquetPlain(data, column, int64(present)); err != nil {
+			return nil, err
+		}
+	case parquetEncodingPlainDictonary, parquetEncodingRLEDictionary:
+		if dictionary == nil || len(data) == 0 {
+			return nil, errors.New("dictionary encoded page without dictionary")
+		}
+		indexes, err := decodeRLEHybrid(data[1:], int(data[0]), present)
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range indexes {
+			if index >= len(dictionary) {
+				return nil, errors.New("dictionary index out of range")
+			}
+			decoded = append(decoded, dictionary[index])
+		}
+	default:
+		return nil, fmt.Errorf("unsupported parquet encoding %d", encoding)
+	}
+
+	if definitionLevels == nil {
+		return decoded, nil
+	}
+	values := make([]interface{}, 0, numValues)
+	next := 0
+	for _, level := range definitionLevels {
+		if level == 0 || next >= len(decoded) {
+			values = append(values, nil)
+			continue
+		}
+		values = append(values, decoded[next])
+		next++
+	}
+	return values, nil
+}
+
+// decodeParquetPlain decodes count PLAIN values and returns them with the number of bytes consumed.
+// count comes from the file, it is checked against the smallest size count values can take in data.
+func decodeParquetPlain(data []byte, column parquetColumn, countValue int64) ([]interface{}, int, error) {
+	if countValue < 0 || countValue > int64(len(data))*8/parquetMinValueBits(column) {
+		return nil, 0, errors.New("parquet page holds fewer values than its header claims")
+	}
+	count := int(countValue)
+	values := make([]interface{}, 0, count)
+	position := 0
+	need := func(n int) error {
+		if position+n > len(data) {
+			return errors.New("truncated parquet page")
+		}
+		return nil
+	}
+
+	if column.physicalType == parquetBoolean && (count+7)/8 > len(data) {
+		return nil, 0, errors.New("truncated parquet page")
+	}
+	for i := 0; i < count; i++ {
+		switch column.physicalType {
+		case parquetBoolean:
+			values = append(values, data[i/8]>>(i%8)&1 == 1)
+		case parquetInt32:
+			if err := need(4); err != nil {
+				return nil, 0, err
+			}
+			value := int32(binary.LittleEndian.Uint32(data[position:]))
+			position += 4
+			if column.displayType == "date" {
+				values = append(values, time.Unix(int64(value)*86400, 0).UTC().Format("2006-01-02"))
+			} else {
+				values = append(values, value)
+			}
+		case parquetInt64:
+			if err := need(8); err != nil {
+				return nil, 0, err
+			}
+			value := int64(binary.LittleEndian.Uint64(data[position:]))
+			position += 8
+			if column.displayType == "timestamp" {
+				values = append(values, time.Unix(0, 0).Add(time.Duration(value)*column.timeUnit).UTC().Format(time.RFC3339Nano))
+			} else {
+				values = append(values, value)
+			}
+		case parquetInt96:
+			if err := need(12); err != nil {
+				return nil, 0, err
+			}
+			nanos := int64(binary.LittleEndian.Uint64(data[position:]))
+			julianDay := int64(binary.LittleEndian.Uint32(data[position+8:]))
+			position += 12
+			values = append(values, time.Unix((julianDay-2440588)*86400, nanos).UTC().Format(time.RFC3339Nano))
+		case parquetFloat:
+			if err := need(4); err != nil {
+				return nil, 0, err
+			}
+			values = append(values, jsonFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(data[position:])))))
+			position += 4
+		case parquetDouble:
+			if err := need(8); err != nil {
+				return nil, 0, err
+			}
+			values = append(values, jsonFloat(math.Float64frombits(binary.LittleEndian.Uint64(data[position:]))))
+			position += 8
+		case parquetByteArray, parquetFixedLenByteArray:
+			length := int(column.typeLength)
+			if column.physicalType == parquetByteArray {
+				if err := need(4); err != nil {
+					return nil, 0, err
+				}
+				length = int(binary.LittleEndian.Uint32(data[position:]))
+				position += 4
+			}
+			if err := need(length); err != nil {
+				return nil, 0, err
+			}
+			values = append(values, displayBytes(data[position:position+length]))
+			position += length
+		default:
+			return nil, 0, fmt.Errorf("unsupported parquet type %d", column.physicalType)
+		}
+	}
+	if column.physicalType == parquetBoolean {
+		position = (count + 7) / 8
+	}
+	return values, position, nil
+}
+
+// parquetMinValueBits is the size of the smallest PLAIN value of the column, byte arrays have a length prefix
+func parquetMinValueBits(column parquetColumn) int64 {
+	switch column.physicalType {
+	case parquetInt32, parquetFloat, parquetByteArray:
+		return 32
+	case parquetInt64, parquetDouble:
+		return 64
+	case parquetInt96:
+		return 96
+	case parquetFixedLenByteArray:
+		return max(column.typeLength*8, 1)
+	}
+	return 1
+}
+
+// NaN and infinity can not be marshaled to JSON
+func jsonFloat(value float64) interface{} {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Sprint(value)
+	}
+	return value
+}
+
+func displayBytes(value []byte) string {
+	if utf8.Valid(value) {
+		return string(value)
+	}
+	return base64.StdEncoding.EncodeToString(value)
+}
+
+// decodeRLEHybrid decodes count values of the parquet RLE / bit-packing hybrid encoding
+func decodeRLEHybrid(data []byte, bitWidth int, count int) ([]int, error) {
+	if bitWidth < 0 || bitWidth > 32 {
+		return nil, fmt.Errorf("invalid bit width %d", bitWidth)
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("invalid value count %d", count)
+	}
+	values := make([]int, 0, count)
+	reader := bytes.NewReader(data)
+	byteWidth := (bitWidth + 7) / 8
+
+	for len(values) < count {
+		header, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, errors.New("truncated RLE data")
+		}
+		if header&1 == 0 {
+			// a run of one repeated value
+			buffer := make([]byte, 4)
+			if _, err := io.ReadFull(reader, buffer[:byteWidth]); err != nil {
+				return nil, errors.New("truncated RLE data")
+			}
+			value := int(binary.LittleEndian.Uint32(buffer))
+			for run := header >> 1; run > 0 && len(values) < count; run-- {
+				values = append(values, value)
+			}
+			continue
+		}
+
+		// groups of eight bit-packed values, least significant bit first, each group takes bitWidth bytes
+		if bitWidth > 0 && header>>1 > uint64(reader.Len()/bitWidth) {
+			return nil, errors.New("truncated bit-packed data")
+		}
+		groups := int(min(header>>1, uint64(count/8+1)))
+		packed := make([]byte, groups*bitWidth)
+		if _, err := io.ReadFull(reader, packed); err != nil {
+			return nil, errors.New("truncated bit-packed data")
+		}
+		for i := 0; i < groups*8 && len(values) < count; i++ {
+			value := 0
+			for bit := 0; bit < bitWidth; bit++ {
+				position := i*bitWidth + bit
+				value |= int(packed[position/8]>>(position%8)&1) << bit
+			}
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// decodeSnappy decodes a raw snappy block as written by parquet
+func decodeSnappy(src []byte) ([]byte, error) {
+	reader := bytes.NewReader(src)
+	length, err := binary.ReadUvarint(reader)
+	if err != nil || length > parquetMaxPageBytes {
+		return nil, errors.New("invalid snappy length")
+	}
+	src = src[len(src)-reader.Len():]
+	dst := make([]byte, 0, length)
+
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 3 {
+		case 0:
+			literalLength := int(tag>>2) + 1
+			src = src[1:]
+			if literalLength > 60 {
+				extra := literalLength - 60
+				if len(src) < extra {
+					return nil, errors.New("truncated snappy literal")
+				}
+				literalLength = 0
+				for i := 0; i < extra; i++ {
+					literalLength |= int(src[i]) << (8 * i)
+				}
+				literalLength++
+				src = src[extra:]
+			}
+			if literalLength > len(src) {
+				return nil, errors.New("truncated snappy literal")
+			}
+			dst = append(dst, src[:literalLength]...)
+			src = src[literalLength:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errors.New("truncated snappy copy")
+			}
+			copyLength := int(tag>>2&7) + 4
+			offset := int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+			if dst, err = snappyCopy(dst, offset, copyLength); err != nil {
+				return nil, err
+			}
+		case 2:
+			if len(src) < 3 {
+				return nil, errors.New("truncated snappy copy")
+			}
+			offset := int(binary.LittleEndian.Uint16(src[1:]))
+			if dst, err = snappyCopy(dst, offset, int(tag>>2)+1); err != nil {
+				return nil, err
+			}
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errors.New("truncated snappy copy")
+			}
+			offset := int(binary.LittleEndian.Uint32(src[1:]))
+			if dst, err = snappyCopy(dst, offset, int(tag>>2)+1); err != nil {
+				return nil, err
+			}
+			src = src[5:]
+		}
+	}
+	if uint64(len(dst)) != length {
+		return nil, errors.New("snappy length mismatch")
+	}
+	return dst, nil
+}
+
+// copies may overlap their own output, so bytes are appended one at a time
+func snappyCopy(dst []byte, offset int, length int) ([]byte, error) {
+	if offset <= 0 || offset > len(dst) || len(dst)+length > cap(dst) {
+		return nil, errors.New("invalid snappy copy")
+	}
+	start := len(dst) - offset
+	for i := 0; i < length; i++ {
+		dst = append(dst, dst[start+i])
+	}
+	return dst, nil
+}
+
+// thriftStruct is a decoded thrift struct keyed by field id
+type thriftStruct map[int16]interface{}
+
+func (s thriftStruct) has(id int16) bool {
+	_, ok := s[id]
+	return ok
+}
+
+func (s thriftStruct) int(id int16) int64 {
+	value, _ := s[id].(int64)
+	return value
+}
+
+func (s thriftStruct) bool(id int16) bool {
+	value, _ := s[id].(bool)
+	return value
+}
+
+func (s thriftStruct) bytes(id int16) []byte {
+	value, _ := s[id].([]byte)
+	return value
+}
+
+func (s thriftStruct) list(id int16) []interface{} {
+	value, _ := s[id].([]interface{})
+	return value
+}
+
+func (s thriftStruct) structure(id int16) thriftStruct {
+	value, _ := s[id].(thriftStruct)
+	return value
+}
+
+const (
+	thriftBooleanTrue  = 1
+	thriftBooleanFalse = 2
+	thriftByte         = 3
+	thriftI16          = 4
+	thriftI32          = 5
+	thriftI64          = 6
+	thriftDouble       = 7
+	thriftBinary       = 8
+	thriftList         = 9
+	thriftSet          = 10
+	thriftMap          = 11
+	thriftStructType   = 12
+
+	thriftMaxDepth      = 32
+	thriftMaxCollection = 1 << 20
+)
+
+// thriftReader decodes the thrift compact protocol used by parquet metadata
+type thriftReader struct {
+	reader io.ByteReader
+}
+
+func newThriftReader(reader io.ByteReader) *thriftReader {
+	return &thriftReader{reader: reader}
+}
+
+func (t *thriftReader) readStruct(depth int) (thriftStruct, error) {
+	if depth > thriftMaxDepth {
+		return nil, errors.New("thrift struct nested too deep")
+	}
+	result := thriftStruct{}
+	var fieldID int16
+	for {
+		header, err := t.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if header == 0 {
+			return result, nil
+		}
+		if delta := header >> 4; delta != 0 {
+			fieldID += int16(delta)
+		} else {
+			id, err := t.readVarint()
+			if err != nil {
+				return nil, err
+			}
+			fieldID = int16(id)
+		}
+
+		fieldType := header & 0x0f
+		switch fieldType {
+		case thriftBooleanTrue:
+			result[fieldID] = true
+		case thriftBooleanFalse:
+			result[fieldID] = false
+		default:
+			value, err := t.readValue(fieldType, depth)
+			if err != nil {
+				return nil, err
+			}
+			result[fieldID] = value
+		}
+	}
+}
+
+func (t *thriftReader) readValue(valueType byte, depth int) (interface{}, error) {
+	switch valueType {
+	case thriftBooleanTrue, thriftBooleanFalse:
+		// booleans inside collections are a full byte
+		value, err := t.reader.ReadByte()
+		return value == thriftBooleanTrue, err
+	case thriftByte:
+		value, err := t.reader.ReadByte()
+		return int64(int8(value)), err
+	case thriftI16, thriftI32, thriftI64:
+		return t.readVarint()
+	case thriftDouble:
+		buffer := make([]byte, 8)
+		for i := range buffer {
+			value, err := t.reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			buffer[i] = value
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(buffer)), nil
+	case thriftBinary:
+		length, err := binary.ReadUvarint(t.reader)
+		if err != nil {
+			return nil, err
+		}
+		if length > parquetMaxFooterBytes {
+			return nil, errors.New("thrift binary too long")
+		}
+		buffer := make([]byte, length)
+		for i := range buffer {
+			if buffer[i], err = t.reader.ReadByte(); err != nil {
+				return nil, err
+			}
+		}
+		return buffer, nil
+	case thriftList, thriftSet:
+		header, err := t.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = binary.ReadUvarint(t.reader); err != nil {
+				return nil, err
+			}
+		}
+		if size > thriftMaxCollection {
+			return nil, errors.New("thrift list too long")
+		}
+		list := make([]interface{}, 0, size)
+		for i := uint64(0); i < size; i++ {
+			value, err := t.readValue(header&0x0f, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case thriftMap:
+		size, err := binary.ReadUvarint(t.reader)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		if size > thriftMaxCollection {
+			return nil, errors.New("thrift map too large")
+		}
+		types, err := t.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < size; i++ {
+			if _, err := t.readValue(types>>4, depth+1); err != nil {
+				return nil, err
+			}
+			if _, err := t.readValue(types&0x0f, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		// maps are not used by the preview, they are skipped
+		return nil, nil
+	case thriftStructType:
+		return t.readStruct(depth + 1)
+	}
+	return nil, fmt.Errorf("unknown thrift type %d", valueType)
+}
+
+// readVarint reads a zigzag encoded varint
+func (t *thriftReader) readVarint() (int64, error) {
+	value, err := binary.ReadUvarint(t.reader)
+	if err != nil {
+		return 0, err
+	}
+	return int64(value>>1) ^ -int64(value&1), nil
+}
@@ -0,0 +1,569 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrCodePreviewUnsupported = "ERR_PREVIEW_UNSUPPORTED"
+	ErrCodePreviewFailed      = "ERR_PREVIEW_FAILED"
+
+	PreviewKindTable = "table"
+	PreviewKindText  = "text"
+	PreviewKindImage = "image"
+
+	defaultPreviewLimit   = 20
+	maxPreviewLimit       = 1000
+	defaultThumbnailSize  = 256
+	maxThumbnailSize      = 1024
+	previewMaxReadBytes   = 4 << 20
+	previewMaxLineLength  = 4096
+	previewMaxImagePixels = 50_000_000
+	previewSniffBytes     = 512
+)
+
+// Preview is the response of GET /preview/{path}, only the fields of its kind are set.
+// Tables have columns and rows, text has lines and the detected encoding, images a PNG thumbnail as data URL.
+// Truncated is set when the file has more rows or lines than returned.
+type Preview struct {
+	FileMetadata
+	Kind      string          `json:"kind"`
+	Format    string          `json:"format"`
+	Columns   []PreviewColumn `json:"columns,omitempty"`
+	Rows      [][]interface{} `json:"rows,omitempty"`
+	TotalRows *int64          `json:"total_rows,omitempty"`
+	Lines     []string        `json:"lines,omitempty"`
+	Encoding  string          `json:"encoding,omitempty"`
+	Width     int             `json:"width,omitempty"`
+	Height    int             `json:"height,omitempty"`
+	Thumbnail string          `json:"thumbnail,omitempty"`
+	Truncated bool            `json:"truncated"`
+}
+
+// PreviewColumn is a table column with its parquet type or the type inferred from the previewed CSV values
+type PreviewColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// PreviewOptions are the number of rows or lines and the maximum thumbnail width and height
+type PreviewOptions struct {
+	Limit         int
+	ThumbnailSize int
+}
+
+// errPreviewUnsupported is returned for files that are neither tables, text nor supported images
+var errPreviewUnsupported = errors.New("no preview available for this file type")
+
+func PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+
+	options := PreviewOptions{Limit: defaultPreviewLimit, ThumbnailSize: defaultThumbnailSize}
+	for name, value := range map[string]*int{"limit": &options.Limit, "size": &options.ThumbnailSize} {
+		if raw := r.URL.Query().Get(name); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed <= 0 {
+				logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid %s value", name))
+				return
+			}
+			*value = parsed
+		}
+	}
+	options.Limit = min(options.Limit, maxPreviewLimit)
+	options.ThumbnailSize = min(options.ThumbnailSize, maxThumbnailSize)
+
+	targetPath, err := ResolveTargetPath(rootPath, mux.Vars(r)["path"])
+	if err != nil || targetPath == rootPath {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid path")
+		return
+	}
+
+	fileInfo, err := os.Lstat(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logAndRespond(w, http.StatusNotFound, ErrCodeFileNotFound, "File not found")
+		} else {
+			logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error accessing file")
+		}
+		return
+	}
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeSymlinkNotAllowed, "Symlinks not allowed")
+		return
+	}
+	if !fileInfo.Mode().IsRegular() {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Only files can be previewed")
+		return
+	}
+
+	version, ok := resolveAPIVersion(w, r)
+	if !ok {
+		return
+	}
+
+	relativePath, _ := filepath.Rel(rootPath, targetPath)
+	metadata := describeFile(rootPath, targetPath, newFileMetadata(filepath.ToSlash(relativePath), fileInfo), MetadataOptions{})
+	preview, err := PreviewFile(targetPath, metadata, options)
+	if err != nil {
+		if err == errPreviewUnsupported {
+			logAndRespond(w, http.StatusUnsupportedMediaType, ErrCodePreviewUnsupported, err.Error())
+			return
+		}
+		log.Error().Err(err).Str("path", relativePath).Msg("Unable to preview file")
+		logAndRespond(w, http.StatusUnprocessableEntity, ErrCodePreviewFailed, fmt.Sprintf("Unable to preview file: %v", err))
+		return
+	}
+
+	preview.FileMetadata = preview.FileMetadata.ForAPIVersion(version)
+	response, err := json.Marshal(preview)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to marshal response")
+		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
+		return
+	}
+	util.SendHTTPResponse(w, http.StatusOK, string(response), false)
+}
+
+// PreviewFile previews the file at path, its format is picked from the MIME type of the metadata and the first bytes of the file
+func PreviewFile(path string, metadata FileMetadata, options PreviewOptions) (*Preview, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, previewSniffBytes)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	preview := &Preview{FileMetadata: metadata}
+	preview.Kind, preview.Format = previewFormat(metadata, head)
+	switch preview.Kind {
+	case PreviewKindTable:
+		if preview.Format == "parquet" {
+			err = previewParquet(path, preview, options)
+		} else if preview.Format == "xlsx" {
+			err = previewXLSX(path, preview, options)
+		} else {
+			err = previewDelimited(file, preview, options)
+		}
+	case PreviewKindText:
+		err = previewText(file, preview, options)
+	case PreviewKindImage:
+		err = previewImage(file, preview, options)
+	default:
+		err = errPreviewUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// previewFormat returns the kind and format of a file, falling back to sniffing its content for unknown extensions
+func previewFormat(metadata FileMetadata, head []byte) (string, string) {
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType = metadata.MIMEType
+	}
+	mimeType, _, _ := mime.ParseMediaType(contentType)
+	extension := strings.ToLower(filepath.Ext(metadata.Name))
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+
+	switch {
+	case extension == ".parquet" || bytes.HasPrefix(head, []byte(parquetMagic)):
+		return PreviewKindTable, "parquet"
+	case extension == ".xlsx" || mimeType == xlsxMIMEType:
+		return PreviewKindTable, "xlsx"
+	case extension == ".csv" || mimeType == "text/csv":
+		return PreviewKindTable, "csv"
+	case extension == ".tsv" || extension == ".tab" || mimeType == "text/tab-separated-values":
+		return PreviewKindTable, "tsv"
+	case mimeType == "image/png" || mimeType == "image/jpeg" || mimeType == "image/gif":
+		return PreviewKindImage, strings.TrimPrefix(mimeType, "image/")
+	case strings.HasPrefix(mimeType, "text/") || mimeType == "application/json" || mimeType == "application/xml" ||
+		mimeType == "application/javascript" || mimeType == "application/x-yaml" || mimeType == "application/x-sh":
+		return PreviewKindText, "text"
+	case mimeType == "application/octet-stream" && isUTF16(head):
+		return PreviewKindText, "text"
+	}
+	return "", ""
+}
+
+// UTF-16 text without byte order mark is sniffed as binary
+func isUTF16(head []byte) bool {
+	encoding, _ := detectEncoding(head)
+	return strings.HasPrefix(encoding, "utf-16")
+}
+
+func previewParquet(path string, preview *Preview, options PreviewOptions) error {
+	parquet, err := ReadParquetPreview(path, options.Limit)
+	if err != nil {
+		return err
+	}
+	preview.Columns = parquet.Columns
+	preview.Rows = parquet.Rows
+	preview.TotalRows = &parquet.TotalRows
+	preview.Truncated = parquet.Rows == nil || int64(len(parquet.Rows)) < parquet.TotalRows
+	return nil
+}
+
+func previewDelimited(file io.Reader, preview *Preview, options PreviewOptions) error {
+	text, cut, err := readPreviewText(file, preview)
+	if err != nil {
+		return err
+	}
+	if cut {
+		// the last record may be incomplete
+		if index := strings.LastIndexByte(text, '\n'); index >= 0 {
+			text = text[:index+1]
+		}
+	}
+
+	reader := csv.NewReader(strings.NewReader(text))
+	if preview.Format == "tsv" {
+		reader.Comma = '\t'
+	}
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		preview.Columns, preview.Rows = []PreviewColumn{}, [][]interface{}{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records [][]string
+	for len(records) < options.Limit {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+	if len(records) == options.Limit {
+		if _, err := reader.Read(); err != io.EOF {
+			preview.Truncated = true
+		}
+	}
+	preview.Truncated = preview.Truncated || cut
+	setPreviewTable(preview, header, records)
+	return nil
+}
+
+// setPreviewTable sets the columns, named by header, and the rows of a table preview from its cell values
+func setPreviewTable(preview *Preview, header []string, records [][]string) {
+	width := len(header)
+	for _, record := range records {
+		width = max(width, len(record))
+	}
+	preview.Columns = make([]PreviewColumn, width)
+	for i := range preview.Columns {
+		name := fmt.Sprintf("column_%d", i+1)
+		if i < len(header) && header[i] != "" {
+			name = header[i]
+		}
+		values := make([]string, 0, len(records))
+		for _, record := range records {
+			if i < len(record) {
+				values = append(values, record[i])
+			}
+		}
+		preview.Columns[i] = PreviewColumn{Name: name, Type: inferColumnType(values)}
+	}
+
+	preview.Rows = make([][]interface{}, len(records))
+	for i, record := range records {
+		row := make([]interface{}, width)
+		for j, value := range record {
+			row[j] = value
+		}
+		preview.Rows[i] = row
+	}
+}
+
+var (
+	previewDateLayout      = "2006-01-02"
+	previewDatetimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05"}
+	// inferred types from the narrowest to the widest, a column gets the first type all its values match
+	previewColumnTypes = []struct {
+		name    string
+		matches func(string) bool
+	}{
+		{"boolean", func(value string) bool {
+			_, err := strconv.ParseBool(strings.ToLower(value))
+			return err == nil && !isNumeric(value)
+		}},
+		{"integer", func(value string) bool { _, err := strconv.ParseInt(value, 10, 64); return err == nil }},
+		{"number", isNumeric},
+		{"date", func(value string) bool { _, err := time.Parse(previewDateLayout, value); return err == nil }},
+		{"datetime", func(value string) bool {
+			for _, layout := range previewDatetimeLayouts {
+				if _, err := time.Parse(layout, value); err == nil {
+					return true
+				}
+			}
+			return false
+		}},
+	}
+)
+
+func isNumeric(value string) bool {
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil
+}
+
+// inferColumnType ignores empty values, a column without values is a string column
+func inferColumnType(values []string) string {
+	for _, columnType := range previewColumnTypes {
+		matched := 0
+		for _, value := range values {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			if !columnType.matches(value) {
+				matched = -1
+				break
+			}
+			matched++
+		}
+		if matched > 0 {
+			return columnType.name
+		}
+	}
+	return "string"
+}
+
+func previewText(file io.Reader, preview *Preview, options PreviewOptions) error {
+	text, cut, err := readPreviewText(file, preview)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	preview.Truncated = cut || len(lines) > options.Limit
+	preview.Lines = make([]string, 0, min(len(lines), options.Limit))
+	for _, line := range lines[:min(len(lines), options.Limit)] {
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) > previewMaxLineLength {
+			line = strings.ToValidUTF8(line[:previewMaxLineLength], "")
+			preview.Truncated = true
+		}
+		preview.Lines = append(preview.Lines, line)
+	}
+	return nil
+}
+
+// readPreviewText reads the start of a text file as UTF-8 and records its encoding, cut is set if the file is longer
+func readPreviewText(file io.Reader, preview *Preview) (string, bool, error) {
+	data, err := io.ReadAll(io.LimitReader(file, previewMaxReadBytes+1))
+	if err != nil {
+		return "", false, err
+	}
+	cut := len(data) > previewMaxReadBytes
+	if cut {
+		data = data[:previewMaxReadBytes]
+	}
+
+	encoding, bomLength := detectEncoding(data)
+	preview.Encoding = encoding
+	return decodeText(data[bomLength:], encoding, cut), cut, nil
+}
+
+// detectEncoding detects UTF-8 and UTF-16 from their byte order mark or, without one, from the byte pattern.
+// Anything that is not valid UTF-8 is treated as ISO-8859-1, which maps every byte to a character.
+func detectEncoding(data []byte) (string, int) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8", 3
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return "utf-16le", 2
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return "utf-16be", 2
+	}
+
+	// ASCII text in UTF-16 has a zero in every other byte
+	sample := data[:min(len(data), previewSniffBytes)]
+	if len(sample) >= 4 {
+		var evenZeros, oddZeros int
+		for i, b := range sample {
+			if b == 0 && i%2 == 0 {
+				evenZeros++
+			} else if b == 0 {
+				oddZeros++
+			}
+		}
+		pairs := len(sample) / 2
+		if oddZeros > pairs*2/5 && evenZeros < pairs/10 {
+			return "utf-16le", 0
+		}
+		if evenZeros > pairs*2/5 && oddZeros < pairs/10 {
+			return "utf-16be", 0
+		}
+	}
+
+	// a multi-byte character may be split at the end of a sample
+	valid := data
+	for i := 0; i < utf8.UTFMax-1 && len(valid) > 0 && !utf8.Valid(valid); i++ {
+		valid = valid[:len(valid)-1]
+	}
+	if utf8.Valid(valid) {
+		return "utf-8", 0
+	}
+	return "iso-8859-1", 0
+}
+
+func decodeText(data []byte, encoding string, cut bool) string {
+	switch encoding {
+	case "utf-16le", "utf-16be":
+		var order binary.ByteOrder = binary.LittleEndian
+		if encoding == "utf-16be" {
+			order = binary.BigEndian
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		return string(utf16.Decode(units))
+	case "iso-8859-1":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	if cut {
+		for i := 0; i < utf8.UTFMax-1 && len(data) > 0 && !utf8.Valid(data); i++ {
+			data = data[:len(data)-1]
+		}
+	}
+	return strings.ToValidUTF8(string(data), "�")
+}
+
+func previewImage(file io.ReadSeeker, preview *Preview, options PreviewOptions) error {
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > previewMaxImagePixels {
+		return fmt.Errorf("image of %dx%d pixels is too large to preview", config.Width, config.Height)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// animated GIFs are previewed with their first frame
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, thumbnail(img, options.ThumbnailSize)); err != nil {
+		return err
+	}
+	preview.Width, preview.Height = config.Width, config.Height
+	preview.Thumbnail = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buffer.Bytes())
+	return nil
+}
+
+// thumbnail scales img down to fit in size by size pixels, keeping its aspect ratio.
+// Every thumbnail pixel is the average of the source pixels it covers, images are never scaled up.
+func thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+	if width >= height {
+		width, height = size, max(height*size/width, 1)
+	} else {
+		width, height = max(width*size/height, 1), size
+	}
+
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		top := bounds.Min.Y + y*bounds.Dy()/height
+		bottom := max(bounds.Min.Y+(y+1)*bounds.Dy()/height, top+1)
+		for x := 0; x < width; x++ {
+			left := bounds.Min.X + x*bounds.Dx()/width
+			right := max(bounds.Min.X+(x+1)*bounds.Dx()/width, left+1)
+
+			var r, g, b, a, count uint64
+			for sy := top; sy < bottom; sy++ {
+				for sx := left; sx < right; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					count++
+				}
+			}
+			result.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / count >> 8),
+				G: uint8(g / count >> 8),
+				B: uint8(b / count >> 8),
+				A: uint8(a / count >> 8),
+			})
+		}
+	}
+	return result
+}
@@ -0,0 +1,346 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+// Usage is the disk usage of a root, files count regular files only
+type Usage struct {
+	Bytes     int64     `json:"bytes"`
+	Files     int64     `json:"files"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// DiskSpace is the size and free space of the file system holding Path
+type DiskSpace struct {
+	Path           string `json:"path"`
+	TotalBytes     uint64 `json:"total_bytes"`
+	FreeBytes      uint64 `json:"free_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+}
+
+// DataRootDiskSpace returns the disk space of the file system holding the data root
+func DataRootDiskSpace() (DiskSpace, error) {
+	return diskSpace(dirPath)
+}
+
+// Quota limits the usage of a root, 0 means unlimited
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxFiles int64 `json:"max_files"`
+}
+
+// QuotaStatus is the response of GET /usage
+type QuotaStatus struct {
+	Usage
+	Quota
+	Exceeded bool `json:"exceeded"`
+}
+
+// QuotaExceededError is returned when a write would exceed the quota of its root
+type QuotaExceededError struct {
+	Message string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return e.Message
+}
+
+func respondQuotaExceeded(w http.ResponseWriter, err error) {
+	if _, ok := err.(*QuotaExceededError); ok {
+		logAndRespond(w, http.StatusInsufficientStorage, ErrCodeQuotaExceeded, err.Error())
+		return
+	}
+	log.Error().Err(err).Msg("Unable to check quota")
+	logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error reading disk usage")
+}
+
+var (
+	// GlobalQuota applies to the whole data directory, TenantQuota to every tenant root
+	GlobalQuota = Quota{MaxBytes: util.GetConfig().QuotaMaxBytes, MaxFiles: util.GetConfig().QuotaMaxFiles}
+	TenantQuota = Quota{MaxBytes: util.GetConfig().TenantQuotaMaxBytes, MaxFiles: util.GetConfig().TenantQuotaMaxFiles}
+
+	usageLock  sync.Mutex
+	usageCache = map[string]Usage{}
+)
+
+// QuotaEnabled reports whether any quota is configured
+func QuotaEnabled() bool {
+	return GlobalQuota != Quota{} || TenantQuota != Quota{}
+}
+
+// ScanUsage walks rootPath without following symlinks and caches the result
+func ScanUsage(rootPath string) (Usage, error) {
+	usage, err := treeUsage(rootPath)
+	if err != nil {
+		return usage, err
+	}
+
+	RecordUsage(rootPath, usage)
+	return usage, nil
+}
+
+func treeUsage(rootPath string) (Usage, error) {
+	usage := Usage{ScannedAt: time.Now().UTC()}
+	err := filepath.WalkDir(rootPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == rootPath {
+				return err
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if fileInfo, err := entry.Info(); err == nil {
+			usage.Bytes += fileInfo.Size()
+			usage.Files++
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// RecordUsage replaces the cached usage of rootPath, e.g. with the usage of a fresh snapshot
+func RecordUsage(rootPath string, usage Usage) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	usageCache[filepath.Clean(rootPath)] = usage
+}
+
+// GetUsage returns the cached usage of rootPath and scans it if it was never scanned
+func GetUsage(rootPath string) (Usage, error) {
+	usageLock.Lock()
+	usage, ok := usageCache[filepath.Clean(rootPath)]
+	usageLock.Unlock()
+	if ok {
+		return usage, nil
+	}
+	return ScanUsage(rootPath)
+}
+
+// AddUsage accounts for files written since the last scan, to rootPath and to the data directory containing it
+func AddUsage(rootPath string, bytes int64, files int64) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	addUsageLocked(quotasFor(rootPath), bytes, files)
+}
+
+func addUsageLocked(limitedRoots []limitedRoot, bytes int64, files int64) {
+	for _, limited := range limitedRoots {
+		if usage, ok := usageCache[limited.rootPath]; ok {
+			usage.Bytes += bytes
+			usage.Files += files
+			usageCache[limited.rootPath] = usage
+		}
+	}
+}
+
+type limitedRoot struct {
+	rootPath string
+	quota    Quota
+}
+
+// quotasFor returns the quotas applying to a write below rootPath, a tenant root is also part of the data directory
+func quotasFor(rootPath string) []limitedRoot {
+	rootPath = filepath.Clean(rootPath)
+	global := limitedRoot{rootPath: filepath.Clean(dirPath), quota: GlobalQuota}
+	if rootPath == global.rootPath {
+		return []limitedRoot{global}
+	}
+	if filepath.Dir(rootPath) == global.rootPath {
+		return []limitedRoot{{rootPath: rootPath, quota: TenantQuota}, global}
+	}
+	return []limitedRoot{{rootPath: rootPath, quota: TenantQuota}}
+}
+
+// RemainingQuota returns how many bytes and files can still be written below rootPath, math.MaxInt64 if unlimited
+func RemainingQuota(rootPath string) (int64, int64, error) {
+	limitedRoots := quotasFor(rootPath)
+	if err := cacheUsage(limitedRoots); err != nil {
+		return 0, 0, err
+	}
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	bytes, files := remainingLocked(limitedRoots)
+	return max(bytes, 0), max(files, 0), nil
+}
+
+// CheckQuota fails if writing bytes in files new files below rootPath would exceed a quota
+func CheckQuota(rootPath string, bytes int64, files int64) error {
+	remainingBytes, remainingFiles, err := RemainingQuota(rootPath)
+	if err != nil {
+		return err
+	}
+	return quotaError(bytes, files, remainingBytes, remainingFiles)
+}
+
+// ReserveQuota adds bytes in files new files to the usage of rootPath if they fit in its quotas. The check and the
+// addition are atomic, so concurrent writes can not both take the rest of a quota. A failed write gives the
+// reservation back with AddUsage.
+func ReserveQuota(rootPath string, bytes int64, files int64) error {
+	limitedRoots := quotasFor(rootPath)
+	if err := cacheUsage(limitedRoots); err != nil {
+		return err
+	}
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	remainingBytes, remainingFiles := remainingLocked(limitedRoots)
+	if err := quotaError(bytes, files, max(remainingBytes, 0), max(remainingFiles, 0)); err != nil {
+		return err
+	}
+	addUsageLocked(limitedRoots, bytes, files)
+	return nil
+}
+
+func quotaError(bytes int64, files int64, remainingBytes int64, remainingFiles int64) error {
+	if bytes > remainingBytes {
+		return &QuotaExceededError{Message: fmt.Sprintf("Storage quota exceeded, %d bytes remaining", remainingBytes)}
+	}
+	if files > remainingFiles {
+		return &QuotaExceededError{Message: fmt.Sprintf("File count quota exceeded, %d files remaining", remainingFiles)}
+	}
+	return nil
+}
+
+// cacheUsage scans the limited roots which were never scanned, so their usage can be read with usageLock held
+func cacheUsage(limitedRoots []limitedRoot) error {
+	for _, limited := range limitedRoots {
+		if limited.quota.MaxBytes <= 0 && limited.quota.MaxFiles <= 0 {
+			continue
+		}
+		if _, err := GetUsage(limited.rootPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remainingLocked returns the bytes and files left in the quotas of limitedRoots, negative once a quota is exceeded.
+// It is called with usageLock held.
+func remainingLocked(limitedRoots []limitedRoot) (int64, int64) {
+	bytes, files := int64(math.MaxInt64), int64(math.MaxInt64)
+	for _, limited := range limitedRoots {
+		usage := usageCache[limited.rootPath]
+		if limited.quota.MaxBytes > 0 {
+			bytes = min(bytes, limited.quota.MaxBytes-usage.Bytes)
+		}
+		if limited.quota.MaxFiles > 0 {
+			files = min(files, limited.quota.MaxFiles-usage.Files)
+		}
+	}
+	return bytes, files
+}
+
+// PeriodicUsageScan rescans the data directory and every tenant root, so files written by executed code are counted
+func PeriodicUsageScan() {
+	interval := util.GetConfig().UsageScanInterval
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		scanAllUsage()
+		time.Sleep(interval)
+	}
+}
+
+func scanAllUsage() {
+	global, err := ScanUsage(dirPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to scan disk usage")
+		return
+	}
+	if GlobalQuota.MaxBytes > 0 && global.Bytes > GlobalQuota.MaxBytes || GlobalQuota.MaxFiles > 0 && global.Files > GlobalQuota.MaxFiles {
+		log.Warn().Int64("bytes", global.Bytes).Int64("files", global.Files).Str("error_code", ErrCodeQuotaExceeded).Msg("Data directory exceeds its quota")
+	}
+
+	if !util.GetConfig().MultiTenant {
+		return
+	}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		tenantRoot := filepath.Join(dirPath, entry.Name())
+		usage, err := ScanUsage(tenantRoot)
+		if err != nil {
+			continue
+		}
+		if TenantQuota.MaxBytes > 0 && usage.Bytes > TenantQuota.MaxBytes || TenantQuota.MaxFiles > 0 && usage.Files > TenantQuota.MaxFiles {
+			log.Warn().Str("tenant", entry.Name()).Int64("bytes", usage.Bytes).Int64("files", usage.Files).Str("error_code", ErrCodeQuotaExceeded).Msg("Tenant exceeds its quota")
+		}
+	}
+}
+
+// GetQuotaStatus returns the usage of rootPath against its own quota. Exceeded is set once the usage of rootPath
+// or of the data directory is above its quota, a root using exactly its quota is full but not exceeded.
+func GetQuotaStatus(rootPath string) (QuotaStatus, error) {
+	usage, err := GetUsage(rootPath)
+	if err != nil {
+		return QuotaStatus{}, err
+	}
+	limitedRoots := quotasFor(rootPath)
+	status := QuotaStatus{Usage: usage, Quota: limitedRoots[0].quota}
+
+	if err := cacheUsage(limitedRoots); err != nil {
+		return QuotaStatus{}, err
+	}
+	usageLock.Lock()
+	remainingBytes, remainingFiles := remainingLocked(limitedRoots)
+	usageLock.Unlock()
+	status.Exceeded = remainingBytes < 0 || remainingFiles < 0
+	return status, nil
+}
+
+// UsageHandler returns the usage and quota of the caller's root
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+
+	status, err := GetQuotaStatus(rootPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to get disk usage")
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error reading disk usage")
+		return
+	}
+
+	response, err := json.Marshal(status)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to marshal response")
+		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
+		return
+	}
+	util.SendHTTPResponse(w, http.StatusOK, string(response), false)
+}
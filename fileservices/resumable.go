@@ -0,0 +1,627 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrCodeUploadNotFound   = "ERR_UPLOAD_NOT_FOUND"
+	ErrCodeUploadLocked     = "ERR_UPLOAD_LOCKED"
+	ErrCodeOffsetMismatch   = "ERR_OFFSET_MISMATCH"
+	ErrCodeChecksumMismatch = "ERR_CHECKSUM_MISMATCH"
+
+	// headers of the offset based protocol, named like their tus counterparts
+	UploadOffsetHeader   = "Upload-Offset"
+	UploadLengthHeader   = "Upload-Length"
+	UploadChecksumHeader = "Upload-Checksum"
+
+	uploadStateSuffix = ".json"
+	uploadDataSuffix  = ".part"
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// UploadSessionRequest is the body of POST /uploads.
+// Path is the directory below the data root, SHA256 the optional hex digest of the whole file checked on completion.
+type UploadSessionRequest struct {
+	Path      string `json:"path"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256,omitempty"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// UploadSession is a resumable upload. Data is appended with PATCH at the current offset
+// and the file is moved into place once offset reaches size.
+type UploadSession struct {
+	ID        string        `json:"id"`
+	Path      string        `json:"path"`
+	Filename  string        `json:"filename"`
+	Size      int64         `json:"size"`
+	Offset    int64         `json:"offset"`
+	SHA256    string        `json:"sha256,omitempty"`
+	Overwrite bool          `json:"overwrite"`
+	CreatedAt time.Time     `json:"created_at"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	Completed bool          `json:"completed"`
+	File      *FileMetadata `json:"file,omitempty"`
+
+	rootPath  string
+	hashState []byte
+	store     *UploadStore
+}
+
+// uploadSessionState is what is persisted next to the data of a session
+type uploadSessionState struct {
+	UploadSession
+	RootPath  string `json:"root_path"`
+	HashState []byte `json:"hash_state"`
+}
+
+// UploadSessionError carries the HTTP status and error code a failed upload operation responds with
+type UploadSessionError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *UploadSessionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func newUploadSessionError(statusCode int, code string, format string, args ...interface{}) *UploadSessionError {
+	return &UploadSessionError{StatusCode: statusCode, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// UploadStore keeps upload sessions in a directory, so they survive a server restart.
+// The directory should be on the same filesystem as the data root for the final rename to be cheap.
+type UploadStore struct {
+	Dir    string
+	TTL    time.Duration
+	Limits UploadLimits
+
+	locksLock sync.Mutex
+	locks     map[string]bool
+}
+
+var defaultUploadStore = &UploadStore{
+	Dir:    util.GetConfig().UploadSessionDir,
+	TTL:    util.GetConfig().UploadSessionTTL,
+	Limits: GetUploadLimits(),
+}
+
+// Create validates the request against rootPath and persists a new empty session
+func (s *UploadStore) Create(rootPath string, request UploadSessionRequest) (*UploadSession, error) {
+	s.removeExpired()
+
+	if request.Size < 0 {
+		return nil, newUploadSessionError(http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid size %d", request.Size)
+	}
+	if s.Limits.MaxFileBytes > 0 && request.Size > s.Limits.MaxFileBytes {
+		return nil, newUploadSessionError(http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge, "File exceeds the maximum size of %d bytes", s.Limits.MaxFileBytes)
+	}
+	if request.SHA256 != "" {
+		if digest, err := hex.DecodeString(request.SHA256); err != nil || len(digest) != sha256.Size {
+			return nil, newUploadSessionError(http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid sha256")
+		}
+	}
+
+	filename := filepath.Base(request.Filename)
+	if request.Filename == "" || filename != request.Filename || filename == "." || filename == ".." {
+		return nil, newUploadSessionError(http.StatusBadRequest, ErrCodeInvalidFilename, "Invalid file name")
+	}
+	targetPath, err := ResolveTargetPath(rootPath, request.Path)
+	if err != nil {
+		return nil, newUploadSessionError(http.StatusBadRequest, ErrCodeInvalidParameter, "Unable to clean and verify target path")
+	}
+	if err := verifyUploadTarget(filepath.Join(targetPath, filename), request.Overwrite); err != nil {
+		return nil, err
+	}
+	if err := CheckQuota(rootPath, request.Size, 1); err != nil {
+		if _, ok := err.(*QuotaExceededError); ok {
+			return nil, newUploadSessionError(http.StatusInsufficientStorage, ErrCodeQuotaExceeded, err.Error())
+		}
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	relativePath, _ := filepath.Rel(rootPath, targetPath)
+
+	now := time.Now().UTC()
+	session := &UploadSession{
+		ID:        hex.EncodeToString(id),
+		Path:      filepath.ToSlash(relativePath),
+		Filename:  filename,
+		Size:      request.Size,
+		SHA256:    strings.ToLower(request.SHA256),
+		Overwrite: request.Overwrite,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.TTL),
+		rootPath:  rootPath,
+		store:     s,
+	}
+	if session.hashState, err = sha256.New().(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return nil, err
+	}
+	data, err := os.OpenFile(s.dataPath(session.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	data.Close()
+	if err := session.save(); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Load reads a session, it is only visible to requests resolving to the same root path
+func (s *UploadStore) Load(rootPath string, id string) (*UploadSession, error) {
+	notFound := newUploadSessionError(http.StatusNotFound, ErrCodeUploadNotFound, "Upload not found")
+	if !uploadIDPattern.MatchString(id) {
+		return nil, notFound
+	}
+
+	content, err := os.ReadFile(s.statePath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, notFound
+		}
+		return nil, err
+	}
+	var state uploadSessionState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, err
+	}
+	if state.RootPath != rootPath || time.Now().After(state.ExpiresAt) {
+		return nil, notFound
+	}
+
+	session := state.UploadSession
+	session.rootPath = state.RootPath
+	session.hashState = state.HashState
+	session.store = s
+	return &session, nil
+}
+
+// Lock serializes writes to one session, a concurrent request fails instead of waiting
+func (s *UploadStore) Lock(id string) (func(), bool) {
+	s.locksLock.Lock()
+	defer s.locksLock.Unlock()
+	if s.locks[id] {
+		return nil, false
+	}
+	if s.locks == nil {
+		s.locks = map[string]bool{}
+	}
+	s.locks[id] = true
+
+	return func() {
+		s.locksLock.Lock()
+		defer s.locksLock.Unlock()
+		delete(s.locks, id)
+	}, true
+}
+
+// Append writes body at offset, which must be the current offset of the session.
+// checksum is an optional "sha256 <base64 digest>" of the chunk; on mismatch the chunk is discarded.
+// Without a checksum the bytes received before a broken connection are kept, so the client can resume after them.
+func (session *UploadSession) Append(offset int64, body io.Reader, checksum string) error {
+	if offset != session.Offset {
+		return newUploadSessionError(http.StatusConflict, ErrCodeOffsetMismatch, "Upload offset is %d, not %d", session.Offset, offset)
+	}
+
+	var expectedChunkDigest []byte
+	if checksum != "" {
+		algorithm, digest, _ := strings.Cut(checksum, " ")
+		decoded, err := base64.StdEncoding.DecodeString(digest)
+		if algorithm != "sha256" || err != nil || len(decoded) != sha256.Size {
+			return newUploadSessionError(http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid %s header, expected 'sha256 <base64 digest>'", UploadChecksumHeader)
+		}
+		expectedChunkDigest = decoded
+	}
+
+	fileHash := sha256.New()
+	if err := fileHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(session.hashState); err != nil {
+		return err
+	}
+
+	data, err := os.OpenFile(session.store.dataPath(session.ID), os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	// drop bytes written after the last persisted offset, e.g. before a crash
+	if err := data.Truncate(session.Offset); err != nil {
+		return err
+	}
+	if _, err := data.Seek(session.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	chunkHash := sha256.New()
+	remaining := session.Size - session.Offset
+	written, copyErr := io.Copy(io.MultiWriter(data, fileHash, chunkHash), io.LimitReader(body, remaining+1))
+	uploadBytes.Add(float64(written))
+	if copyErr == nil && written > remaining {
+		data.Truncate(session.Offset)
+		return newUploadSessionError(http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge, "Chunk exceeds the declared size of %d bytes", session.Size)
+	}
+	if expectedChunkDigest != nil && (copyErr != nil || !strings.EqualFold(hex.EncodeToString(chunkHash.Sum(nil)), hex.EncodeToString(expectedChunkDigest))) {
+		data.Truncate(session.Offset)
+		if copyErr != nil {
+			return copyErr
+		}
+		return newUploadSessionError(http.StatusBadRequest, ErrCodeChecksumMismatch, "Chunk does not match %s", UploadChecksumHeader)
+	}
+	if err := data.Sync(); err != nil {
+		return err
+	}
+
+	if session.hashState, err = fileHash.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return err
+	}
+	session.Offset += written
+	if err := session.save(); err != nil {
+		return err
+	}
+	return copyErr
+}
+
+// Complete verifies the checksum of the finished file and moves it into the target path atomically
+func (session *UploadSession) Complete() error {
+	if session.Offset != session.Size {
+		return newUploadSessionError(http.StatusConflict, ErrCodeOffsetMismatch, "Upload is incomplete at offset %d of %d", session.Offset, session.Size)
+	}
+
+	if session.SHA256 != "" {
+		fileHash := sha256.New()
+		if err := fileHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(session.hashState); err != nil {
+			return err
+		}
+		if hex.EncodeToString(fileHash.Sum(nil)) != session.SHA256 {
+			session.Remove()
+			return newUploadSessionError(http.StatusBadRequest, ErrCodeChecksumMismatch, "File does not match sha256 %s, the upload was discarded", session.SHA256)
+		}
+	}
+
+	// the target is verified again, it may have changed since the session was created
+	targetPath, err := ResolveTargetPath(session.rootPath, session.Path)
+	if err != nil {
+		return newUploadSessionError(http.StatusBadRequest, ErrCodeInvalidParameter, "Unable to clean and verify target path")
+	}
+	dstPath := filepath.Join(targetPath, session.Filename)
+	if err := verifyUploadTarget(dstPath, session.Overwrite); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(targetPath, os.ModePerm); err != nil {
+		return err
+	}
+	if err := ownPath(session.rootPath, targetPath); err != nil {
+		return err
+	}
+
+	// the quota is checked again, other writes may have taken it since the session was created. A replaced file
+	// frees its space, unless it is kept as a version.
+	var freed, replaced Usage
+	if fileInfo, err := os.Lstat(dstPath); err == nil && fileInfo.Mode().IsRegular() && MaxFileVersions <= 0 {
+		freed = Usage{Bytes: fileInfo.Size(), Files: 1}
+	}
+	if err := ReserveQuota(session.rootPath, session.Size-freed.Bytes, 1-freed.Files); err != nil {
+		if _, ok := err.(*QuotaExceededError); ok {
+			return newUploadSessionError(http.StatusInsufficientStorage, ErrCodeQuotaExceeded, err.Error())
+		}
+		return err
+	}
+
+	if err := SaveVersion(session.rootPath, dstPath); err != nil {
+		log.Error().Err(err).Str("path", dstPath).Msg("Unable to save file version")
+	}
+	// the saved version is accounted by SaveVersion, the file it was taken from is replaced now
+	if fileInfo, err := os.Lstat(dstPath); err == nil && fileInfo.Mode().IsRegular() {
+		replaced = Usage{Bytes: fileInfo.Size(), Files: 1}
+	}
+	if err := moveIntoPlace(session.store.dataPath(session.ID), dstPath); err != nil {
+		AddUsage(session.rootPath, freed.Bytes-session.Size, freed.Files-1)
+		return err
+	}
+	AddUsage(session.rootPath, freed.Bytes-replaced.Bytes, freed.Files-replaced.Files)
+	if err := ownPath(session.rootPath, dstPath); err != nil {
+		return err
+	}
+	fileInfo, err := os.Stat(dstPath)
+	if err != nil {
+		return err
+	}
+
+	metadata := describeFile(session.rootPath, dstPath, newFileMetadata(session.Filename, fileInfo), MetadataOptions{})
+	session.File = &metadata
+	session.Completed = true
+	os.Remove(session.store.statePath(session.ID))
+	return nil
+}
+
+// Remove discards the session and its data
+func (session *UploadSession) Remove() error {
+	os.Remove(session.store.dataPath(session.ID))
+	return os.Remove(session.store.statePath(session.ID))
+}
+
+func (session *UploadSession) save() error {
+	content, err := json.Marshal(uploadSessionState{UploadSession: *session, RootPath: session.rootPath, HashState: session.hashState})
+	if err != nil {
+		return err
+	}
+
+	// replace the state atomically so a crash never leaves a half written file
+	tmp := session.store.statePath(session.ID) + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, session.store.statePath(session.ID))
+}
+
+func (s *UploadStore) statePath(id string) string {
+	return filepath.Join(s.Dir, id+uploadStateSuffix)
+}
+
+func (s *UploadStore) dataPath(id string) string {
+	return filepath.Join(s.Dir, id+uploadDataSuffix)
+}
+
+func (s *UploadStore) removeExpired() {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), uploadStateSuffix)
+		if !ok {
+			continue
+		}
+		content, err := os.ReadFile(s.statePath(id))
+		if err != nil {
+			continue
+		}
+		var state uploadSessionState
+		if json.Unmarshal(content, &state) == nil && time.Now().After(state.ExpiresAt) {
+			log.Info().Str("upload", id).Msg("Removing expired upload session")
+			os.Remove(s.dataPath(id))
+			os.Remove(s.statePath(id))
+		}
+	}
+}
+
+func verifyUploadTarget(dstPath string, overwrite bool) error {
+	fileInfo, err := os.Lstat(dstPath)
+	if err != nil {
+		return nil
+	}
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		return newUploadSessionError(http.StatusBadRequest, ErrCodeSymlinkNotAllowed, "Symlinks not allowed")
+	}
+	if fileInfo.IsDir() || !overwrite {
+		return newUploadSessionError(http.StatusConflict, ErrCodeFileExists, "Destination already exists")
+	}
+	return nil
+}
+
+// moveIntoPlace renames src to dst. Across filesystems the data is copied next to dst first,
+// so dst is still replaced in a single rename.
+func moveIntoPlace(src string, dst string) error {
+	if err := os.Chmod(src, 0777); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := copyFile(src, tmp.Name()); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// CreateUploadHandler starts a resumable upload and returns the session, its URL is in the Location header
+func CreateUploadHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+
+	var request UploadSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid request body")
+		return
+	}
+
+	session, err := defaultUploadStore.Create(rootPath, request)
+	if err != nil {
+		respondUploadError(w, err)
+		return
+	}
+
+	log.Info().Str("upload", session.ID).Msg(fmt.Sprintf("Created upload of %s with %d bytes.\n", session.Filename, session.Size))
+	w.Header().Set("Location", "/uploads/"+session.ID)
+	respondWithUploadSession(w, http.StatusCreated, session)
+}
+
+// GetUploadHandler returns the session, HEAD requests only get the offset and length headers
+func GetUploadHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+
+	session, err := defaultUploadStore.Load(rootPath, mux.Vars(r)["id"])
+	if err != nil {
+		respondUploadError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		setUploadHeaders(w, session)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	respondWithUploadSession(w, http.StatusOK, session)
+}
+
+// PatchUploadHandler appends the body at the Upload-Offset header and completes the upload once all bytes arrived
+func PatchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+	version, ok := resolveAPIVersion(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	unlock, ok := defaultUploadStore.Lock(id)
+	if !ok {
+		logAndRespond(w, http.StatusLocked, ErrCodeUploadLocked, "Another request is writing to this upload")
+		return
+	}
+	defer unlock()
+
+	session, err := defaultUploadStore.Load(rootPath, id)
+	if err != nil {
+		respondUploadError(w, err)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Missing or invalid "+UploadOffsetHeader+" header")
+		return
+	}
+
+	if err := session.Append(offset, r.Body, r.Header.Get(UploadChecksumHeader)); err != nil {
+		setUploadHeaders(w, session)
+		respondUploadError(w, err)
+		return
+	}
+
+	if session.Offset == session.Size {
+		if err := session.Complete(); err != nil {
+			respondUploadError(w, err)
+			return
+		}
+		*session.File = session.File.ForAPIVersion(version)
+		log.Info().Str("upload", session.ID).Msg(fmt.Sprintf("Upload of %s completed.\n", session.Filename))
+	}
+
+	setUploadHeaders(w, session)
+	respondWithUploadSession(w, http.StatusOK, session)
+}
+
+// DeleteUploadHandler aborts an upload and discards the received data
+func DeleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	unlock, ok := defaultUploadStore.Lock(id)
+	if !ok {
+		logAndRespond(w, http.StatusLocked, ErrCodeUploadLocked, "Another request is writing to this upload")
+		return
+	}
+	defer unlock()
+
+	session, err := defaultUploadStore.Load(rootPath, id)
+	if err != nil {
+		respondUploadError(w, err)
+		return
+	}
+	if err := session.Remove(); err != nil {
+		respondUploadError(w, err)
+		return
+	}
+	util.SendHTTPResponse(w, http.StatusOK, "upload deleted successfully", true)
+}
+
+func setUploadHeaders(w http.ResponseWriter, session *UploadSession) {
+	w.Header().Set(UploadOffsetHeader, strconv.FormatInt(session.Offset, 10))
+	w.Header().Set(UploadLengthHeader, strconv.FormatInt(session.Size, 10))
+}
+
+func respondWithUploadSession(w http.ResponseWriter, statusCode int, session *UploadSession) {
+	response, err := json.Marshal(session)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to marshal response")
+		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
+		return
+	}
+	util.SendHTTPResponse(w, statusCode, string(response), false)
+}
+
+func respondUploadError(w http.ResponseWriter, err error) {
+	var sessionError *UploadSessionError
+	if errors.As(err, &sessionError) {
+		logAndRespond(w, sessionError.StatusCode, sessionError.Code, sessionError.Message)
+		return
+	}
+	if isMaxBytesError(err) {
+		logAndRespond(w, http.StatusRequestEntityTooLarge, ErrCodeRequestTooLarge, "Request body is too large")
+		return
+	}
+	log.Error().Err(err).Msg("Upload failed")
+	logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error writing upload")
+}
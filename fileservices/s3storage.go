@@ -0,0 +1,545 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3DateLayout    = "20060102T150405Z"
+	s3RequestTime   = 5 * time.Minute
+	s3EmptyPayload  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3UnreservedSet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_.~"
+)
+
+// S3Options locate the bucket of an S3-compatible object store. Requests are anonymous without an access key.
+// PathStyle addresses the bucket as endpoint/bucket, as most self-hosted stores expect, instead of bucket.endpoint.
+type S3Options struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	PathStyle       bool
+	Client          *http.Client
+}
+
+// S3Storage keeps files as objects below the prefix of a bucket. Directories are key prefixes,
+// empty ones are kept as "dir/" marker objects. Renaming a directory copies every object below it.
+type S3Storage struct {
+	options  S3Options
+	endpoint *url.URL
+	prefix   string
+	client   *http.Client
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// storageFileInfo describes an object or key prefix
+type storageFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *storageFileInfo) Name() string       { return i.name }
+func (i *storageFileInfo) Size() int64        { return i.size }
+func (i *storageFileInfo) ModTime() time.Time { return i.modTime }
+func (i *storageFileInfo) IsDir() bool        { return i.dir }
+func (i *storageFileInfo) Sys() interface{}   { return nil }
+func (i *storageFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func NewS3Storage(options S3Options) (*S3Storage, error) {
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil || endpoint.Host == "" || endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint '%s'", options.Endpoint)
+	}
+	if options.Bucket == "" {
+		return nil, errors.New("S3 bucket is not set")
+	}
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+	prefix, err := cleanStorageName(options.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	client := options.Client
+	if client == nil {
+		client = &http.Client{Timeout: s3RequestTime}
+	}
+	return &S3Storage{options: options, endpoint: endpoint, prefix: prefix, client: client}, nil
+}
+
+// key returns the object key of a storage path, the root is the prefix itself
+func (s *S3Storage) key(name string) (string, error) {
+	cleaned, err := cleanStorageName(name)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case s.prefix == "":
+		return cleaned, nil
+	case cleaned == "":
+		return s.prefix, nil
+	}
+	return s.prefix + "/" + cleaned, nil
+}
+
+// dirKey is the prefix of the objects below a directory
+func (s *S3Storage) dirKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (s *S3Storage) List(dir string) ([]fs.FileInfo, error) {
+	key, err := s.key(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := s.dirKey(key)
+
+	fileInfos := []fs.FileInfo{}
+	found := key == s.prefix
+	err = s.listObjects(prefix, "/", func(result *s3ListResult) error {
+		for _, object := range result.Contents {
+			found = true
+			if object.Key == prefix {
+				continue
+			}
+			// HEAD responses only have seconds, listings are truncated to match them
+			fileInfos = append(fileInfos, &storageFileInfo{name: path.Base(object.Key), size: object.Size, modTime: object.LastModified.Truncate(time.Second)})
+		}
+		for _, common := range result.CommonPrefixes {
+			found = true
+			fileInfos = append(fileInfos, &storageFileInfo{name: path.Base(strings.TrimSuffix(common.Prefix, "/")), dir: true})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "list", Path: dir, Err: fs.ErrNotExist}
+	}
+	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name() < fileInfos[j].Name() })
+	return fileInfos, nil
+}
+
+func (s *S3Storage) Stat(name string) (fs.FileInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if key == s.prefix {
+		return &storageFileInfo{name: ".", dir: true}, nil
+	}
+
+	response, err := s.do(http.MethodHead, key, nil, nil, s3EmptyPayload, nil)
+	if err == nil {
+		response.Body.Close()
+		modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+		return &storageFileInfo{name: path.Base(key), size: response.ContentLength, modTime: modTime}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	isDir, err := s.hasObjects(s.dirKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if !isDir {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return &storageFileInfo{name: path.Base(key), dir: true}, nil
+}
+
+func (s *S3Storage) Open(name string) (io.ReadCloser, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.do(http.MethodGet, key, nil, nil, s3EmptyPayload, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// Create buffers the content in a temporary file, the object is uploaded in one request on close
+func (s *S3Storage) Create(name string) (io.WriteCloser, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if key == s.prefix {
+		return nil, errors.New("can not create the storage root")
+	}
+	tmp, err := os.CreateTemp("", "s3-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{storage: s, key: key, file: tmp, hash: sha256.New()}, nil
+}
+
+func (s *S3Storage) Remove(name string) error {
+	fileInfo, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	key, _ := s.key(name)
+	if fileInfo.IsDir() {
+		entries, err := s.List(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 || key == s.prefix {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+		key = s.dirKey(key)
+	}
+	return s.deleteObject(key)
+}
+
+func (s *S3Storage) Rename(oldName string, newName string) error {
+	fileInfo, err := s.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	oldKey, _ := s.key(oldName)
+	newKey, err := s.key(newName)
+	if err != nil {
+		return err
+	}
+	if oldKey == s.prefix || newKey == s.prefix {
+		return errors.New("can not rename the storage root")
+	}
+	if !fileInfo.IsDir() {
+		if err := s.copyObject(oldKey, newKey); err != nil {
+			return err
+		}
+		return s.deleteObject(oldKey)
+	}
+
+	// objects are copied before any is deleted, a failed rename leaves the source complete
+	oldPrefix, newPrefix := s.dirKey(oldKey), s.dirKey(newKey)
+	var keys []string
+	err = s.listObjects(oldPrefix, "", func(result *s3ListResult) error {
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.copyObject(key, newPrefix+strings.TrimPrefix(key, oldPrefix)); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if err := s.deleteObject(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listObjects pages through ListObjectsV2 of prefix, an empty delimiter lists every object below it
+func (s *S3Storage) listObjects(prefix string, delimiter string, page func(result *s3ListResult) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		response, err := s.do(http.MethodGet, "", query, nil, s3EmptyPayload, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return fmt.Errorf("invalid S3 list response: %v", err)
+		}
+		if err := page(&result); err != nil {
+			return err
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Storage) hasObjects(prefix string) (bool, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "max-keys": {"1"}}
+	response, err := s.do(http.MethodGet, "", query, nil, s3EmptyPayload, nil)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	var result s3ListResult
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("invalid S3 list response: %v", err)
+	}
+	return len(result.Contents) > 0 || len(result.CommonPrefixes) > 0, nil
+}
+
+func (s *S3Storage) copyObject(srcKey string, dstKey string) error {
+	header := http.Header{"X-Amz-Copy-Source": {"/" + s.options.Bucket + "/" + s3Escape(srcKey, false)}}
+	response, err := s.do(http.MethodPut, dstKey, nil, nil, s3EmptyPayload, header)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) deleteObject(key string) error {
+	response, err := s.do(http.MethodDelete, key, nil, nil, s3EmptyPayload, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// do sends a signed request for the object key, or for the bucket when key is empty.
+// Responses other than 2xx are closed and returned as errors, 404 matches fs.ErrNotExist.
+func (s *S3Storage) do(method string, key string, query url.Values, body io.Reader, payloadHash string, header http.Header) (*http.Response, error) {
+	target := *s.endpoint
+	objectPath := "/" + key
+	if s.options.PathStyle {
+		objectPath = "/" + s.options.Bucket + objectPath
+	} else {
+		target.Host = s.options.Bucket + "." + target.Host
+	}
+	target.Path = strings.TrimSuffix(target.Path, "/") + objectPath
+	target.RawPath = s3Escape(target.Path, false)
+	target.RawQuery = query.Encode()
+
+	request, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if seeker, ok := body.(io.Seeker); ok {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		seeker.Seek(0, io.SeekStart)
+		request.ContentLength = size
+	}
+	SignS3Request(request, s.options, payloadHash, time.Now())
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response, nil
+	}
+	defer response.Body.Close()
+
+	var s3Error s3ErrorResponse
+	xml.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(&s3Error)
+	if response.StatusCode == http.StatusNotFound && s3Error.Code != "NoSuchBucket" {
+		return nil, &fs.PathError{Op: strings.ToLower(method), Path: key, Err: fs.ErrNotExist}
+	}
+	if s3Error.Code == "" {
+		s3Error.Code = response.Status
+	}
+	return nil, fmt.Errorf("S3 %s of '%s' failed: %s %s", method, key, s3Error.Code, s3Error.Message)
+}
+
+// SignS3Request adds the AWS signature version 4 headers to request, signing the host and every header already set.
+// payloadHash is the hex sha256 of the body. Requests stay anonymous without an access key.
+func SignS3Request(request *http.Request, options S3Options, payloadHash string, now time.Time) {
+	if options.AccessKeyID == "" {
+		return
+	}
+	now = now.UTC()
+	date := now.Format(s3DateLayout)
+	request.Header.Set("X-Amz-Date", date)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if options.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", options.SessionToken)
+	}
+
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range request.Header {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := request.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			canonicalQuery = append(canonicalQuery, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	canonicalURI := request.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		canonicalURI,
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := now.Format("20060102") + "/" + options.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + date + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + options.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), options.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, options.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, slashes are kept in paths
+func s3Escape(value string, escapeSlash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if strings.IndexByte(s3UnreservedSet, c) >= 0 || c == '/' && !escapeSlash {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3Writer hashes the content while it is buffered, the hash signs the upload
+type s3Writer struct {
+	storage *S3Storage
+	key     string
+	file    *os.File
+	hash    hash.Hash
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.file.Name())
+	defer w.file.Close()
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	response, err := w.storage.do(http.MethodPut, w.key, nil, w.file, hex.EncodeToString(w.hash.Sum(nil)), nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
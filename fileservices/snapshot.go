@@ -0,0 +1,154 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileChanges are the paths created, modified and deleted between two snapshots.
+// Truncated is set when a tree had more entries than the snapshot limit, the lists are then incomplete.
+type FileChanges struct {
+	Created   []FileMetadata `json:"created"`
+	Modified  []FileMetadata `json:"modified"`
+	Deleted   []FileMetadata `json:"deleted"`
+	Truncated bool           `json:"truncated,omitempty"`
+}
+
+// Snapshot is the name, size and mtime of every entry below a root, keyed by slash separated relative path.
+// Only directory entries are read, file contents never are, so taking one costs one lstat per entry.
+type Snapshot struct {
+	root      string
+	entries   map[string]os.FileInfo
+	truncated bool
+}
+
+var errSnapshotFull = errors.New("snapshot entry limit reached")
+
+// TakeSnapshot walks rootPath without following symlinks and stops after maxEntries entries, 0 means unlimited.
+// Temporary files of running uploads and extractions are left out.
+func TakeSnapshot(rootPath string, maxEntries int) (*Snapshot, error) {
+	snapshot := &Snapshot{root: rootPath, entries: map[string]os.FileInfo{}}
+
+	err := filepath.WalkDir(rootPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == rootPath {
+				return err
+			}
+			return nil
+		}
+		if path == rootPath || entry.Type()&os.ModeSymlink != 0 {
+			return nil
+		}
+		if isTransientName(entry.Name()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if maxEntries > 0 && len(snapshot.entries) >= maxEntries {
+			snapshot.truncated = true
+			return errSnapshotFull
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		relativePath, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return nil
+		}
+		snapshot.entries[filepath.ToSlash(relativePath)] = fileInfo
+		return nil
+	})
+	if err != nil && err != errSnapshotFull {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Diff lists what changed from before to after, leaving out the file versions. Directories are reported when created or deleted,
+// files also when their size or mtime changed. Every list is sorted by path.
+func Diff(before *Snapshot, after *Snapshot) FileChanges {
+	changes := FileChanges{
+		Created:   []FileMetadata{},
+		Modified:  []FileMetadata{},
+		Deleted:   []FileMetadata{},
+		Truncated: before.truncated || after.truncated,
+	}
+
+	for path, fileInfo := range after.entries {
+		if isVersionsPath(path) {
+			continue
+		}
+		previous, ok := before.entries[path]
+		switch {
+		case !ok && !before.truncated:
+			changes.Created = append(changes.Created, after.describe(path, fileInfo))
+		case ok && previous.IsDir() != fileInfo.IsDir():
+			changes.Deleted = append(changes.Deleted, deletedFileMetadata(path, previous))
+			changes.Created = append(changes.Created, after.describe(path, fileInfo))
+		case ok && !fileInfo.IsDir() && (previous.Size() != fileInfo.Size() || !previous.ModTime().Equal(fileInfo.ModTime())):
+			changes.Modified = append(changes.Modified, after.describe(path, fileInfo))
+		}
+	}
+	if !after.truncated {
+		for path, fileInfo := range before.entries {
+			if _, ok := after.entries[path]; !ok && !isVersionsPath(path) {
+				changes.Deleted = append(changes.Deleted, deletedFileMetadata(path, fileInfo))
+			}
+		}
+	}
+
+	for _, list := range [][]FileMetadata{changes.Created, changes.Modified, changes.Deleted} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	}
+	return changes
+}
+
+// Usage sums the regular files of the snapshot, it is only complete if the snapshot is not truncated
+func (s *Snapshot) Usage() (Usage, bool) {
+	usage := Usage{ScannedAt: time.Now().UTC()}
+	for _, fileInfo := range s.entries {
+		if fileInfo.Mode().IsRegular() {
+			usage.Bytes += fileInfo.Size()
+			usage.Files++
+		}
+	}
+	return usage, !s.truncated
+}
+
+// describe reads the content type of an entry of the snapshot
+func (s *Snapshot) describe(path string, fileInfo os.FileInfo) FileMetadata {
+	return describeFile(s.root, filepath.Join(s.root, filepath.FromSlash(path)), newFileMetadata(path, fileInfo), MetadataOptions{})
+}
+
+// deleted files can not be read anymore, their type is guessed from the extension
+func deletedFileMetadata(path string, fileInfo os.FileInfo) FileMetadata {
+	metadata := newFileMetadata(path, fileInfo)
+	metadata.Path = path
+	return metadata
+}
+
+func isTransientName(name string) bool {
+	return strings.HasPrefix(name, ".extract-") || strings.HasPrefix(name, ".") && strings.Contains(name, ".upload-")
+}
@@ -0,0 +1,194 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/jupyterpython/util"
+)
+
+// Storage is a tree of files and directories addressed by slash separated paths relative to its root,
+// "" and "." are the root itself. Missing paths fail with an error matching fs.ErrNotExist.
+// The file handlers work on the data root directly, the sync copies between a LocalStorage and an S3Storage.
+type Storage interface {
+	// List returns the direct entries of the directory dir sorted by name
+	List(dir string) ([]fs.FileInfo, error)
+	Stat(name string) (fs.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	// Create replaces name with the written content once the writer is closed, missing parent directories are created
+	Create(name string) (io.WriteCloser, error)
+	// Remove deletes a file or an empty directory
+	Remove(name string) error
+	Rename(oldName string, newName string) error
+}
+
+// s3OptionsFromConfig is the S3 bucket the data root is synced with
+func s3OptionsFromConfig() S3Options {
+	cfg := util.GetConfig()
+	return S3Options{
+		Endpoint:        cfg.S3Endpoint,
+		Region:          cfg.S3Region,
+		Bucket:          cfg.S3Bucket,
+		Prefix:          cfg.S3Prefix,
+		AccessKeyID:     cfg.S3AccessKeyID,
+		SecretAccessKey: cfg.S3SecretAccessKey,
+		SessionToken:    cfg.S3SessionToken,
+		PathStyle:       cfg.S3PathStyle,
+	}
+}
+
+// cleanStorageName cleans a slash separated path and rejects paths leaving the root, the root itself is ""
+func cleanStorageName(name string) (string, error) {
+	if strings.Contains(name, "\\") || strings.Contains(name, "\x00") {
+		return "", fmt.Errorf("invalid path '%s'", name)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("path '%s' leaves the storage root", name)
+		}
+	}
+	return strings.TrimPrefix(path.Clean("/"+name), "/"), nil
+}
+
+// LocalStorage keeps files in a directory of the host, symlinks are never followed
+type LocalStorage struct {
+	Root string
+}
+
+func (s *LocalStorage) path(name string) (string, error) {
+	cleaned, err := cleanStorageName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(cleaned)), nil
+}
+
+func (s *LocalStorage) List(dir string) ([]fs.FileInfo, error) {
+	dirPath, err := s.path(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos := []fs.FileInfo{}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink != 0 {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		fileInfos = append(fileInfos, fileInfo)
+	}
+	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name() < fileInfos[j].Name() })
+	return fileInfos, nil
+}
+
+func (s *LocalStorage) Stat(name string) (fs.FileInfo, error) {
+	filePath, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Lstat(filePath)
+	if err == nil && fileInfo.Mode()&os.ModeSymlink != 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return fileInfo, err
+}
+
+func (s *LocalStorage) Open(name string) (io.ReadCloser, error) {
+	if _, err := s.Stat(name); err != nil {
+		return nil, err
+	}
+	filePath, _ := s.path(name)
+	return os.Open(filePath)
+}
+
+func (s *LocalStorage) Create(name string) (io.WriteCloser, error) {
+	filePath, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if filePath == filepath.Clean(s.Root) {
+		return nil, fmt.Errorf("can not create the storage root")
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return nil, err
+	}
+	// written next to the destination and renamed into place on close like uploads
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &localStorageWriter{File: tmp, root: s.Root, path: filePath}, nil
+}
+
+func (s *LocalStorage) Remove(name string) error {
+	filePath, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+func (s *LocalStorage) Rename(oldName string, newName string) error {
+	oldPath, err := s.path(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.path(newName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	return ownPath(s.Root, newPath)
+}
+
+type localStorageWriter struct {
+	*os.File
+	root string
+	path string
+}
+
+func (w *localStorageWriter) Close() error {
+	defer os.Remove(w.File.Name())
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(w.File.Name(), 0777); err != nil {
+		return err
+	}
+	if err := ownPath(w.root, w.File.Name()); err != nil {
+		return err
+	}
+	return os.Rename(w.File.Name(), w.path)
+}
@@ -0,0 +1,554 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrCodeSyncNotConfigured = "ERR_SYNC_NOT_CONFIGURED"
+
+	SyncDirectionPull = "pull"
+	SyncDirectionPush = "push"
+
+	SyncConflictModified = "modified on both sides"
+	SyncConflictDeleted  = "deleted on the destination since the last sync"
+	SyncConflictDiffers  = "exists on both sides with different content"
+	SyncConflictType     = "is a directory on the destination"
+)
+
+// SyncReport is the outcome of a pull or push, conflicting files are left unchanged on both sides
+type SyncReport struct {
+	Direction   string          `json:"direction"`
+	Transferred []string        `json:"transferred"`
+	Unchanged   int             `json:"unchanged"`
+	Conflicts   []SyncConflict  `json:"conflicts"`
+	Failed      []SyncFileError `json:"failed"`
+}
+
+type SyncConflict struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+type SyncFileError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Syncer mirrors the files below Prefixes of a root to its remote storage and back. Paths are relative to the root
+// on both sides, the globs select files by name or, when they contain a slash, by path where ** spans directories.
+// The state of every transferred file is kept, a file changed on both sides since is reported as a conflict.
+// Local deletions are never pushed.
+type Syncer struct {
+	Remote   func(rootPath string) (Storage, error)
+	Prefixes []string
+	Include  []string
+	Exclude  []string
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+
+	statesLock sync.Mutex
+	states     map[string]*syncState
+}
+
+// syncState remembers both sides of every file of a root as they were after its last transfer
+type syncState struct {
+	lock    sync.Mutex
+	records map[string]syncRecord
+}
+
+type syncRecord struct {
+	local  syncFileState
+	remote syncFileState
+}
+
+type syncFileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// syncSide is one storage of a sync, the source or the destination
+type syncSide struct {
+	storage Storage
+	local   bool
+	// root of the local side, pulled files count against its quota
+	root string
+}
+
+var errSyncNotConfigured = errors.New("sync is not configured, set SYNC_ENABLED and the S3 bucket")
+
+var defaultSyncer = newDefaultSyncer()
+
+func newDefaultSyncer() *Syncer {
+	cfg := util.GetConfig()
+	if !cfg.SyncEnabled {
+		return nil
+	}
+	syncer, err := NewSyncer(&Syncer{Remote: remoteStorage, Prefixes: cfg.SyncPrefixes, Include: cfg.SyncInclude, Exclude: cfg.SyncExclude})
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid sync config, sync is disabled")
+		return nil
+	}
+	return syncer
+}
+
+// NewSyncer validates the prefixes and compiles the globs of syncer
+func NewSyncer(syncer *Syncer) (*Syncer, error) {
+	prefixes := []string{}
+	for _, prefix := range syncer.Prefixes {
+		cleaned, err := cleanStorageName(prefix)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, cleaned)
+	}
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	syncer.Prefixes = prefixes
+
+	var err error
+	if syncer.include, err = compileSyncGlobs(syncer.Include); err != nil {
+		return nil, err
+	}
+	if syncer.exclude, err = compileSyncGlobs(syncer.Exclude); err != nil {
+		return nil, err
+	}
+	syncer.states = map[string]*syncState{}
+	return syncer, nil
+}
+
+// remoteStorage is the S3 storage of rootPath, every tenant syncs below its own directory of S3_PREFIX
+func remoteStorage(rootPath string) (Storage, error) {
+	options := s3OptionsFromConfig()
+	if filepath.Clean(rootPath) != filepath.Clean(dirPath) {
+		options.Prefix = path.Join(options.Prefix, filepath.Base(rootPath))
+	}
+	return NewS3Storage(options)
+}
+
+func compileSyncGlobs(globs []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, glob := range globs {
+		if _, err := path.Match(strings.ReplaceAll(glob, "**", "*"), ""); err != nil {
+			return nil, fmt.Errorf("invalid glob '%s'", glob)
+		}
+
+		var pattern strings.Builder
+		pattern.WriteString("^")
+		if !strings.Contains(glob, "/") {
+			// globs without a slash match the name in any directory
+			pattern.WriteString("(.*/)?")
+		}
+		for i := 0; i < len(glob); i++ {
+			switch c := glob[i]; {
+			case strings.HasPrefix(glob[i:], "**/"):
+				pattern.WriteString("(.*/)?")
+				i += 2
+			case strings.HasPrefix(glob[i:], "**"):
+				pattern.WriteString(".*")
+				i++
+			case c == '*':
+				pattern.WriteString("[^/]*")
+			case c == '?':
+				pattern.WriteString("[^/]")
+			case c == '[':
+				end := strings.IndexByte(glob[i:], ']')
+				if end < 0 {
+					return nil, fmt.Errorf("invalid glob '%s'", glob)
+				}
+				class := strings.Replace(glob[i+1:i+end], "!", "^", 1)
+				pattern.WriteString("[" + class + "]")
+				i += end
+			default:
+				pattern.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		pattern.WriteString("$")
+		expression, err := regexp.Compile(pattern.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob '%s'", glob)
+		}
+		compiled = append(compiled, expression)
+	}
+	return compiled, nil
+}
+
+// SyncEnabled reports whether a remote storage is configured for sync
+func SyncEnabled() bool {
+	return defaultSyncer != nil
+}
+
+// PullOnSessionStart pulls the remote files of tenant before its new session runs code
+func PullOnSessionStart(tenant string) {
+	if defaultSyncer == nil {
+		return
+	}
+	rootPath, err := TenantRootPath(tenant)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to resolve root for sync")
+		return
+	}
+	report, err := defaultSyncer.Pull(rootPath)
+	logSyncReport(rootPath, report, err)
+}
+
+// PushAfterExecution pushes the files an execution wrote, the report is nil when sync is disabled or after executions
+func PushAfterExecution(rootPath string) *SyncReport {
+	if defaultSyncer == nil || !util.GetConfig().SyncAfterExecution {
+		return nil
+	}
+	report, err := defaultSyncer.Push(rootPath)
+	logSyncReport(rootPath, report, err)
+	if err != nil {
+		return nil
+	}
+	return &report
+}
+
+func logSyncReport(rootPath string, report SyncReport, err error) {
+	if err != nil {
+		log.Error().Err(err).Str("root", rootPath).Msg("Sync failed")
+		return
+	}
+	log.Info().Str("root", rootPath).Str("direction", report.Direction).
+		Msgf("Sync transferred %d files, %d unchanged, %d conflicts, %d failed", len(report.Transferred), report.Unchanged, len(report.Conflicts), len(report.Failed))
+}
+
+// Pull downloads the remote files that are new or changed since the last sync into rootPath
+func (s *Syncer) Pull(rootPath string) (SyncReport, error) {
+	return s.sync(rootPath, SyncDirectionPull)
+}
+
+// Push uploads the files of rootPath that are new or changed since the last sync
+func (s *Syncer) Push(rootPath string) (SyncReport, error) {
+	return s.sync(rootPath, SyncDirectionPush)
+}
+
+func (s *Syncer) state(rootPath string) *syncState {
+	s.statesLock.Lock()
+	defer s.statesLock.Unlock()
+	state, ok := s.states[filepath.Clean(rootPath)]
+	if !ok {
+		state = &syncState{records: map[string]syncRecord{}}
+		s.states[filepath.Clean(rootPath)] = state
+	}
+	return state
+}
+
+func (s *Syncer) sync(rootPath string, direction string) (SyncReport, error) {
+	report := SyncReport{Direction: direction, Transferred: []string{}, Conflicts: []SyncConflict{}, Failed: []SyncFileError{}}
+	remote, err := s.Remote(rootPath)
+	if err != nil {
+		return report, err
+	}
+	local := syncSide{storage: &LocalStorage{Root: rootPath}, local: true, root: rootPath}
+	source, destination := syncSide{storage: remote}, local
+	if direction == SyncDirectionPush {
+		source, destination = local, syncSide{storage: remote}
+	}
+
+	// a root syncs one direction at a time, e.g. a push after an execution and one requested with POST /sync
+	state := s.state(rootPath)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	var names []string
+	files := map[string]fs.FileInfo{}
+	for _, prefix := range s.Prefixes {
+		err := walkStorage(source.storage, prefix, func(name string, fileInfo fs.FileInfo) {
+			if s.matches(name) {
+				names = append(names, name)
+				files[name] = fileInfo
+			}
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return report, err
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if direction == SyncDirectionPull {
+			if _, err := CleanAndVerifyTargetPath(rootPath, filepath.Join(rootPath, filepath.FromSlash(name))); err != nil {
+				report.Failed = append(report.Failed, SyncFileError{Path: name, Error: err.Error()})
+				continue
+			}
+		}
+
+		transferred, conflict, err := syncFile(state, name, files[name], source, destination)
+		switch {
+		case err != nil:
+			report.Failed = append(report.Failed, SyncFileError{Path: name, Error: err.Error()})
+		case conflict != "":
+			report.Conflicts = append(report.Conflicts, SyncConflict{Path: name, Reason: conflict})
+		case transferred:
+			report.Transferred = append(report.Transferred, name)
+		default:
+			report.Unchanged++
+		}
+	}
+
+	return report, nil
+}
+
+// syncFile copies one file from source to destination unless it is unchanged since the last sync
+// or the destination changed as well
+func syncFile(state *syncState, name string, sourceInfo fs.FileInfo, source syncSide, destination syncSide) (bool, string, error) {
+	record, synced := state.records[name]
+	sourceChanged := !synced || !record.side(source).matches(sourceInfo)
+
+	destinationInfo, err := destination.storage.Stat(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && synced && !sourceChanged:
+		// deleted on the destination on purpose, it is not brought back
+		return false, "", nil
+	case errors.Is(err, fs.ErrNotExist) && synced:
+		return false, SyncConflictDeleted, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return true, "", transferFile(state, name, sourceInfo, source, destination)
+	case err != nil:
+		return false, "", err
+	case destinationInfo.IsDir():
+		return false, SyncConflictType, nil
+	}
+
+	destinationChanged := !synced || !record.side(destination).matches(destinationInfo)
+	switch {
+	case synced && !sourceChanged:
+		return false, "", nil
+	case synced && !destinationChanged:
+		return true, "", transferFile(state, name, sourceInfo, source, destination)
+	case synced:
+		return false, SyncConflictModified, nil
+	}
+
+	// never synced by this process, e.g. after a restart, identical files are only recorded
+	equal, err := sameContent(source.storage, destination.storage, name)
+	if err != nil {
+		return false, "", err
+	}
+	if !equal {
+		return false, SyncConflictDiffers, nil
+	}
+	state.record(name, source, sourceInfo, destination, destinationInfo)
+	return false, "", nil
+}
+
+// transferFile copies name from source to destination. A pulled file replaces the local one like an upload,
+// it has to fit in the quota of the root and the replaced file is kept as a version.
+func transferFile(state *syncState, name string, sourceInfo fs.FileInfo, source syncSide, destination syncSide) error {
+	var localPath string
+	var freed, replaced, reserved Usage
+	if destination.local {
+		localPath = filepath.Join(destination.root, filepath.FromSlash(name))
+		if fileInfo, err := os.Lstat(localPath); err == nil && fileInfo.Mode().IsRegular() {
+			replaced = Usage{Bytes: fileInfo.Size(), Files: 1}
+			if MaxFileVersions <= 0 {
+				freed = replaced
+			}
+		}
+		reserved = Usage{Bytes: sourceInfo.Size() - freed.Bytes, Files: 1 - freed.Files}
+		if err := ReserveQuota(destination.root, reserved.Bytes, reserved.Files); err != nil {
+			return err
+		}
+		// a failed transfer gives back what is still reserved
+		defer func() { AddUsage(destination.root, -reserved.Bytes, -reserved.Files) }()
+	}
+
+	reader, err := source.storage.Open(name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := destination.storage.Create(name)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(writer, reader)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	// the local writer renames the file into place on close
+	if destination.local && replaced.Files > 0 {
+		if err := SaveVersion(destination.root, localPath); err != nil {
+			log.Error().Err(err).Str("path", localPath).Msg("Unable to save file version")
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if destination.local {
+		AddUsage(destination.root, written-replaced.Bytes-reserved.Bytes, 1-replaced.Files-reserved.Files)
+		reserved = Usage{}
+	}
+
+	// both sides are read back, the destination sets its own modification time
+	sourceInfo, err = source.storage.Stat(name)
+	if err != nil {
+		return err
+	}
+	destinationInfo, err := destination.storage.Stat(name)
+	if err != nil {
+		return err
+	}
+	state.record(name, source, sourceInfo, destination, destinationInfo)
+	return nil
+}
+
+func (state *syncState) record(name string, source syncSide, sourceInfo fs.FileInfo, destination syncSide, destinationInfo fs.FileInfo) {
+	var record syncRecord
+	*record.side(source) = newSyncFileState(sourceInfo)
+	*record.side(destination) = newSyncFileState(destinationInfo)
+	state.records[name] = record
+}
+
+func (r *syncRecord) side(side syncSide) *syncFileState {
+	if side.local {
+		return &r.local
+	}
+	return &r.remote
+}
+
+func newSyncFileState(fileInfo fs.FileInfo) syncFileState {
+	return syncFileState{size: fileInfo.Size(), modTime: fileInfo.ModTime()}
+}
+
+func (s syncFileState) matches(fileInfo fs.FileInfo) bool {
+	return s.size == fileInfo.Size() && s.modTime.Equal(fileInfo.ModTime())
+}
+
+func sameContent(a Storage, b Storage, name string) (bool, error) {
+	digestA, err := storageDigest(a, name)
+	if err != nil {
+		return false, err
+	}
+	digestB, err := storageDigest(b, name)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(digestA, digestB), nil
+}
+
+func storageDigest(storage Storage, name string) ([]byte, error) {
+	reader, err := storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func (s *Syncer) matches(name string) bool {
+	if len(s.include) > 0 && !matchesAny(s.include, name) {
+		return false
+	}
+	return !matchesAny(s.exclude, name)
+}
+
+func matchesAny(expressions []*regexp.Regexp, name string) bool {
+	for _, expression := range expressions {
+		if expression.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkStorage calls visit for every file below dir, file versions and temporary files are left out
+func walkStorage(storage Storage, dir string, visit func(name string, fileInfo fs.FileInfo)) error {
+	fileInfos, err := storage.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		name := path.Join(dir, fileInfo.Name())
+		if isTransientName(fileInfo.Name()) || isVersionsPath(name) {
+			continue
+		}
+		if fileInfo.IsDir() {
+			if err := walkStorage(storage, name, visit); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if fileInfo.Mode().IsRegular() {
+			visit(name, fileInfo)
+		}
+	}
+	return nil
+}
+
+// SyncHandler pulls or pushes the files of the caller's root, direction defaults to push
+func SyncHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+	if defaultSyncer == nil {
+		logAndRespond(w, http.StatusNotImplemented, ErrCodeSyncNotConfigured, errSyncNotConfigured.Error())
+		return
+	}
+
+	direction := r.URL.Query().Get("direction")
+	if direction == "" {
+		direction = SyncDirectionPush
+	}
+	if direction != SyncDirectionPull && direction != SyncDirectionPush {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid direction '%s', expected %s or %s", direction, SyncDirectionPull, SyncDirectionPush))
+		return
+	}
+
+	report, err := defaultSyncer.sync(rootPath, direction)
+	logSyncReport(rootPath, report, err)
+	if err != nil {
+		logAndRespond(w, http.StatusBadGateway, ErrCodeFileAccess, "Error syncing with the remote storage")
+		return
+	}
+
+	response, err := json.Marshal(report)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to marshal response")
+		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
+		return
+	}
+	util.SendHTTPResponse(w, http.StatusOK, string(response), false)
+}
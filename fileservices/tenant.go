@@ -0,0 +1,137 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/microsoft/jupyterpython/util"
+)
+
+// tenantLock serializes the uid allocation of new tenant roots
+var tenantLock sync.Mutex
+
+// EnsureTenantRoot creates the root of tenant under dataRoot, owned by the tenant's own uid and only
+// accessible to it, and returns the root and the uid. The uid is stored as the owner of the root, a new
+// tenant gets the next uid from uidBase up. Roots created before tenants had their own uid are adopted.
+func EnsureTenantRoot(dataRoot string, tenant string, uidBase int) (string, int, error) {
+	root := filepath.Join(dataRoot, tenant)
+
+	tenantLock.Lock()
+	defer tenantLock.Unlock()
+
+	if uid, err := fileOwner(root); err == nil && uid >= uidBase {
+		return root, uid, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", 0, fmt.Errorf("error reading tenant directory: %v", err)
+	}
+
+	uid, err := nextTenantUID(dataRoot, uidBase)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return "", 0, fmt.Errorf("error creating tenant directory: %v", err)
+	}
+	// the files of an adopted root move to the tenant uid too, the root itself is chowned last so a
+	// failure is retried on the next request
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		return os.Lchown(path, uid, uid)
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("error adopting tenant directory: %v", err)
+	}
+	if err := os.Chmod(root, 0o700); err != nil {
+		return "", 0, fmt.Errorf("error restricting tenant directory: %v", err)
+	}
+	if err := os.Lchown(root, uid, uid); err != nil {
+		return "", 0, fmt.Errorf("error assigning tenant directory: %v", err)
+	}
+	return root, uid, nil
+}
+
+// nextTenantUID returns the uid after the highest uid owning a tenant root, or uidBase for the first tenant
+func nextTenantUID(dataRoot string, uidBase int) (int, error) {
+	entries, err := os.ReadDir(dataRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("error listing tenant directories: %v", err)
+	}
+	next := uidBase
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if uid, err := fileOwner(filepath.Join(dataRoot, entry.Name())); err == nil && uid >= next {
+			next = uid + 1
+		}
+	}
+	return next, nil
+}
+
+// TenantUser returns the root and uid of tenant, the kernel of the tenant runs as that uid
+func TenantUser(tenant string) (string, int, error) {
+	return EnsureTenantRoot(dirPath, tenant, util.GetConfig().TenantUIDBase)
+}
+
+// ownPath gives path and the parents created with it below rootPath to the owner of rootPath. Tenant kernels
+// run as the owner of their root and have to be able to change what the server writes there for them.
+// Nothing changes below a root owned by the server.
+func ownPath(rootPath string, path string) error {
+	uid, err := fileOwner(rootPath)
+	if err != nil || uid == os.Geteuid() {
+		return nil
+	}
+	rootPath = filepath.Clean(rootPath)
+	for current := filepath.Clean(path); strings.HasPrefix(current, rootPath+string(filepath.Separator)); current = filepath.Dir(current) {
+		owner, err := fileOwner(current)
+		if err != nil {
+			return err
+		}
+		// the parents of a path the tenant owns already belong to it
+		if owner == uid && current != filepath.Clean(path) {
+			return nil
+		}
+		if err := os.Lchown(current, uid, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownTree gives path, everything below it and its new parents to the owner of rootPath like ownPath
+func ownTree(rootPath string, path string) error {
+	uid, err := fileOwner(rootPath)
+	if err != nil || uid == os.Geteuid() {
+		return nil
+	}
+	err = filepath.WalkDir(path, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(current, uid, uid)
+	})
+	if err != nil {
+		return err
+	}
+	return ownPath(rootPath, path)
+}
@@ -0,0 +1,40 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package fileservices
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func fileOwner(path string) (int, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	return int(info.Sys().(*syscall.Stat_t).Uid), nil
+}
+
+// PrepareTenantIsolation checks the server can give tenant roots to their uids, which needs root.
+// The kernels are started by the same user and need root as well to drop to the tenant uid.
+func PrepareTenantIsolation() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("MULTI_TENANT needs the server and Jupyter to run as root, running as uid %d", os.Geteuid())
+	}
+	return nil
+}
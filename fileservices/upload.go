@@ -0,0 +1,325 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrCodeFileTooLarge    = "ERR_FILE_TOO_LARGE"
+	ErrCodeRequestTooLarge = "ERR_REQUEST_TOO_LARGE"
+	ErrCodeInvalidFilename = "ERR_INVALID_FILENAME"
+
+	UploadStatusOK    = "ok"
+	UploadStatusError = "error"
+
+	uploadFormField = "file"
+)
+
+// UploadResult is the outcome of one uploaded file, the metadata is only set when the status is ok.
+// Extracted archives are not kept, Extracted lists the files unpacked from them instead.
+type UploadResult struct {
+	FileMetadata
+	Status    string         `json:"status"`
+	ErrorCode string         `json:"error_code,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Extracted []FileMetadata `json:"extracted,omitempty"`
+}
+
+// UploadOptions control where and how StreamUpload writes the uploaded files
+type UploadOptions struct {
+	RootPath      string
+	TargetPath    string
+	Limits        UploadLimits
+	Preconditions Preconditions
+	// unpack every uploaded file as an archive instead of storing it
+	Extract       bool
+	ExtractLimits ExtractLimits
+	// reject files whose name is taken instead of replacing them, set by overwrite=false
+	FailIfExists bool
+	// bytes and files left in the quota of the root as returned by RemainingQuota, decreased by every written file
+	QuotaBytes int64
+	QuotaFiles int64
+}
+
+// UploadLimits are the maximum sizes of a single file and of the whole request body, 0 means unlimited
+type UploadLimits struct {
+	MaxFileBytes    int64
+	MaxRequestBytes int64
+}
+
+func GetUploadLimits() UploadLimits {
+	cfg := util.GetConfig()
+	return UploadLimits{
+		MaxFileBytes:    cfg.UploadMaxFileBytes,
+		MaxRequestBytes: cfg.UploadMaxRequestBytes,
+	}
+}
+
+// errRequestTooLarge stops the upload, files written before it are kept
+var errRequestTooLarge = errors.New("request body exceeds the maximum upload size")
+
+// StreamUpload writes every "file" part of reader straight into the target path without buffering the form.
+// A failing file does not stop the others, only a broken or oversized request body does.
+// Wrap the body with http.MaxBytesReader to enforce Limits.MaxRequestBytes.
+// The preconditions are checked against each destination file right before it is replaced.
+func StreamUpload(reader *multipart.Reader, options UploadOptions) ([]UploadResult, error) {
+	results := []UploadResult{}
+
+	if err := os.MkdirAll(options.TargetPath, os.ModePerm); err != nil {
+		return results, err
+	}
+	if err := ownPath(options.RootPath, options.TargetPath); err != nil {
+		return results, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			if isMaxBytesError(err) {
+				return results, errRequestTooLarge
+			}
+			return results, err
+		}
+
+		if part.FormName() != uploadFormField || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		result := writePart(part, &options)
+		part.Close()
+		results = append(results, result)
+		if result.ErrorCode == ErrCodeRequestTooLarge {
+			return results, errRequestTooLarge
+		}
+	}
+}
+
+// writePart streams one part into a temporary file next to the destination and renames it into place,
+// so a failed upload never leaves a truncated file behind or replaces an existing one
+func writePart(part *multipart.Part, options *UploadOptions) UploadResult {
+	targetPath, limits := options.TargetPath, options.Limits
+
+	filename, err := url.QueryUnescape(part.FileName())
+	if err != nil {
+		return uploadError(part.FileName(), ErrCodeInvalidFilename, "Error decoding file name")
+	}
+	filename = filepath.Base(filename)
+	if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+		return uploadError(filename, ErrCodeInvalidFilename, "Invalid file name")
+	}
+
+	dstPath := filepath.Join(targetPath, filename)
+	if inVersions(options.RootPath, dstPath) {
+		return uploadError(filename, ErrCodeInvalidFilename, "File name is reserved")
+	}
+	// an upload replacing a file frees the space of that file, unless it is kept as a version
+	var freed, replaced Usage
+	if fileInfo, err := os.Lstat(dstPath); err == nil && !options.Extract {
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			return uploadError(filename, ErrCodeSymlinkNotAllowed, "Symlinks not allowed")
+		}
+		if fileInfo.IsDir() {
+			return uploadError(filename, ErrCodeFileExists, "A directory with the same name exists")
+		}
+		if options.FailIfExists {
+			return uploadError(filename, ErrCodeFileExists, "A file with the same name exists")
+		}
+		if MaxFileVersions <= 0 {
+			freed = Usage{Bytes: fileInfo.Size(), Files: 1}
+		}
+	}
+
+	if options.QuotaFiles+freed.Files <= 0 && !options.Extract {
+		return uploadError(filename, ErrCodeQuotaExceeded, "File count quota exceeded")
+	}
+
+	tmp, err := os.CreateTemp(targetPath, "."+filename+".upload-*")
+	if err != nil {
+		log.Error().Err(err).Str("filename", filename).Msg("Unable to create upload file")
+		return uploadError(filename, ErrCodeFileAccess, "Error creating file")
+	}
+	defer os.Remove(tmp.Name())
+
+	// an archive only takes space once extracted, the quota applies to its content
+	maxBytes := int64(math.MaxInt64 - 1)
+	if limits.MaxFileBytes > 0 {
+		maxBytes = limits.MaxFileBytes
+	}
+	if !options.Extract {
+		maxBytes = min(maxBytes, options.QuotaBytes+freed.Bytes)
+	}
+	written, err := io.Copy(tmp, io.LimitReader(part, maxBytes+1))
+	uploadBytes.Add(float64(written))
+	closeErr := tmp.Close()
+	if err != nil {
+		if isMaxBytesError(err) {
+			return uploadError(filename, ErrCodeRequestTooLarge, fmt.Sprintf("Request exceeds the maximum size of %d bytes", limits.MaxRequestBytes))
+		}
+		log.Error().Err(err).Str("filename", filename).Msg("Unable to write upload file")
+		return uploadError(filename, ErrCodeFileAccess, "Error writing file")
+	}
+	if limits.MaxFileBytes > 0 && written > limits.MaxFileBytes {
+		return uploadError(filename, ErrCodeFileTooLarge, fmt.Sprintf("File exceeds the maximum size of %d bytes", limits.MaxFileBytes))
+	}
+	if written > maxBytes {
+		return uploadError(filename, ErrCodeQuotaExceeded, fmt.Sprintf("Storage quota exceeded, %d bytes remaining", options.QuotaBytes+freed.Bytes))
+	}
+	if closeErr != nil {
+		return uploadError(filename, ErrCodeFileAccess, "Error writing file")
+	}
+
+	if options.Extract {
+		return extractPart(tmp.Name(), filename, options)
+	}
+
+	if err := options.Preconditions.Check(dstPath); err != nil {
+		return uploadError(filename, ErrCodePreconditionFailed, err.Error())
+	}
+	if err := os.Chmod(tmp.Name(), 0777); err != nil {
+		return uploadError(filename, ErrCodeFileAccess, "Error setting file permissions")
+	}
+	if err := ownPath(options.RootPath, tmp.Name()); err != nil {
+		return uploadError(filename, ErrCodeFileAccess, "Error setting file owner")
+	}
+	// concurrent uploads may have taken the quota since it was read for this request
+	if err := ReserveQuota(options.RootPath, written-freed.Bytes, 1-freed.Files); err != nil {
+		if quotaErr, ok := err.(*QuotaExceededError); ok {
+			return uploadError(filename, ErrCodeQuotaExceeded, quotaErr.Message)
+		}
+		log.Error().Err(err).Str("filename", filename).Msg("Unable to check quota")
+		return uploadError(filename, ErrCodeFileAccess, "Error reading disk usage")
+	}
+	if options.FailIfExists {
+		// a link fails instead of replacing a file created while the upload was running
+		if err := os.Link(tmp.Name(), dstPath); err != nil {
+			AddUsage(options.RootPath, freed.Bytes-written, freed.Files-1)
+			if os.IsExist(err) {
+				return uploadError(filename, ErrCodeFileExists, "A file with the same name exists")
+			}
+			log.Error().Err(err).Str("filename", filename).Msg("Unable to move upload file into place")
+			return uploadError(filename, ErrCodeFileAccess, "Error writing file")
+		}
+	} else {
+		if err := SaveVersion(options.RootPath, dstPath); err != nil {
+			log.Error().Err(err).Str("filename", filename).Msg("Unable to save file version")
+		}
+		// the saved version is accounted by SaveVersion, the file it was taken from is replaced now
+		if fileInfo, err := os.Lstat(dstPath); err == nil && fileInfo.Mode().IsRegular() {
+			replaced = Usage{Bytes: fileInfo.Size(), Files: 1}
+		}
+		if err := os.Rename(tmp.Name(), dstPath); err != nil {
+			AddUsage(options.RootPath, freed.Bytes-written, freed.Files-1)
+			log.Error().Err(err).Str("filename", filename).Msg("Unable to move upload file into place")
+			return uploadError(filename, ErrCodeFileAccess, "Error writing file")
+		}
+	}
+
+	options.QuotaBytes -= written - freed.Bytes
+	options.QuotaFiles -= 1 - freed.Files
+	// the reservation counted the freed space, the file actually replaced may differ from it
+	AddUsage(options.RootPath, freed.Bytes-replaced.Bytes, freed.Files-replaced.Files)
+
+	fileInfo, err := os.Stat(dstPath)
+	if err != nil {
+		return uploadError(filename, ErrCodeFileAccess, "Error accessing file")
+	}
+	metadata := describeFile(options.RootPath, dstPath, newFileMetadata(filename, fileInfo), MetadataOptions{})
+	return UploadResult{FileMetadata: metadata, Status: UploadStatusOK}
+}
+
+func extractPart(archivePath string, filename string, options *UploadOptions) UploadResult {
+	limits := options.ExtractLimits
+	quotaLimited := false
+	if limits.MaxTotalBytes <= 0 || options.QuotaBytes < limits.MaxTotalBytes {
+		limits.MaxTotalBytes, quotaLimited = options.QuotaBytes, true
+	}
+	if limits.MaxEntries <= 0 || options.QuotaFiles < int64(limits.MaxEntries) {
+		limits.MaxEntries, quotaLimited = int(min(options.QuotaFiles, math.MaxInt32)), true
+	}
+
+	extracted, err := ExtractArchive(archivePath, options.RootPath, options.TargetPath, limits)
+	if err != nil {
+		var archiveError *ArchiveError
+		if errors.As(err, &archiveError) {
+			if archiveError.Code == ErrCodeArchiveTooLarge && quotaLimited {
+				return uploadError(filename, ErrCodeQuotaExceeded, "Extracted archive exceeds the storage quota")
+			}
+			return uploadError(filename, archiveError.Code, archiveError.Message)
+		}
+		log.Error().Err(err).Str("filename", filename).Msg("Unable to extract archive")
+		return uploadError(filename, ErrCodeFileAccess, "Error extracting archive")
+	}
+
+	var extractedBytes int64
+	for _, metadata := range extracted {
+		extractedBytes += metadata.Size
+	}
+	options.QuotaBytes -= extractedBytes
+	options.QuotaFiles -= int64(len(extracted))
+	AddUsage(options.RootPath, extractedBytes, int64(len(extracted)))
+
+	log.Info().Str("filename", filename).Msg(fmt.Sprintf("Extracted %d files.\n", len(extracted)))
+	return UploadResult{
+		FileMetadata: FileMetadata{Name: filename, Type: fileType, Filename: filename},
+		Status:       UploadStatusOK,
+		Extracted:    extracted,
+	}
+}
+
+func uploadError(filename string, errCode string, message string) UploadResult {
+	fileErrors.Inc(errCode)
+	log.Error().Str("filename", filename).Str("error_code", errCode).Msg(message)
+	return UploadResult{
+		FileMetadata: FileMetadata{Name: filename, Type: fileType, Filename: filename},
+		Status:       UploadStatusError,
+		ErrorCode:    errCode,
+		Error:        message,
+	}
+}
+
+func failedPrecondition(results []UploadResult) bool {
+	return hasErrorCode(results, ErrCodePreconditionFailed)
+}
+
+func hasErrorCode(results []UploadResult, errCode string) bool {
+	for _, result := range results {
+		if result.ErrorCode == errCode {
+			return true
+		}
+	}
+	return false
+}
+
+func isMaxBytesError(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
@@ -0,0 +1,307 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrCodeVersionNotFound = "ERR_VERSION_NOT_FOUND"
+
+	// versionsDirName is the hidden directory at the top of a root holding prior versions of its files,
+	// .versions/a/b.csv/<id> is a version of a/b.csv
+	versionsDirName = ".versions"
+	// version ids are the UTC time the version was replaced, so they sort by age
+	versionIDLayout = "20060102T150405.000000000Z"
+)
+
+// FileVersion is a prior version of a file, LastModTime is the time its content was written
+// and VersionedTime the time it was replaced
+type FileVersion struct {
+	ID            string    `json:"id"`
+	Size          int64     `json:"size"`
+	LastModTime   time.Time `json:"last_modified_time"`
+	VersionedTime time.Time `json:"versioned_time"`
+}
+
+// MaxFileVersions is the number of prior versions kept of every file, 0 disables versioning
+var MaxFileVersions = util.GetConfig().FileVersionsMax
+
+var errVersionNotFound = errors.New("version not found")
+
+// isVersionsPath reports whether the slash separated path relative to a root is inside its version history
+func isVersionsPath(relativePath string) bool {
+	return relativePath == versionsDirName || strings.HasPrefix(relativePath, versionsDirName+"/")
+}
+
+// inVersions reports whether path is inside the version history of rootPath
+func inVersions(rootPath string, path string) bool {
+	relativePath, err := filepath.Rel(rootPath, path)
+	return err == nil && isVersionsPath(filepath.ToSlash(relativePath))
+}
+
+// isDataRoot reports whether path is the data directory or, with multiple tenants, a tenant root
+func isDataRoot(path string) bool {
+	path = filepath.Clean(path)
+	return path == filepath.Clean(dirPath) || util.GetConfig().MultiTenant && filepath.Dir(path) == filepath.Clean(dirPath)
+}
+
+// versionsPath is the directory holding the versions of path
+func versionsPath(rootPath string, path string) (string, error) {
+	relativePath, err := filepath.Rel(rootPath, path)
+	if err != nil || relativePath == "." || strings.HasPrefix(relativePath, "..") {
+		return "", fmt.Errorf("'%s' is not below the root", path)
+	}
+	return filepath.Join(rootPath, versionsDirName, relativePath), nil
+}
+
+// SaveVersion keeps the current content of path as a version before it is replaced and drops the oldest versions
+// beyond MaxFileVersions. The version is a hard link, so the file has to be replaced by a rename and not written in place.
+// Nothing is saved when versioning is disabled or path is not a regular file.
+func SaveVersion(rootPath string, path string) error {
+	if MaxFileVersions <= 0 {
+		return nil
+	}
+	fileInfo, err := os.Lstat(path)
+	if err != nil || !fileInfo.Mode().IsRegular() {
+		return nil
+	}
+
+	dir, err := versionsPath(rootPath, path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	versionPath := filepath.Join(dir, time.Now().UTC().Format(versionIDLayout))
+	if err := os.Link(path, versionPath); err != nil {
+		// not every file system supports hard links
+		if err := copyFile(path, versionPath); err != nil {
+			return err
+		}
+		os.Chtimes(versionPath, fileInfo.ModTime(), fileInfo.ModTime())
+	}
+	AddUsage(rootPath, fileInfo.Size(), 1)
+
+	versions, err := readVersions(dir)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions[min(MaxFileVersions, len(versions)):] {
+		if err := os.Remove(filepath.Join(dir, version.ID)); err == nil {
+			AddUsage(rootPath, -version.Size, -1)
+		}
+	}
+	return nil
+}
+
+// ListVersions returns the versions of path from the newest to the oldest, also when path itself was deleted
+func ListVersions(rootPath string, path string) ([]FileVersion, error) {
+	dir, err := versionsPath(rootPath, path)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := readVersions(dir)
+	if os.IsNotExist(err) {
+		return []FileVersion{}, nil
+	}
+	return versions, err
+}
+
+func readVersions(dir string) ([]FileVersion, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []FileVersion{}
+	for _, entry := range entries {
+		versionedTime, err := time.Parse(versionIDLayout, entry.Name())
+		if err != nil || !entry.Type().IsRegular() {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, FileVersion{
+			ID:            entry.Name(),
+			Size:          fileInfo.Size(),
+			LastModTime:   fileInfo.ModTime(),
+			VersionedTime: versionedTime,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID > versions[j].ID })
+	return versions, nil
+}
+
+// RestoreVersion replaces path with a copy of the version id, the replaced content becomes a version itself
+func RestoreVersion(rootPath string, path string, id string) error {
+	if _, err := time.Parse(versionIDLayout, id); err != nil {
+		return errVersionNotFound
+	}
+	dir, err := versionsPath(rootPath, path)
+	if err != nil {
+		return err
+	}
+	versionPath := filepath.Join(dir, id)
+	versionInfo, err := os.Lstat(versionPath)
+	if err != nil || !versionInfo.Mode().IsRegular() {
+		return errVersionNotFound
+	}
+
+	var currentBytes, currentFiles int64
+	if fileInfo, err := os.Lstat(path); err == nil {
+		if !fileInfo.Mode().IsRegular() {
+			return fmt.Errorf("'%s' is not a regular file", filepath.Base(path))
+		}
+		currentBytes, currentFiles = fileInfo.Size(), 1
+	}
+	if err := ReserveQuota(rootPath, versionInfo.Size()-currentBytes, 1-currentFiles); err != nil {
+		return err
+	}
+	restored := false
+	defer func() {
+		if !restored {
+			AddUsage(rootPath, currentBytes-versionInfo.Size(), currentFiles-1)
+		}
+	}()
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	version, err := os.Open(versionPath)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = io.Copy(tmp, version)
+	version.Close()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chtimes(tmp.Name(), versionInfo.ModTime(), versionInfo.ModTime())
+	if err := os.Chmod(tmp.Name(), 0777); err != nil {
+		return err
+	}
+	if err := ownPath(rootPath, tmp.Name()); err != nil {
+		return err
+	}
+
+	if err := SaveVersion(rootPath, path); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Unable to save file version")
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	restored = true
+	return nil
+}
+
+// ListVersionsHandler returns the versions of a file from the newest to the oldest
+func ListVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+
+	targetPath, err := ResolveTargetPath(rootPath, mux.Vars(r)["path"])
+	if err != nil || targetPath == rootPath {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid path")
+		return
+	}
+
+	versions, err := ListVersions(rootPath, targetPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read file versions")
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error reading file versions")
+		return
+	}
+
+	response, err := json.Marshal(versions)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to marshal response")
+		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
+		return
+	}
+	util.SendHTTPResponse(w, http.StatusOK, string(response), false)
+}
+
+// RestoreVersionHandler restores a version of a file and returns the metadata of the restored file
+func RestoreVersionHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+	version, ok := resolveAPIVersion(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	targetPath, err := ResolveTargetPath(rootPath, vars["path"])
+	if err != nil || targetPath == rootPath {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid path")
+		return
+	}
+	if fileInfo, err := os.Lstat(targetPath); err == nil && fileInfo.Mode()&os.ModeSymlink != 0 {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeSymlinkNotAllowed, "Symlinks not allowed")
+		return
+	}
+	if err := PreconditionsFromRequest(r).Check(targetPath); err != nil {
+		logAndRespond(w, http.StatusPreconditionFailed, ErrCodePreconditionFailed, err.Error())
+		return
+	}
+
+	if err := RestoreVersion(rootPath, targetPath, vars["id"]); err != nil {
+		var quotaError *QuotaExceededError
+		switch {
+		case err == errVersionNotFound:
+			logAndRespond(w, http.StatusNotFound, ErrCodeVersionNotFound, "Version not found")
+		case errors.As(err, &quotaError):
+			respondQuotaExceeded(w, err)
+		default:
+			log.Error().Err(err).Msg("Unable to restore file version")
+			logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error restoring file version")
+		}
+		return
+	}
+
+	log.Info().Msg(fmt.Sprintf("Restored version %s of %s.\n", vars["id"], targetPath))
+	respondWithMetadata(w, http.StatusOK, rootPath, targetPath, version)
+}
@@ -0,0 +1,345 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ErrCodeWatchUnsupported = "ERR_WATCH_UNSUPPORTED"
+
+	FileEventCreated  = "created"
+	FileEventModified = "modified"
+	FileEventDeleted  = "deleted"
+	// FileEventOverflow means events were dropped, clients have to list the directory again
+	FileEventOverflow = "overflow"
+
+	defaultWatchDebounce = 250 * time.Millisecond
+	maxWatchDebounce     = 10 * time.Second
+	watchHeartbeat       = 15 * time.Second
+	watchRetryMillis     = 3000
+)
+
+// FileEvent is one debounced change below the watched directory. Name is relative to the watched directory
+// like in listings, deleted entries only have their name, path and type.
+type FileEvent struct {
+	Event string `json:"event"`
+	FileMetadata
+}
+
+// WatchOptions are the query parameters of GET /files/watch
+type WatchOptions struct {
+	// directory to watch relative to the root
+	Path      string
+	Glob      string
+	Recursive bool
+	// changes of one path are reported once it was quiet for Debounce
+	Debounce time.Duration
+}
+
+// errWatchUnsupported is returned where file system notifications are not available
+var errWatchUnsupported = errors.New("file change notifications are only supported on linux")
+
+// watchOp is a raw change reported by the platform watcher
+type watchOp int
+
+const (
+	watchCreated watchOp = iota + 1
+	watchModified
+	watchDeleted
+)
+
+type watchEvent struct {
+	path     string
+	op       watchOp
+	isDir    bool
+	overflow bool
+}
+
+type pendingChange struct {
+	op    watchOp
+	isDir bool
+	first time.Time
+	last  time.Time
+}
+
+// ParseWatchOptions reads path, glob, recursive and debounce
+func ParseWatchOptions(query url.Values) (WatchOptions, error) {
+	options := WatchOptions{
+		Path:      query.Get("path"),
+		Glob:      query.Get("glob"),
+		Recursive: true,
+		Debounce:  defaultWatchDebounce,
+	}
+
+	if recursive := query.Get("recursive"); recursive != "" {
+		value, err := strconv.ParseBool(recursive)
+		if err != nil {
+			return options, fmt.Errorf("invalid recursive value '%s'", recursive)
+		}
+		options.Recursive = value
+	}
+
+	if options.Glob != "" {
+		if _, err := filepath.Match(options.Glob, ""); err != nil {
+			return options, fmt.Errorf("invalid glob '%s'", options.Glob)
+		}
+	}
+
+	if debounce := query.Get("debounce"); debounce != "" {
+		value, err := time.ParseDuration(debounce)
+		if err != nil || value < 0 || value > maxWatchDebounce {
+			return options, fmt.Errorf("invalid debounce '%s', expected a duration up to %s", debounce, maxWatchDebounce)
+		}
+		options.Debounce = value
+	}
+	return options, nil
+}
+
+// WatchFiles reports the files created, modified and deleted below targetPath until ctx is done.
+// Events of one path are merged until it was quiet for the debounce interval, so a file written
+// in many chunks is reported once. Symlinks and temporary upload files are never reported.
+func WatchFiles(ctx context.Context, rootPath string, targetPath string, options WatchOptions) (<-chan FileEvent, error) {
+	watcher, err := newFileWatcher(rootPath, targetPath, options.Recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan FileEvent, 64)
+	go func() {
+		defer close(events)
+		defer watcher.Close()
+
+		tick := max(options.Debounce/2, 10*time.Millisecond)
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+
+		// a path written without pause is still reported from time to time
+		maxDelay := max(5*options.Debounce, time.Second)
+		pending := map[string]*pendingChange{}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events():
+				if !ok {
+					return
+				}
+				if event.overflow {
+					pending = map[string]*pendingChange{}
+					if !sendFileEvent(ctx, events, FileEvent{Event: FileEventOverflow}) {
+						return
+					}
+					continue
+				}
+				if !watchMatches(targetPath, event.path, options.Glob) || inVersions(rootPath, event.path) {
+					continue
+				}
+				mergeChange(pending, event, time.Now())
+			case now := <-ticker.C:
+				for path, change := range pending {
+					if now.Sub(change.last) < options.Debounce && now.Sub(change.first) < maxDelay {
+						continue
+					}
+					delete(pending, path)
+					if event, ok := newFileEvent(rootPath, targetPath, path, change); ok {
+						if !sendFileEvent(ctx, events, event) {
+							return
+						}
+					}
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// mergeChange folds a raw event into the pending change of its path, e.g. a file created and deleted
+// before the debounce interval passed is not reported at all
+func mergeChange(pending map[string]*pendingChange, event watchEvent, now time.Time) {
+	change, ok := pending[event.path]
+	if !ok {
+		pending[event.path] = &pendingChange{op: event.op, isDir: event.isDir, first: now, last: now}
+		return
+	}
+
+	change.last = now
+	change.isDir = event.isDir
+	switch {
+	case change.op == watchCreated && event.op == watchDeleted:
+		delete(pending, event.path)
+	case change.op == watchCreated:
+	case change.op == watchDeleted && event.op == watchCreated:
+		// replaced, e.g. by an upload renaming its temporary file into place
+		change.op = watchModified
+	case change.op == watchModified:
+		if event.op == watchDeleted {
+			change.op = watchDeleted
+		}
+	}
+}
+
+func watchMatches(targetPath string, path string, glob string) bool {
+	relativePath, err := filepath.Rel(targetPath, path)
+	if err != nil || strings.HasPrefix(relativePath, "..") {
+		return false
+	}
+	for _, segment := range strings.Split(relativePath, string(filepath.Separator)) {
+		if isTransientName(segment) {
+			return false
+		}
+	}
+	if glob != "" {
+		if matched, _ := filepath.Match(glob, filepath.Base(path)); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// newFileEvent reads the metadata of a changed path, a path that vanished in the meantime is reported as deleted
+func newFileEvent(rootPath string, targetPath string, path string, change *pendingChange) (FileEvent, bool) {
+	relativePath, _ := filepath.Rel(targetPath, path)
+	name := filepath.ToSlash(relativePath)
+
+	if change.op != watchDeleted {
+		fileInfo, err := os.Lstat(path)
+		switch {
+		case err == nil && fileInfo.Mode()&os.ModeSymlink != 0:
+			return FileEvent{}, false
+		case err == nil:
+			event := FileEventModified
+			if change.op == watchCreated {
+				event = FileEventCreated
+			}
+			return FileEvent{Event: event, FileMetadata: describeFile(rootPath, path, newFileMetadata(name, fileInfo), MetadataOptions{})}, true
+		case change.op == watchCreated:
+			return FileEvent{}, false
+		}
+	}
+
+	metadata := FileMetadata{Name: name, Type: fileType, Filename: name}
+	metadata.MIMEType = mimeTypeOrDefault(mime.TypeByExtension(filepath.Ext(name)))
+	if change.isDir {
+		metadata.Type, metadata.MIMEType = dirType, dirMIMEType
+	}
+	metadata.ContentType = metadata.MIMEType
+	if relativeToRoot, err := filepath.Rel(rootPath, path); err == nil {
+		metadata.Path = filepath.ToSlash(relativeToRoot)
+	}
+	return FileEvent{Event: FileEventDeleted, FileMetadata: metadata}, true
+}
+
+func sendFileEvent(ctx context.Context, events chan<- FileEvent, event FileEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// WatchFilesHandler streams file events of the caller's root as server-sent events until the client disconnects.
+// Every event is named after its change and carries the FileMetadata of the listing endpoints as data.
+func WatchFilesHandler(w http.ResponseWriter, r *http.Request) {
+	rootPath, ok := resolveRootPath(w, r)
+	if !ok {
+		return
+	}
+	version, ok := resolveAPIVersion(w, r)
+	if !ok {
+		return
+	}
+
+	options, err := ParseWatchOptions(r.URL.Query())
+	if err != nil {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+	targetPath, err := ResolveTargetPath(rootPath, options.Path)
+	if err != nil {
+		logAndRespond(w, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid path")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logAndRespond(w, http.StatusInternalServerError, ErrCodeWatchUnsupported, "Streaming is not supported")
+		return
+	}
+
+	events, err := WatchFiles(r.Context(), rootPath, targetPath, options)
+	if err != nil {
+		switch {
+		case err == errWatchUnsupported:
+			logAndRespond(w, http.StatusNotImplemented, ErrCodeWatchUnsupported, err.Error())
+		case os.IsNotExist(err):
+			logAndRespond(w, http.StatusNotFound, ErrCodeDirNotFound, "File path not found")
+		default:
+			log.Error().Err(err).Msg("Unable to watch directory")
+			logAndRespond(w, http.StatusInternalServerError, ErrCodeFileAccess, "Error watching directory")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// keeps reverse proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", watchRetryMillis)
+	flusher.Flush()
+	log.Info().Str("path", targetPath).Msg("File watch started")
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	var id int64
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				log.Info().Str("path", targetPath).Msg("File watch ended")
+				return
+			}
+			event.FileMetadata = event.FileMetadata.ForAPIVersion(version)
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Error().Err(err).Msg("Unable to marshal file event")
+				continue
+			}
+			id++
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event.Event, data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
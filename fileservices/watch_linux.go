@@ -0,0 +1,225 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package fileservices
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_MODIFY | unix.IN_CLOSE_WRITE |
+	unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_EXCL_UNLINK | unix.IN_ONLYDIR
+
+// fileWatcher watches a directory tree with inotify, new directories are watched as they appear
+type fileWatcher struct {
+	file      *os.File
+	fd        int
+	rootPath  string
+	recursive bool
+	events    chan watchEvent
+	done      chan struct{}
+	closeOnce sync.Once
+
+	lock    sync.Mutex
+	watches map[int]string
+	// entries below the watched directories, a rename over one of them replaces it
+	known map[string]bool
+}
+
+func newFileWatcher(rootPath string, targetPath string, recursive bool) (*fileWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	watcher := &fileWatcher{
+		// a non-blocking descriptor is served by the runtime poller, so Close interrupts a pending Read
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		fd:        fd,
+		rootPath:  rootPath,
+		recursive: recursive,
+		events:    make(chan watchEvent, 256),
+		done:      make(chan struct{}),
+		watches:   map[int]string{},
+		known:     map[string]bool{},
+	}
+
+	// only the target has to exist, directories below it that can not be watched are skipped
+	if _, err := unix.InotifyAddWatch(fd, targetPath, watchMask); err != nil {
+		watcher.file.Close()
+		return nil, &os.PathError{Op: "inotify_add_watch", Path: targetPath, Err: err}
+	}
+	watcher.addTree(targetPath, false)
+
+	go watcher.readEvents()
+	return watcher, nil
+}
+
+func (w *fileWatcher) Events() <-chan watchEvent {
+	return w.events
+}
+
+func (w *fileWatcher) Close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.file.Close()
+	})
+}
+
+// addTree watches dir and, when recursive, the directories below it whose entries a listing would show.
+// Entries of a directory that appeared while watching are reported as created, they may have been written before its watch existed.
+func (w *fileWatcher) addTree(dir string, report bool) {
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != dir {
+			if entry.Type()&os.ModeSymlink != 0 || isTransientName(entry.Name()) || inVersions(w.rootPath, path) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			w.lock.Lock()
+			w.known[path] = true
+			w.lock.Unlock()
+			if report && !w.send(watchEvent{path: path, op: watchCreated, isDir: entry.IsDir()}) {
+				return filepath.SkipAll
+			}
+			if !entry.IsDir() {
+				return nil
+			}
+			if pathDepth(w.rootPath, path) >= dirPathMaxDepth {
+				return filepath.SkipDir
+			}
+		}
+
+		wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("Unable to watch directory")
+			return filepath.SkipDir
+		}
+		w.lock.Lock()
+		w.watches[wd] = path
+		w.lock.Unlock()
+
+		if !w.recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// removeTree stops watching a directory that was moved away, its old path is no longer valid
+func (w *fileWatcher) removeTree(dir string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for wd, path := range w.watches {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+	for path := range w.known {
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			delete(w.known, path)
+		}
+	}
+}
+
+func (w *fileWatcher) send(event watchEvent) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *fileWatcher) readEvents() {
+	defer close(w.events)
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buffer)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameBytes := buffer[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(raw.Len)]
+			offset += unix.SizeofInotifyEvent + int(raw.Len)
+			if !w.handle(raw, strings.TrimRight(string(nameBytes), "\x00")) {
+				return
+			}
+		}
+	}
+}
+
+func (w *fileWatcher) handle(raw *unix.InotifyEvent, name string) bool {
+	if raw.Mask&unix.IN_Q_OVERFLOW != 0 {
+		return w.send(watchEvent{overflow: true})
+	}
+
+	w.lock.Lock()
+	dir, ok := w.watches[int(raw.Wd)]
+	if raw.Mask&unix.IN_IGNORED != 0 {
+		delete(w.watches, int(raw.Wd))
+	}
+	w.lock.Unlock()
+	// events of the watched directory itself are reported by its parent
+	if !ok || name == "" {
+		return true
+	}
+
+	event := watchEvent{path: filepath.Join(dir, name), isDir: raw.Mask&unix.IN_ISDIR != 0}
+	w.lock.Lock()
+	switch {
+	case raw.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		event.op = watchCreated
+		if w.known[event.path] {
+			event.op = watchModified
+		}
+		w.known[event.path] = true
+	case raw.Mask&(unix.IN_MODIFY|unix.IN_CLOSE_WRITE) != 0:
+		event.op = watchModified
+	case raw.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		event.op = watchDeleted
+		delete(w.known, event.path)
+	}
+	w.lock.Unlock()
+	if event.op == 0 {
+		return true
+	}
+	if !w.send(event) {
+		return false
+	}
+
+	if event.isDir && event.op == watchCreated && w.recursive && pathDepth(w.rootPath, event.path) < dirPathMaxDepth && !isTransientName(name) {
+		w.addTree(event.path, true)
+	}
+	if event.isDir && event.op == watchDeleted && raw.Mask&unix.IN_MOVED_FROM != 0 {
+		w.removeTree(event.path)
+	}
+	return true
+}
@@ -0,0 +1,290 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileservices
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	xlsxMIMEType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	// uncompressed bytes read from a part of the workbook, a zip entry can expand far beyond its size
+	xlsxMaxPartBytes = 64 << 20
+	// cells right of this column are left out of the preview
+	xlsxMaxColumns = 256
+	// the first sheet when the workbook does not say which part holds it
+	xlsxDefaultSheet = "xl/worksheets/sheet1.xml"
+)
+
+// xlsxCell is a cell of a sheet as stored, shared strings are resolved once the previewed rows are known
+type xlsxCell struct {
+	Ref        string   `xml:"r,attr"`
+	Type       string   `xml:"t,attr"`
+	Value      string   `xml:"v"`
+	Inline     string   `xml:"is>t"`
+	InlineRuns []string `xml:"is>r>t"`
+}
+
+// xlsxText is a shared string, either plain or made of formatted runs
+type xlsxText struct {
+	Text string   `xml:"t"`
+	Runs []string `xml:"r>t"`
+}
+
+func (t xlsxText) String() string {
+	return t.Text + strings.Join(t.Runs, "")
+}
+
+// previewXLSX previews the first sheet of a workbook like a CSV file, its first row names the columns.
+// Cells are shown as stored, dates are the serial numbers excel keeps them as.
+func previewXLSX(path string, preview *Preview, options PreviewOptions) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	parts := map[string]*zip.File{}
+	for _, file := range archive.File {
+		parts[file.Name] = file
+	}
+	sheet, ok := parts[xlsxFirstSheet(parts)]
+	if !ok {
+		return errors.New("workbook has no sheet")
+	}
+
+	// the header and the shown rows
+	cells, truncated, err := readXLSXRows(sheet, options.Limit+1)
+	if err != nil {
+		return err
+	}
+
+	needed := map[int]bool{}
+	for _, row := range cells {
+		for _, cell := range row {
+			if cell.Type == "s" {
+				if index, ok := parseXLSXIndex(cell.Value); ok {
+					needed[index] = true
+				}
+			}
+		}
+	}
+	sharedStrings, err := readXLSXSharedStrings(parts["xl/sharedStrings.xml"], needed)
+	if err != nil {
+		return err
+	}
+
+	if len(cells) == 0 {
+		preview.Columns, preview.Rows = []PreviewColumn{}, [][]interface{}{}
+		return nil
+	}
+	rows := make([][]string, len(cells))
+	for i, row := range cells {
+		for column, cell := range row {
+			if column < 0 {
+				continue
+			}
+			for len(rows[i]) <= column {
+				rows[i] = append(rows[i], "")
+			}
+			rows[i][column] = xlsxCellText(cell, sharedStrings)
+		}
+	}
+	preview.Truncated = truncated
+	setPreviewTable(preview, rows[0], rows[1:])
+	return nil
+}
+
+// xlsxFirstSheet returns the part of the first sheet listed by the workbook
+func xlsxFirstSheet(parts map[string]*zip.File) string {
+	var workbook struct {
+		Sheets []struct {
+			ID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	var relationships struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if decodeXLSXPart(parts["xl/workbook.xml"], &workbook) != nil || len(workbook.Sheets) == 0 ||
+		decodeXLSXPart(parts["xl/_rels/workbook.xml.rels"], &relationships) != nil {
+		return xlsxDefaultSheet
+	}
+	for _, relationship := range relationships.Relationships {
+		if relationship.ID == workbook.Sheets[0].ID {
+			if strings.HasPrefix(relationship.Target, "/") {
+				return strings.TrimPrefix(relationship.Target, "/")
+			}
+			return path.Join("xl", relationship.Target)
+		}
+	}
+	return xlsxDefaultSheet
+}
+
+func decodeXLSXPart(file *zip.File, value interface{}) error {
+	if file == nil {
+		return errors.New("missing workbook part")
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return xml.NewDecoder(io.LimitReader(reader, xlsxMaxPartBytes)).Decode(value)
+}
+
+// readXLSXRows reads up to maxRows rows of a sheet as cells keyed by their column.
+// It reports whether the sheet has more rows or cells right of xlsxMaxColumns, which are left out.
+func readXLSXRows(file *zip.File, maxRows int) ([]map[int]xlsxCell, bool, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	decoder := xml.NewDecoder(io.LimitReader(reader, xlsxMaxPartBytes))
+	var rows []map[int]xlsxCell
+	truncated := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return rows, truncated, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "row":
+				if len(rows) == maxRows {
+					return rows, true, nil
+				}
+				rows = append(rows, map[int]xlsxCell{})
+			case "c":
+				var cell xlsxCell
+				if err := decoder.DecodeElement(&cell, &element); err != nil {
+					return nil, false, err
+				}
+				if len(rows) == 0 {
+					continue
+				}
+				row := rows[len(rows)-1]
+				column := len(row)
+				if cell.Ref != "" {
+					column = xlsxColumn(cell.Ref)
+				}
+				if column >= xlsxMaxColumns {
+					truncated = true
+					continue
+				}
+				row[column] = cell
+			}
+		case xml.EndElement:
+			if element.Name.Local == "sheetData" {
+				return rows, truncated, nil
+			}
+		}
+	}
+}
+
+// readXLSXSharedStrings reads the shared strings at the needed indexes, the others are skipped
+func readXLSXSharedStrings(file *zip.File, needed map[int]bool) (map[int]string, error) {
+	sharedStrings := map[int]string{}
+	if file == nil || len(needed) == 0 {
+		return sharedStrings, nil
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decoder := xml.NewDecoder(io.LimitReader(reader, xlsxMaxPartBytes))
+	index := 0
+	for len(sharedStrings) < len(needed) {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok || element.Name.Local != "si" {
+			continue
+		}
+		if needed[index] {
+			var text xlsxText
+			if err := decoder.DecodeElement(&text, &element); err != nil {
+				return nil, err
+			}
+			sharedStrings[index] = text.String()
+		} else if err := decoder.Skip(); err != nil {
+			return nil, err
+		}
+		index++
+	}
+	return sharedStrings, nil
+}
+
+func xlsxCellText(cell xlsxCell, sharedStrings map[int]string) string {
+	switch cell.Type {
+	case "s":
+		index, _ := parseXLSXIndex(cell.Value)
+		return sharedStrings[index]
+	case "inlineStr":
+		return cell.Inline + strings.Join(cell.InlineRuns, "")
+	case "b":
+		if cell.Value == "1" {
+			return "true"
+		}
+		return "false"
+	}
+	return cell.Value
+}
+
+// xlsxColumn returns the zero based column of a cell reference like AB12, -1 when it has no column
+func xlsxColumn(ref string) int {
+	column := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		column = column*26 + int(r-'A') + 1
+		if column > xlsxMaxColumns {
+			return xlsxMaxColumns
+		}
+	}
+	return column - 1
+}
+
+func parseXLSXIndex(value string) (int, bool) {
+	index := 0
+	for _, r := range strings.TrimSpace(value) {
+		if r < '0' || r > '9' || index > 1<<24 {
+			return 0, false
+		}
+		index = index*10 + int(r-'0')
+	}
+	return index, value != ""
+}
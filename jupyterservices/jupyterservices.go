@@ -17,12 +17,17 @@ package jupyterservices
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
 )
 
 // define kernel and session
@@ -43,40 +48,67 @@ type Session struct {
 	Notebook Notebook `json:"notebook"`
 }
 
+// APIStatus is the reply of the Jupyter status endpoint
+type APIStatus struct {
+	Started      time.Time `json:"started"`
+	LastActivity time.Time `json:"last_activity"`
+	Connections  int       `json:"connections"`
+	Kernels      int       `json:"kernels"`
+}
+
 type Notebook struct {
 	Path string `json:"path"`
 	Name string `json:"name"`
 }
 
-const (
-	jupyterURL = "http://localhost:8888"
-	Timeout    = 60 * time.Second
+var (
+	jupyterURL = strings.TrimSuffix(util.GetConfig().JupyterURL, "/")
+	// Timeout is how long an execution may run before it is reported as timed out
+	Timeout = util.GetConfig().ExecutionTimeout
 )
 
 var Token = ""
 
-// check if there are any available kernels running and if so create a new session
-// return the kernelId and sessionId
-func CheckKernels(kernelId string) (string, string, error) {
-	fmt.Println("Checking for available kernels... with token: ", Token)
-
-	url := fmt.Sprintf("%s/api/kernels?token=%s", jupyterURL, Token)
-	client := util.HTTPClient()
-	response, err := client.Get(url)
-	if err != nil {
-		return "", "", fmt.Errorf("error getting kernels: %v", err)
+// KernelChannelsURL is the websocket URL of the channels of a kernel on the Jupyter server
+func KernelChannelsURL(kernelID string) string {
+	u, _ := url.Parse(jupyterURL)
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
 	}
+	u.Path += "/api/kernels/" + kernelID + "/channels"
+	return u.String()
+}
 
-	defer response.Body.Close()
-	body, err := io.ReadAll(response.Body)
+// AuthHeader authenticates requests to the Jupyter server. The token is never put in URLs,
+// they end up in errors and logs.
+func AuthHeader() http.Header {
+	return http.Header{"Authorization": {"token " + Token}}
+}
+
+// jupyterRequest calls path of the Jupyter REST API with the token in AuthHeader
+func jupyterRequest(client *http.Client, method string, path string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, jupyterURL+path, body)
 	if err != nil {
-		return "", "", fmt.Errorf("error reading response body: %v", err)
+		return nil, err
+	}
+	request.Header = AuthHeader()
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
 	}
+	return client.Do(request)
+}
+
+// check if there are any available kernels running and if so create a new session
+// return the kernelId and sessionId
+func CheckKernels(kernelId string) (string, string, error) {
+	fmt.Println("Checking for available kernels...")
 
-	var kernels []Kernel
-	err = json.Unmarshal(body, &kernels)
+	client := util.HTTPClient()
+	kernels, err := ListKernels()
 	if err != nil {
-		return "", "", fmt.Errorf("error unmarshaling JSON: %v", err)
+		return "", "", err
 	}
 
 	fmt.Println(kernels)
@@ -90,7 +122,7 @@ func CheckKernels(kernelId string) (string, string, error) {
 			return "", "", fmt.Errorf("error getting sessions: %v", err)
 		}
 
-		// return the first session or the session related to the passed kernelId
+		// return the first untenanted session or the session related to the passed kernelId
 		if len(sessions) > 0 {
 			if kernelId != "" {
 				for _, session := range sessions {
@@ -103,16 +135,24 @@ func CheckKernels(kernelId string) (string, string, error) {
 					}
 				}
 			} else {
-				sessionId = sessions[0].ID
-				kernelId = sessions[0].Kernel.ID
+				// sessions of tenants run as the tenant, the untenanted callers and the health probe never use them
+				for _, session := range sessions {
+					if !strings.HasPrefix(session.Path, tenantSessionPath("")) {
+						sessionId = session.ID
+						kernelId = session.Kernel.ID
+						break
+					}
+				}
 			}
 		}
-	} else {
-		newSession, err := createSession()
+	}
+	if len(kernels) == 0 || kernelId == "" {
+		newSession, err := createSession("")
 		if err != nil {
 			return "", "", fmt.Errorf("error creating new session: %v", err)
 		}
 		fmt.Printf("Session ID: %s\n", newSession.ID)
+		runSessionStartHooks("")
 		sessionId = newSession.ID
 		kernelId = newSession.Kernel.ID
 	}
@@ -124,8 +164,7 @@ func CheckKernels(kernelId string) (string, string, error) {
 func getSessions(client *http.Client) ([]Session, error) {
 	fmt.Println("Listing available sessions:")
 
-	url := fmt.Sprintf("%s/api/sessions?token=%s", jupyterURL, Token)
-	response, err := client.Get(url)
+	response, err := jupyterRequest(client, http.MethodGet, "/api/sessions", nil)
 	if err != nil {
 		return nil, fmt.Errorf("error getting sessions: %v", err)
 	}
@@ -147,14 +186,72 @@ func getSessions(client *http.Client) ([]Session, error) {
 	return sessions, nil
 }
 
-func createSession() (*Session, error) {
+// CheckTenantKernel returns the kernelId and sessionId of the tenant's own session, creating it if needed.
+// Jupyter keys sessions by path, so every tenant gets a session and kernel under tenants/<tenant>.
+func CheckTenantKernel(tenant string) (string, string, error) {
+	sessions, err := getSessions(util.HTTPClient())
+	if err != nil {
+		return "", "", fmt.Errorf("error getting sessions: %v", err)
+	}
+
+	path := tenantSessionPath(tenant)
+	for _, session := range sessions {
+		if session.Path == path {
+			return session.Kernel.ID, session.ID, nil
+		}
+	}
+
+	newSession, err := createSession(path)
+	if err != nil {
+		return "", "", fmt.Errorf("error creating new session: %v", err)
+	}
+	log.Debug().Str("session_id", newSession.ID).Str("tenant", tenant).Msg("Created tenant session")
+	runSessionStartHooks(tenant)
+	return newSession.Kernel.ID, newSession.ID, nil
+}
+
+// SessionStartHook prepares the files of tenant, "" without multi tenancy, before its new session runs code
+type SessionStartHook func(tenant string)
+
+var (
+	sessionHooksLock  sync.RWMutex
+	sessionStartHooks []SessionStartHook
+)
+
+// RegisterSessionStartHook adds a hook that runs whenever a session is created
+func RegisterSessionStartHook(hook SessionStartHook) {
+	sessionHooksLock.Lock()
+	defer sessionHooksLock.Unlock()
+	sessionStartHooks = append(sessionStartHooks, hook)
+}
+
+func runSessionStartHooks(tenant string) {
+	sessionHooksLock.RLock()
+	defer sessionHooksLock.RUnlock()
+	for _, hook := range sessionStartHooks {
+		hook(tenant)
+	}
+}
+
+func tenantSessionPath(tenant string) string {
+	return "tenants/" + tenant
+}
+
+func createSession(path string) (*Session, error) {
 	fmt.Println("Creating a new session...")
 
 	// payload for POST request to create session as io.Reader value
-	payload := bytes.NewBuffer([]byte(`{"path": "", "type": "notebook", "kernel": {"name": "python3"}}`))
+	sessionRequest, err := json.Marshal(map[string]interface{}{
+		"path":   path,
+		"type":   "notebook",
+		"kernel": map[string]string{"name": "python3"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling session: %v", err)
+	}
+	payload := bytes.NewBuffer(sessionRequest)
 
-	url := fmt.Sprintf("%s/api/sessions?token=%s", jupyterURL, Token)
-	response, err := http.Post(url, "application/json", payload)
+	response, err := jupyterRequest(http.DefaultClient, http.MethodPost, "/api/sessions", payload)
 	if err != nil {
 		return nil, fmt.Errorf("error creating session: %v", err)
 	}
@@ -173,3 +270,64 @@ func createSession() (*Session, error) {
 
 	return sessionInfo, nil
 }
+
+// InterruptKernel stops the cell the kernel is running, the kernel and its state are kept
+func InterruptKernel(kernelId string) error {
+	response, err := jupyterRequest(util.HTTPClient(), http.MethodPost, "/api/kernels/"+kernelId+"/interrupt", nil)
+	if err != nil {
+		return fmt.Errorf("error interrupting kernel: %v", err)
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("error interrupting kernel: status %d: %s", response.StatusCode, string(body))
+	}
+	return nil
+}
+
+// ShutdownSessions deletes every session, which also shuts down their kernels
+func ShutdownSessions() error {
+	client := util.HTTPClient()
+	sessions, err := getSessions(client)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, session := range sessions {
+		response, err := jupyterRequest(client, http.MethodDelete, "/api/sessions/"+session.ID, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error deleting session %s: %v", session.ID, err))
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+			errs = append(errs, fmt.Errorf("error deleting session %s: status %d", session.ID, response.StatusCode))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetAPIStatus asks the Jupyter server for its status, which fails when it is down
+func GetAPIStatus() (APIStatus, error) {
+	response, err := jupyterRequest(util.HTTPClient(), http.MethodGet, "/api/status", nil)
+	if err != nil {
+		return APIStatus{}, fmt.Errorf("error getting status: %v", err)
+	}
+
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return APIStatus{}, fmt.Errorf("error reading response body: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return APIStatus{}, fmt.Errorf("error getting status: status %d: %s", response.StatusCode, string(body))
+	}
+
+	var status APIStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return APIStatus{}, fmt.Errorf("error unmarshaling JSON: %v", err)
+	}
+	return status, nil
+}
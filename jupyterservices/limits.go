@@ -0,0 +1,125 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jupyterservices
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/microsoft/jupyterpython/metrics"
+	"github.com/microsoft/jupyterpython/util"
+)
+
+// optional per-kernel resource limits, a zero value means no limit
+type KernelLimits struct {
+	MaxRSSBytes          int64
+	MaxAddressSpaceBytes uint64
+	MaxCPUSecondsCell    int64
+	MaxCPUSeconds        uint64
+	MaxOpenFiles         uint64
+}
+
+// LimitViolation describes which limit a kernel went over
+type LimitViolation struct {
+	Limit    string
+	Observed int64
+	Allowed  int64
+}
+
+const (
+	LimitMemory    = "memory"
+	LimitCPU       = "cpu"
+	LimitOpenFiles = "open_files"
+	// LimitAddressSpace has no observed value, the allocation going over it fails
+	LimitAddressSpace = "address_space"
+)
+
+func (v *LimitViolation) Error() string {
+	switch v.Limit {
+	case LimitMemory:
+		return fmt.Sprintf("kernel memory usage %d bytes exceeded the limit of %d bytes", v.Observed, v.Allowed)
+	case LimitCPU:
+		return fmt.Sprintf("cell cpu time %d ms exceeded the limit of %d ms", v.Observed, v.Allowed)
+	case LimitAddressSpace:
+		return fmt.Sprintf("kernel memory allocation exceeded the address space limit of %d bytes", v.Allowed)
+	case LimitOpenFiles:
+		return fmt.Sprintf("kernel exceeded the limit of %d open files", v.Allowed)
+	default:
+		return fmt.Sprintf("kernel exceeded the %s limit of %d", v.Limit, v.Allowed)
+	}
+}
+
+// GetKernelLimits returns the limits configured through the environment
+func GetKernelLimits() KernelLimits {
+	cfg := util.GetConfig()
+	return KernelLimits{
+		MaxRSSBytes:          cfg.KernelMaxRSSBytes,
+		MaxAddressSpaceBytes: cfg.KernelMaxAddressSpaceBytes,
+		MaxCPUSecondsCell:    cfg.KernelMaxCPUSecondsPerCell,
+		MaxCPUSeconds:        cfg.KernelMaxCPUSeconds,
+		MaxOpenFiles:         cfg.KernelMaxOpenFiles,
+	}
+}
+
+// Check returns the first limit that rss or the cell's cpu time goes over, or nil.
+// The rlimits set on the kernel surface as python errors instead, see CheckError.
+func (l KernelLimits) Check(rssBytes int64, cellCPUMilliseconds int64) *LimitViolation {
+	if l.MaxRSSBytes > 0 && rssBytes > l.MaxRSSBytes {
+		return &LimitViolation{Limit: LimitMemory, Observed: rssBytes, Allowed: l.MaxRSSBytes}
+	}
+	if l.MaxCPUSecondsCell > 0 && cellCPUMilliseconds > l.MaxCPUSecondsCell*1000 {
+		return &LimitViolation{Limit: LimitCPU, Observed: cellCPUMilliseconds, Allowed: l.MaxCPUSecondsCell * 1000}
+	}
+	return nil
+}
+
+// CheckError returns the limit behind the python error a cell failed with, or nil. RLIMIT_NOFILE fails
+// opening files with EMFILE and RLIMIT_AS fails allocations with a MemoryError.
+func (l KernelLimits) CheckError(errorName string, errorMessage string) *LimitViolation {
+	if l.MaxOpenFiles > 0 && strings.Contains(errorMessage, "[Errno 24]") {
+		return &LimitViolation{Limit: LimitOpenFiles, Allowed: int64(l.MaxOpenFiles)}
+	}
+	if l.MaxAddressSpaceBytes > 0 && errorName == "MemoryError" {
+		return &LimitViolation{Limit: LimitAddressSpace, Allowed: int64(l.MaxAddressSpaceBytes)}
+	}
+	return nil
+}
+
+var kernelRestarts = metrics.NewCounter("jupyterpython_kernel_restarts_total", "Kernels restarted by the server.")
+
+// RestartKernel asks Jupyter to restart the kernel, which frees all of its memory
+func RestartKernel(kernelId string) error {
+	response, err := jupyterRequest(util.HTTPClient(), http.MethodPost, "/api/kernels/"+kernelId+"/restart", nil)
+	if err != nil {
+		return fmt.Errorf("error restarting kernel: %v", err)
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("error restarting kernel: status %d: %s", response.StatusCode, string(body))
+	}
+
+	kernelRestarts.Inc()
+
+	// the restarted kernel gets a new process
+	resourceLock.Lock()
+	delete(kernelPids, kernelId)
+	delete(resourceUsage, kernelId)
+	resourceLock.Unlock()
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package jupyterservices
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// applyKernelRlimits caps the open files, the address space and the cpu time of the kernel process, children
+// started by the kernel inherit all three. RLIMIT_CPU counts the cpu time over the whole life of the process,
+// so it is a fixed cap per kernel and the cpu time of a cell is left to the sampler. Limits are only ever
+// lowered, raising a hard limit needs privileges the server may not have.
+func applyKernelRlimits(pid int, limits KernelLimits) error {
+	if err := setRlimit(pid, unix.RLIMIT_NOFILE, "open files", limits.MaxOpenFiles); err != nil {
+		return err
+	}
+	if err := setRlimit(pid, unix.RLIMIT_AS, "address space", limits.MaxAddressSpaceBytes); err != nil {
+		return err
+	}
+	return setRlimit(pid, unix.RLIMIT_CPU, "cpu time", limits.MaxCPUSeconds)
+}
+
+// setRlimit lowers the soft and hard limit of resource of pid to value, a zero value leaves the limit alone
+func setRlimit(pid int, resource int, name string, value uint64) error {
+	if value == 0 {
+		return nil
+	}
+
+	var current unix.Rlimit
+	if err := unix.Prlimit(pid, resource, nil, &current); err != nil {
+		return fmt.Errorf("error reading %s limit of %d: %v", name, pid, err)
+	}
+	limit := unix.Rlimit{Cur: min(current.Cur, value), Max: min(current.Max, value)}
+	if limit == current {
+		return nil
+	}
+	if err := unix.Prlimit(pid, resource, &limit, nil); err != nil {
+		return fmt.Errorf("error setting %s limit of %d: %v", name, pid, err)
+	}
+	return nil
+}
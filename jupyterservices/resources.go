@@ -0,0 +1,452 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jupyterservices
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/microsoft/jupyterpython/auth"
+	"github.com/microsoft/jupyterpython/util"
+	"github.com/rs/zerolog/log"
+)
+
+// resource usage of a kernel process and all of its children
+type KernelResourceUsage struct {
+	KernelID            string    `json:"kernelId"`
+	Pid                 int       `json:"pid"`
+	CurrentRSSBytes     int64     `json:"currentRssBytes"`
+	PeakRSSBytes        int64     `json:"peakRssBytes"`
+	CPUTimeMilliseconds int64     `json:"cpuTimeMilliseconds"`
+	LastSampled         time.Time `json:"lastSampled"`
+}
+
+// single reading of a process tree taken from /proc
+type processSample struct {
+	RSSBytes            int64
+	CPUTimeMilliseconds int64
+}
+
+// ProcStat is a process entry read from /proc/<pid>/stat. ChildCPUTicks is the cpu time of the children
+// the process waited for, they are not part of the process tree anymore.
+type ProcStat struct {
+	Pid           int
+	PPid          int
+	CPUTicks      int64
+	ChildCPUTicks int64
+	RSSPages      int64
+	Cmdline       string
+	StartTime     int64
+}
+
+const (
+	procPath = "/proc"
+	// USER_HZ is 100 on every Linux platform we ship on
+	clockTicksPerSecond = 100
+)
+
+var (
+	resourceLock  sync.Mutex
+	resourceUsage = make(map[string]*KernelResourceUsage)
+	kernelPids    = make(map[string]int)
+)
+
+// KernelResourcesHandler returns the sampled resource usage for the kernel in the path
+func KernelResourcesHandler(w http.ResponseWriter, r *http.Request) {
+	kernelId := mux.Vars(r)["id"]
+
+	// tenants may only see their own kernel
+	tenant, err := auth.TenantFromRequest(r)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to resolve tenant")
+		util.SendHTTPResponse(w, http.StatusBadRequest, auth.ErrCodeTenantRequired+": "+err.Error(), true)
+		return
+	}
+	if tenant != "" {
+		tenantKernelId, _, err := CheckTenantKernel(tenant)
+		if err != nil || tenantKernelId != kernelId {
+			util.SendHTTPResponse(w, http.StatusNotFound, "kernel not found", true)
+			return
+		}
+	}
+
+	usage, err := SampleKernel(kernelId)
+	if err != nil {
+		log.Error().Err(err).Str("kernel_id", kernelId).Msg("Unable to sample kernel resources")
+		util.SendHTTPResponse(w, http.StatusNotFound, "error sampling kernel resources: "+err.Error(), true)
+		return
+	}
+
+	response, err := json.Marshal(usage)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to marshal response")
+		util.SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
+		return
+	}
+	util.SendHTTPResponse(w, http.StatusOK, string(response), false)
+}
+
+// PeriodicResourceSampling samples every running kernel so that peak usage is tracked between requests
+func PeriodicResourceSampling() {
+	interval := util.GetConfig().ResourceSampleInterval
+	if interval <= 0 {
+		log.Info().Msg("Kernel resource sampling disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		kernels, err := ListKernels()
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to list kernels for resource sampling")
+			continue
+		}
+		for _, kernel := range kernels {
+			if _, err := SampleKernel(kernel.ID); err != nil {
+				log.Error().Err(err).Str("kernel_id", kernel.ID).Msg("Unable to sample kernel resources")
+			}
+		}
+		forgetStoppedKernels(kernels)
+	}
+}
+
+// ListKernels returns the kernels currently running in the Jupyter server
+func ListKernels() ([]Kernel, error) {
+	response, err := jupyterRequest(util.HTTPClient(), http.MethodGet, "/api/kernels", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error getting kernels: %v", err)
+	}
+
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	var kernels []Kernel
+	err = json.Unmarshal(body, &kernels)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling JSON: %v", err)
+	}
+	return kernels, nil
+}
+
+// SampleKernel reads the current usage of a kernel and updates its peak values
+func SampleKernel(kernelId string) (KernelResourceUsage, error) {
+	pid, err := FindKernelPid(kernelId)
+	if err != nil {
+		return KernelResourceUsage{}, err
+	}
+
+	sample, err := sampleProcessTree(pid)
+	if err != nil {
+		return KernelResourceUsage{}, err
+	}
+
+	resourceLock.Lock()
+	defer resourceLock.Unlock()
+
+	usage, ok := resourceUsage[kernelId]
+	if !ok || usage.Pid != pid {
+		// kernel was restarted, start counting from scratch
+		usage = &KernelResourceUsage{KernelID: kernelId, Pid: pid}
+		resourceUsage[kernelId] = usage
+	}
+	usage.CurrentRSSBytes = sample.RSSBytes
+	if sample.RSSBytes > usage.PeakRSSBytes {
+		usage.PeakRSSBytes = sample.RSSBytes
+	}
+	usage.CPUTimeMilliseconds = sample.CPUTimeMilliseconds
+	usage.LastSampled = time.Now()
+
+	return *usage, nil
+}
+
+// FindKernelPid returns the pid of the ipykernel process Jupyter started for the kernel.
+// Jupyter passes the connection file kernel-<id>.json on the command line, which is how we match it.
+func FindKernelPid(kernelId string) (int, error) {
+	if kernelId == "" {
+		return 0, fmt.Errorf("kernel id is empty")
+	}
+
+	resourceLock.Lock()
+	pid, ok := kernelPids[kernelId]
+	resourceLock.Unlock()
+	if ok {
+		if stat, err := readProcStat(pid); err == nil && strings.Contains(stat.Cmdline, "kernel-"+kernelId) {
+			return pid, nil
+		}
+	}
+
+	procs, err := readAllProcStats()
+	if err != nil {
+		return 0, err
+	}
+	for _, proc := range procs {
+		if strings.Contains(proc.Cmdline, "kernel-"+kernelId+".json") {
+			resourceLock.Lock()
+			kernelPids[kernelId] = proc.Pid
+			resourceLock.Unlock()
+			return proc.Pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no process found for kernel %s", kernelId)
+}
+
+// ExecutionSampler tracks the peak memory and the cpu time of a kernel during a single execution
+type ExecutionSampler struct {
+	pid       int
+	startCPU  int64
+	peakRSS   int64
+	lastCPU   int64
+	limits    KernelLimits
+	exceeded  chan struct{}
+	violation *LimitViolation
+	stop      chan struct{}
+	done      chan struct{}
+	sampleMux sync.Mutex
+}
+
+const executionSampleInterval = 100 * time.Millisecond
+
+// StartExecutionSampler starts sampling the kernel until Stop is called.
+// It returns nil if the kernel process cannot be found, in which case no diagnostics are reported.
+func StartExecutionSampler(kernelId string) *ExecutionSampler {
+	pid, err := FindKernelPid(kernelId)
+	if err != nil {
+		log.Debug().Err(err).Str("kernel_id", kernelId).Msg("Unable to find kernel process")
+		return nil
+	}
+	sample, err := sampleProcessTree(pid)
+	if err != nil {
+		log.Debug().Err(err).Str("kernel_id", kernelId).Msg("Unable to sample kernel process")
+		return nil
+	}
+
+	limits := GetKernelLimits()
+	if err := applyKernelRlimits(pid, limits); err != nil {
+		log.Error().Err(err).Str("kernel_id", kernelId).Msg("Unable to apply kernel rlimits")
+	}
+
+	sampler := &ExecutionSampler{
+		pid:      pid,
+		startCPU: sample.CPUTimeMilliseconds,
+		lastCPU:  sample.CPUTimeMilliseconds,
+		peakRSS:  sample.RSSBytes,
+		limits:   limits,
+		exceeded: make(chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go sampler.run()
+	return sampler
+}
+
+func (s *ExecutionSampler) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(executionSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			s.sample()
+			return
+		case <-ticker.C:
+			s.sample()
+		}
+	}
+}
+
+func (s *ExecutionSampler) sample() {
+	sample, err := sampleProcessTree(s.pid)
+	if err != nil {
+		return
+	}
+	s.sampleMux.Lock()
+	defer s.sampleMux.Unlock()
+	if sample.RSSBytes > s.peakRSS {
+		s.peakRSS = sample.RSSBytes
+	}
+	s.lastCPU = sample.CPUTimeMilliseconds
+
+	if s.violation == nil {
+		if violation := s.limits.Check(sample.RSSBytes, s.lastCPU-s.startCPU); violation != nil {
+			s.violation = violation
+			close(s.exceeded)
+		}
+	}
+}
+
+// Exceeded is closed as soon as the kernel goes over one of the configured limits
+func (s *ExecutionSampler) Exceeded() <-chan struct{} {
+	return s.exceeded
+}
+
+// Violation returns the limit that was exceeded, or nil
+func (s *ExecutionSampler) Violation() *LimitViolation {
+	s.sampleMux.Lock()
+	defer s.sampleMux.Unlock()
+	return s.violation
+}
+
+// Current returns the peak rss and the cpu time used since the sampler started
+func (s *ExecutionSampler) Current() (int64, int64) {
+	s.sampleMux.Lock()
+	defer s.sampleMux.Unlock()
+	return s.peakRSS, s.lastCPU - s.startCPU
+}
+
+// Stop takes a last sample and returns the peak rss and the cpu time used during the execution
+func (s *ExecutionSampler) Stop() (int64, int64) {
+	close(s.stop)
+	<-s.done
+	return s.Current()
+}
+
+func forgetStoppedKernels(kernels []Kernel) {
+	running := make(map[string]bool)
+	for _, kernel := range kernels {
+		running[kernel.ID] = true
+	}
+
+	resourceLock.Lock()
+	defer resourceLock.Unlock()
+	for kernelId := range resourceUsage {
+		if !running[kernelId] {
+			delete(resourceUsage, kernelId)
+			delete(kernelPids, kernelId)
+		}
+	}
+}
+
+// sums rss and cpu time for pid and all its descendants, since cells can spawn subprocesses
+func sampleProcessTree(pid int) (processSample, error) {
+	procs, err := readAllProcStats()
+	if err != nil {
+		return processSample{}, err
+	}
+
+	children := make(map[int][]int)
+	byPid := make(map[int]ProcStat)
+	for _, proc := range procs {
+		children[proc.PPid] = append(children[proc.PPid], proc.Pid)
+		byPid[proc.Pid] = proc
+	}
+
+	if _, ok := byPid[pid]; !ok {
+		return processSample{}, fmt.Errorf("process %d not found", pid)
+	}
+
+	pageSize := int64(os.Getpagesize())
+	var sample processSample
+	queue := []int{pid}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		proc := byPid[current]
+		sample.RSSBytes += proc.RSSPages * pageSize
+		sample.CPUTimeMilliseconds += (proc.CPUTicks + proc.ChildCPUTicks) * 1000 / clockTicksPerSecond
+		queue = append(queue, children[current]...)
+	}
+	return sample, nil
+}
+
+func readAllProcStats() ([]ProcStat, error) {
+	entries, err := os.ReadDir(procPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", procPath, err)
+	}
+
+	var procs []ProcStat
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// processes can exit while we are reading, ignore them
+		if proc, err := readProcStat(pid); err == nil {
+			procs = append(procs, proc)
+		}
+	}
+	return procs, nil
+}
+
+func readProcStat(pid int) (ProcStat, error) {
+	stat, err := os.ReadFile(filepath.Join(procPath, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return ProcStat{}, err
+	}
+	proc, err := ParseProcStat(string(stat))
+	if err != nil {
+		return ProcStat{}, err
+	}
+
+	cmdline, err := os.ReadFile(filepath.Join(procPath, strconv.Itoa(pid), "cmdline"))
+	if err == nil {
+		proc.Cmdline = strings.ReplaceAll(string(cmdline), "\x00", " ")
+	}
+	return proc, nil
+}
+
+// ParseProcStat parses the content of /proc/<pid>/stat.
+// The command name is wrapped in parentheses and may itself contain spaces, so fields are read after the last ')'.
+func ParseProcStat(stat string) (ProcStat, error) {
+	open := strings.Index(stat, "(")
+	end := strings.LastIndex(stat, ")")
+	if open < 0 || end < 0 || end < open {
+		return ProcStat{}, fmt.Errorf("invalid stat format")
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(stat[:open]))
+	if err != nil {
+		return ProcStat{}, fmt.Errorf("invalid pid: %v", err)
+	}
+
+	// fields[0] is field 3 (state) in proc(5)
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 22 {
+		return ProcStat{}, fmt.Errorf("invalid stat format: expected at least 24 fields, got %d", len(fields)+2)
+	}
+
+	values := make(map[int]int64)
+	for _, index := range []int{1, 11, 12, 13, 14, 19, 21} {
+		value, err := strconv.ParseInt(fields[index], 10, 64)
+		if err != nil {
+			return ProcStat{}, fmt.Errorf("invalid stat field %d: %v", index+3, err)
+		}
+		values[index] = value
+	}
+
+	return ProcStat{
+		Pid:           pid,
+		PPid:          int(values[1]),
+		CPUTicks:      values[11] + values[12],
+		ChildCPUTicks: values[13] + values[14],
+		StartTime:     values[19],
+		RSSPages:      values[21],
+	}, nil
+}
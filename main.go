@@ -15,63 +15,188 @@ package main
 // limitations under the License.
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"github.com/gorilla/mux"
+	"github.com/microsoft/jupyterpython/auth"
 	"github.com/microsoft/jupyterpython/codeexecution"
+	"github.com/microsoft/jupyterpython/egress"
 	"github.com/microsoft/jupyterpython/fileservices"
 	"github.com/microsoft/jupyterpython/jupyterservices"
+	"github.com/microsoft/jupyterpython/metrics"
 	"github.com/microsoft/jupyterpython/util"
 )
 
+// time open requests get to complete once executions are drained
+const serverShutdownTimeout = 10 * time.Second
+
 func init() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	log.Logger = log.Output(os.Stdout)
+	log.Logger = log.Output(util.NewRedactingWriter(os.Stdout))
 }
 
 func main() {
+	// "config <setting>..." prints the effective settings for the entrypoint instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := util.PrintConfig(os.Stdout, os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("Unable to print config")
+		}
+		return
+	}
+
 	r := mux.NewRouter()
 	setToken()
 
-	log.Info().Msgf("Starting Jupyter API server with token: %s", jupyterservices.Token)
+	log.Info().Msg("Starting Jupyter API server")
 
 	// Define your routes
-	r.HandleFunc("/", initializeJupyter).Methods("GET")
-	r.HandleFunc("/execute", codeexecution.Execute).Methods("POST")
+	r.HandleFunc("/", auth.Require(auth.ScopeExecute, initializeJupyter)).Methods("GET")
+	r.HandleFunc("/execute", auth.Require(auth.ScopeExecute, codeexecution.Execute)).Methods("POST")
+	r.HandleFunc("/config", auth.Require(auth.ScopeExecute, util.ConfigHandler)).Methods("GET")
+	r.HandleFunc("/kernels/{id}/resources", auth.Require(auth.ScopeExecute, jupyterservices.KernelResourcesHandler)).Methods("GET")
 
 	// health check
 	r.HandleFunc("/health", codeexecution.HealthHandler).Methods("GET")
-	r.HandleFunc("/listfiles", fileservices.ListFilesHandler).Methods("GET")
-	r.HandleFunc("/listfiles/{path:.*}", fileservices.ListFilesHandler).Methods("GET")
-	r.HandleFunc("/upload", fileservices.UploadFileHandler).Methods("POST")
-	r.HandleFunc("/upload/{path:.*}", fileservices.UploadFileHandler).Methods("POST")
-	r.HandleFunc("/download/{filename}", fileservices.DownloadFileHandler).Methods("GET")
-	r.HandleFunc("/download/{path:.*}/{filename}", fileservices.DownloadFileHandler).Methods("GET")
-	r.HandleFunc("/delete/{filename}", fileservices.DeleteFileHandler).Methods("DELETE")
-	r.HandleFunc("/get/{filename}", fileservices.GetFileHandler).Methods("GET")
+	r.HandleFunc("/healthz/live", codeexecution.LiveHandler).Methods("GET")
+	r.HandleFunc("/healthz/ready", codeexecution.ReadyHandler).Methods("GET")
+	r.HandleFunc("/healthz/deep", codeexecution.DeepHealthHandler).Methods("GET")
+	r.HandleFunc("/metrics", metrics.Handler).Methods("GET")
+	r.HandleFunc("/listfiles", auth.Require(auth.ScopeFileRead, fileservices.ListFilesHandler)).Methods("GET")
+	r.HandleFunc("/listfiles/{path:.*}", auth.Require(auth.ScopeFileRead, fileservices.ListFilesHandler)).Methods("GET")
+	r.HandleFunc("/upload", auth.Require(auth.ScopeFileWrite, fileservices.UploadFileHandler)).Methods("POST")
+	r.HandleFunc("/upload/{path:.*}", auth.Require(auth.ScopeFileWrite, fileservices.UploadFileHandler)).Methods("POST")
+	r.HandleFunc("/download/{filename}", auth.Require(auth.ScopeFileRead, fileservices.DownloadFileHandler)).Methods("GET")
+	r.HandleFunc("/download/{path:.*}/{filename}", auth.Require(auth.ScopeFileRead, fileservices.DownloadFileHandler)).Methods("GET")
+	r.HandleFunc("/delete/{filename}", auth.Require(auth.ScopeFileWrite, fileservices.DeleteFileHandler)).Methods("DELETE")
+	r.HandleFunc("/delete/{path:.*}/{filename}", auth.Require(auth.ScopeFileWrite, fileservices.DeleteFileHandler)).Methods("DELETE")
+	r.HandleFunc("/get/{filename}", auth.Require(auth.ScopeFileRead, fileservices.GetFileHandler)).Methods("GET")
+	r.HandleFunc("/get/{path:.*}/{filename}", auth.Require(auth.ScopeFileRead, fileservices.GetFileHandler)).Methods("GET")
+	r.HandleFunc("/preview/{path:.*}", auth.Require(auth.ScopeFileRead, fileservices.PreviewHandler)).Methods("GET")
+	r.HandleFunc("/usage", auth.Require(auth.ScopeFileRead, fileservices.UsageHandler)).Methods("GET")
+	r.HandleFunc("/archive", auth.Require(auth.ScopeFileRead, fileservices.ArchiveHandler)).Methods("GET")
+	r.HandleFunc("/archive/{path:.*}", auth.Require(auth.ScopeFileRead, fileservices.ArchiveHandler)).Methods("GET")
+	r.HandleFunc("/uploads", auth.Require(auth.ScopeFileWrite, fileservices.CreateUploadHandler)).Methods("POST")
+	r.HandleFunc("/uploads/{id}", auth.Require(auth.ScopeFileWrite, fileservices.GetUploadHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/uploads/{id}", auth.Require(auth.ScopeFileWrite, fileservices.PatchUploadHandler)).Methods("PATCH")
+	r.HandleFunc("/uploads/{id}", auth.Require(auth.ScopeFileWrite, fileservices.DeleteUploadHandler)).Methods("DELETE")
+	r.HandleFunc("/directories/{path:.*}", auth.Require(auth.ScopeFileWrite, fileservices.CreateDirectoryHandler)).Methods("POST")
+	r.HandleFunc("/files/watch", auth.Require(auth.ScopeFileRead, fileservices.WatchFilesHandler)).Methods("GET")
+	r.HandleFunc("/files/move", auth.Require(auth.ScopeFileWrite, fileservices.MoveFileHandler)).Methods("POST")
+	r.HandleFunc("/files/copy", auth.Require(auth.ScopeFileWrite, fileservices.CopyFileHandler)).Methods("POST")
+	r.HandleFunc("/files/{path:.*}/versions", auth.Require(auth.ScopeFileRead, fileservices.ListVersionsHandler)).Methods("GET")
+	r.HandleFunc("/files/{path:.*}/versions/{id}/restore", auth.Require(auth.ScopeFileWrite, fileservices.RestoreVersionHandler)).Methods("POST")
+	r.HandleFunc("/files/{path:.*}", auth.Require(auth.ScopeFileWrite, fileservices.DeletePathHandler)).Methods("DELETE")
+	r.HandleFunc("/sync", auth.Require(auth.ScopeFileWrite, fileservices.SyncHandler)).Methods("POST")
 
 	// Run health check in the background
 	go codeexecution.PeriodicCodeExecution()
+	go jupyterservices.PeriodicResourceSampling()
+	if fileservices.QuotaEnabled() {
+		go fileservices.PeriodicUsageScan()
+	}
+	// pull the synced object storage into the data root of every new session
+	if fileservices.SyncEnabled() {
+		jupyterservices.RegisterSessionStartHook(fileservices.PullOnSessionStart)
+	}
 
 	var cfg = util.GetConfig()
 
-	if cfg.UseTls == "true" {
-		log.Info().Msg("Starting server on port :6000 with cert " + cfg.XdsCertFilePath + " and key " + cfg.XdsCertKeyFilePath)
-		error := http.ListenAndServeTLS(":6000", cfg.XdsCertFilePath, cfg.XdsCertKeyFilePath, r)
-		if error != nil {
-			log.Error().Msg("HTTPS Server Error: " + error.Error())
+	// tenant roots are owned by the tenant uids, which needs a server running as root
+	if cfg.MultiTenant {
+		if err := fileservices.PrepareTenantIsolation(); err != nil {
+			log.Fatal().Err(err).Msg("Unable to isolate tenants")
 		}
-	} else {
-		log.Info().Msg("Starting server on port :6000")
-		error := http.ListenAndServe(":6000", r)
-		if error != nil {
+	}
+
+	if err := auth.Configure(cfg); err != nil {
+		log.Fatal().Err(err).Msg("Invalid authentication config")
+	}
+	if !auth.Enabled() {
+		log.Warn().Msg("No authentication configured, the API is open to anyone who can reach it")
+	}
+
+	// proxy the kernels' outbound traffic through the egress policy
+	egressPolicy, err := egress.GetPolicy()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid egress policy")
+	}
+	if egressPolicy.Mode != egress.ModeAllowAll {
+		go egress.Start(cfg.EgressProxyAddress, egressPolicy)
+	}
+
+	if cfg.CodePolicyFile != "" {
+		codePolicy, err := codeexecution.LoadCodePolicy(cfg.CodePolicyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid code policy")
+		}
+		codeexecution.RegisterPreExecutionHook(codePolicy.Check)
+		log.Info().Msgf("Loaded code policy with %d rules from %s", len(codePolicy.Rules), cfg.CodePolicyFile)
+	}
+
+	server := &http.Server{
+		Addr:              cfg.ListenAddress,
+		Handler:           r,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	// serve until SIGTERM or an interrupt, then drain before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		if cfg.UseTls == "true" {
+			log.Info().Msg("Starting server on " + cfg.ListenAddress + " with cert " + cfg.XdsCertFilePath + " and key " + cfg.XdsCertKeyFilePath)
+			serveErr <- server.ListenAndServeTLS(cfg.XdsCertFilePath, cfg.XdsCertKeyFilePath)
+		} else {
+			log.Info().Msg("Starting server on " + cfg.ListenAddress)
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case error := <-serveErr:
+		if cfg.UseTls == "true" {
+			log.Error().Msg("HTTPS Server Error: " + error.Error())
+		} else {
 			log.Error().Msg("HTTP Server Error: " + error.Error())
 		}
+	case <-ctx.Done():
+		stop()
+		shutdown(server, cfg)
+	}
+}
+
+// shutdown lets running executions finish while /health reports draining, then closes the kernel
+// connection and the server. Connections still open after the shutdown timeout, like file watches, are closed.
+func shutdown(server *http.Server, cfg util.JupyterPythonConfig) {
+	log.Info().Msgf("Shutting down, draining executions for up to %s", cfg.ShutdownGracePeriod)
+	if interrupted := codeexecution.Drain(cfg.ShutdownGracePeriod); interrupted > 0 {
+		log.Warn().Msgf("Interrupted executions on %d kernels", interrupted)
+	}
+	codeexecution.CloseWebSocket()
+	if cfg.ShutdownJupyterSessions {
+		if err := jupyterservices.ShutdownSessions(); err != nil {
+			log.Err(err).Msg("Error shutting down Jupyter sessions")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("Closing connections still open after the shutdown timeout")
+		server.Close()
 	}
+	log.Info().Msg("Server stopped")
 }
 
 // func to take token from the environment variable
@@ -79,9 +204,10 @@ func setToken() {
 	jupyterservices.Token = os.Getenv("JUPYTER_GEN_TOKEN")
 	if jupyterservices.Token == "" {
 		jupyterservices.Token = "test"
-		log.Info().Msg("Token not found in environment variable, using default token: " + jupyterservices.Token)
+		log.Info().Msg("Token not found in environment variable, using default token")
 	} else {
-		log.Info().Msg("Token found in environment variable: " + jupyterservices.Token)
+		util.RegisterSecret(jupyterservices.Token)
+		log.Info().Msg("Token found in environment variable")
 	}
 }
 
@@ -92,5 +218,5 @@ func initializeJupyter(w http.ResponseWriter, r *http.Request) {
 		log.Err(err).Msg("Failed to check kernels")
 		util.SendHTTPResponse(w, http.StatusInternalServerError, "error checking kernels"+err.Error(), true)
 	}
-	util.SendHTTPResponse(w, http.StatusOK, "jupyter initialized with token: "+jupyterservices.Token, true)
+	util.SendHTTPResponse(w, http.StatusOK, "jupyter initialized", true)
 }
@@ -2,25 +2,370 @@ package util
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/sethvargo/go-envconfig"
+	"gopkg.in/yaml.v3"
 )
 
+// JupyterPythonConfig holds the settings read from env vars and the optional YAML file CONFIG_FILE.
+// Fields tagged secret are redacted by Redacted.
 type JupyterPythonConfig struct {
+	// directory served by the file endpoints, tenant roots are created below it
+	DataRoot      string `env:"DATA_ROOT,default=/mnt/data"`
+	ListenAddress string `env:"LISTEN_ADDRESS,default=:6000"`
+	JupyterURL    string `env:"JUPYTER_URL,default=http://localhost:8888"`
+
 	UseTls             string `env:"USE_TLS,default=false"`
 	XdsCertFilePath    string `env:"XDS_CERT_FILE_PATH,default=/etc/jupyterpython/certs/cert.pem"`
 	XdsCertKeyFilePath string `env:"XDS_CERT_KEY_FILE_PATH,default=/etc/jupyterpython/certs/key.pem"`
+
+	// timeouts of the API server, 0 means none. Reads and writes are unlimited by default for large uploads and /files/watch
+	ReadHeaderTimeout time.Duration `env:"READ_HEADER_TIMEOUT,default=10s"`
+	ReadTimeout       time.Duration `env:"READ_TIMEOUT,default=0"`
+	WriteTimeout      time.Duration `env:"WRITE_TIMEOUT,default=0"`
+	IdleTimeout       time.Duration `env:"IDLE_TIMEOUT,default=2m"`
+
+	// on SIGTERM running executions get the grace period to finish before they are interrupted,
+	// optionally the Jupyter sessions and their kernels are shut down as well
+	ShutdownGracePeriod     time.Duration `env:"SHUTDOWN_GRACE_PERIOD,default=30s"`
+	ShutdownJupyterSessions bool          `env:"SHUTDOWN_JUPYTER_SESSIONS,default=false"`
+
+	// periodic health probe running HEALTH_PROBE_CODE on the default kernel, the server is not ready after
+	// HEALTH_PROBE_FAILURE_THRESHOLD failures in a row, /healthz/deep lists the last HEALTH_PROBE_HISTORY probes
+	HealthProbeInitialDelay     time.Duration `env:"HEALTH_PROBE_INITIAL_DELAY,default=30s"`
+	HealthProbeInterval         time.Duration `env:"HEALTH_PROBE_INTERVAL,default=15s"`
+	HealthProbeCode             string        `env:"HEALTH_PROBE_CODE,default=1+1"`
+	HealthProbeFailureThreshold int           `env:"HEALTH_PROBE_FAILURE_THRESHOLD,default=3"`
+	HealthProbeHistory          int           `env:"HEALTH_PROBE_HISTORY,default=10"`
+
+	// time an execution may run before it is reported as timed out, and timeout of REST calls to Jupyter
+	ExecutionTimeout      time.Duration `env:"EXECUTION_TIMEOUT,default=60s"`
+	JupyterRequestTimeout time.Duration `env:"JUPYTER_REQUEST_TIMEOUT,default=10s"`
+
+	// stdout and stderr of an execution are cut after this many characters, 0 means unlimited
+	OutputMaxLength int `env:"OUTPUT_MAX_LENGTH,default=1024"`
+
+	// interval of the background kernel resource sampler, 0 disables it
+	ResourceSampleInterval time.Duration `env:"RESOURCE_SAMPLE_INTERVAL,default=5s"`
+
+	// upload size limits of a single file and of a whole request body, 0 means unlimited
+	UploadMaxFileBytes    int64 `env:"UPLOAD_MAX_FILE_BYTES,default=0"`
+	UploadMaxRequestBytes int64 `env:"UPLOAD_MAX_REQUEST_BYTES,default=0"`
+
+	// limits of archives unpacked with upload?extract=true, 0 means unlimited
+	ExtractMaxTotalBytes int64 `env:"EXTRACT_MAX_TOTAL_BYTES,default=1073741824"`
+	ExtractMaxEntries    int   `env:"EXTRACT_MAX_ENTRIES,default=10000"`
+
+	// report files created, modified and deleted by each execution, walks stop after the max entries
+	ExecutionFileChanges   bool `env:"EXECUTION_FILE_CHANGES,default=true"`
+	FileSnapshotMaxEntries int  `env:"FILE_SNAPSHOT_MAX_ENTRIES,default=100000"`
+
+	// storage quotas of the data directory and of every tenant root, 0 means unlimited
+	QuotaMaxBytes       int64         `env:"QUOTA_MAX_BYTES,default=0"`
+	QuotaMaxFiles       int64         `env:"QUOTA_MAX_FILES,default=0"`
+	TenantQuotaMaxBytes int64         `env:"TENANT_QUOTA_MAX_BYTES,default=0"`
+	TenantQuotaMaxFiles int64         `env:"TENANT_QUOTA_MAX_FILES,default=0"`
+	UsageScanInterval   time.Duration `env:"USAGE_SCAN_INTERVAL,default=1m"`
+
+	// prior versions kept of every replaced file in the hidden .versions directory, 0 disables versioning
+	FileVersionsMax int `env:"FILE_VERSIONS_MAX,default=0"`
+
+	// S3-compatible object store, like MinIO, that the data root is synced with
+	S3Endpoint        string `env:"S3_ENDPOINT"`
+	S3Region          string `env:"S3_REGION,default=us-east-1"`
+	S3Bucket          string `env:"S3_BUCKET"`
+	S3Prefix          string `env:"S3_PREFIX"`
+	S3AccessKeyID     string `env:"S3_ACCESS_KEY_ID"`
+	S3SecretAccessKey string `env:"S3_SECRET_ACCESS_KEY" secret:"true"`
+	S3SessionToken    string `env:"S3_SESSION_TOKEN" secret:"true"`
+	S3PathStyle       bool   `env:"S3_PATH_STYLE,default=true"`
+
+	// sync SYNC_PREFIXES of the data root with the S3 bucket, pulled when a session starts and pushed after executions
+	SyncEnabled        bool     `env:"SYNC_ENABLED,default=false"`
+	SyncPrefixes       []string `env:"SYNC_PREFIXES"`
+	SyncInclude        []string `env:"SYNC_INCLUDE"`
+	SyncExclude        []string `env:"SYNC_EXCLUDE"`
+	SyncAfterExecution bool     `env:"SYNC_AFTER_EXECUTION,default=true"`
+
+	// resumable upload sessions, kept on disk until completed or expired
+	UploadSessionDir string        `env:"UPLOAD_SESSION_DIR,default=/mnt/uploads"`
+	UploadSessionTTL time.Duration `env:"UPLOAD_SESSION_TTL,default=24h"`
+
+	// per-kernel limits, 0 means unlimited. The address space is capped by the kernel itself, it is larger
+	// than the rss of a python process so it gets its own limit. The cpu time of a cell is watched by the
+	// server, the cpu time of the whole kernel process is capped by the kernel itself.
+	KernelMaxRSSBytes          int64  `env:"KERNEL_MAX_RSS_BYTES,default=0"`
+	KernelMaxAddressSpaceBytes uint64 `env:"KERNEL_MAX_ADDRESS_SPACE_BYTES,default=0"`
+	KernelMaxCPUSecondsPerCell int64  `env:"KERNEL_MAX_CPU_SECONDS_PER_CELL,default=0"`
+	KernelMaxCPUSeconds        uint64 `env:"KERNEL_MAX_CPU_SECONDS,default=0"`
+	KernelMaxOpenFiles         uint64 `env:"KERNEL_MAX_OPEN_FILES,default=0"`
+
+	// egress policy for executed code: allow-all, deny-all or allow-list
+	EgressPolicy       string   `env:"EGRESS_POLICY,default=allow-all"`
+	EgressAllowList    []string `env:"EGRESS_ALLOW_LIST"`
+	EgressProxyAddress string   `env:"EGRESS_PROXY_ADDRESS,default=127.0.0.1:3128"`
+
+	// YAML or JSON file with the static code policy checked before execution
+	CodePolicyFile string `env:"CODE_POLICY_FILE"`
+
+	// secret values, and names of env vars holding secrets, masked in output and logs
+	RedactSecrets       []string `env:"REDACT_SECRETS" secret:"true"`
+	RedactSecretEnvVars []string `env:"REDACT_SECRET_ENV_VARS"`
+
+	// authentication of the public API, disabled when none is configured
+	AuthStaticKey       string   `env:"AUTH_STATIC_KEY" secret:"true"`
+	AuthStaticKeyScopes []string `env:"AUTH_STATIC_KEY_SCOPES"`
+	AuthHmacSecret      string   `env:"AUTH_HMAC_SECRET" secret:"true"`
+	AuthHmacScopes      []string `env:"AUTH_HMAC_SCOPES"`
+	AuthJwksFile        string   `env:"AUTH_JWKS_FILE"`
+	AuthJwtIssuer       string   `env:"AUTH_JWT_ISSUER"`
+	AuthJwtAudience     string   `env:"AUTH_JWT_AUDIENCE"`
+
+	// give every tenant its own kernel and file root, the tenant comes from an auth claim or from the header
+	// of principals whose subject is in TENANT_HEADER_SUBJECTS, like a gateway's static key or hmac secret
+	MultiTenant          bool     `env:"MULTI_TENANT,default=false"`
+	TenantClaim          string   `env:"TENANT_CLAIM,default=tid"`
+	TenantHeader         string   `env:"TENANT_HEADER"`
+	TenantHeaderSubjects []string `env:"TENANT_HEADER_SUBJECTS"`
+	// tenant roots are owned by their own user id from TENANT_UID_BASE up, tenant kernels drop root for it
+	TenantUIDBase int `env:"TENANT_UID_BASE,default=100000"`
+
+	// api-version used by requests without one, 2 drops the deprecated filename and mime_type metadata fields
+	DefaultAPIVersion int `env:"DEFAULT_API_VERSION,default=1"`
 }
 
 var values = JupyterPythonConfig{}
 
 func init() {
-	err := envconfig.Process(context.TODO(), &values)
+	config, err := LoadConfig(os.Getenv("CONFIG_FILE"), envconfig.OsLookuper())
 	if err != nil {
 		panic(err)
 	}
+	values = config
 }
 
 func GetConfig() JupyterPythonConfig {
 	return values
 }
+
+// LoadConfig reads the settings from lookuper, then from the YAML file configFile if set, then the defaults.
+// The file maps the env var names in lower case to values, lists may be YAML sequences.
+func LoadConfig(configFile string, lookuper envconfig.Lookuper) (JupyterPythonConfig, error) {
+	config := JupyterPythonConfig{}
+	if configFile != "" {
+		fileValues, err := readConfigFile(configFile)
+		if err != nil {
+			return config, err
+		}
+		lookuper = envconfig.MultiLookuper(lookuper, envconfig.MapLookuper(fileValues))
+	}
+	if err := envconfig.ProcessWith(context.TODO(), &envconfig.Config{Target: &config, Lookuper: lookuper}); err != nil {
+		return config, err
+	}
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid config: %w", err)
+	}
+	return config, nil
+}
+
+func readConfigFile(configFile string) (map[string]string, error) {
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	settings := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &settings); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", configFile, err)
+	}
+
+	known := map[string]bool{}
+	for _, field := range configFields() {
+		known[field.name] = true
+	}
+	fileValues := map[string]string{}
+	for key, value := range settings {
+		name := strings.ToUpper(key)
+		if !known[name] {
+			return nil, fmt.Errorf("unknown setting '%s' in config file %s", key, configFile)
+		}
+		switch value := value.(type) {
+		case nil:
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			fileValues[name] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("setting '%s' in config file %s must be a value or a list", key, configFile)
+		default:
+			fileValues[name] = fmt.Sprint(value)
+		}
+	}
+	return fileValues, nil
+}
+
+type configField struct {
+	name   string
+	secret bool
+	index  int
+}
+
+// configFields returns the env var names of the settings in field order
+func configFields() []configField {
+	fields := []configField{}
+	configType := reflect.TypeOf(JupyterPythonConfig{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("env"), ",")
+		if name == "" {
+			continue
+		}
+		fields = append(fields, configField{name: name, secret: field.Tag.Get("secret") == "true", index: i})
+	}
+	return fields
+}
+
+// Validate checks the settings that would otherwise only fail once they are used
+func (c JupyterPythonConfig) Validate() error {
+	var errs []error
+	if !filepath.IsAbs(c.DataRoot) {
+		errs = append(errs, fmt.Errorf("DATA_ROOT must be an absolute path, was '%s'", c.DataRoot))
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		errs = append(errs, fmt.Errorf("LISTEN_ADDRESS must be host:port, was '%s'", c.ListenAddress))
+	}
+	if u, err := url.Parse(c.JupyterURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("JUPYTER_URL must be an http or https URL, was '%s'", redactCredentials(c.JupyterURL)))
+	}
+	switch c.UseTls {
+	case "true":
+		if c.XdsCertFilePath == "" || c.XdsCertKeyFilePath == "" {
+			errs = append(errs, errors.New("XDS_CERT_FILE_PATH and XDS_CERT_KEY_FILE_PATH are required with USE_TLS"))
+		}
+	case "false":
+	default:
+		errs = append(errs, fmt.Errorf("USE_TLS must be true or false, was '%s'", c.UseTls))
+	}
+	durations := map[string]time.Duration{
+		"READ_HEADER_TIMEOUT":        c.ReadHeaderTimeout,
+		"READ_TIMEOUT":               c.ReadTimeout,
+		"WRITE_TIMEOUT":              c.WriteTimeout,
+		"IDLE_TIMEOUT":               c.IdleTimeout,
+		"SHUTDOWN_GRACE_PERIOD":      c.ShutdownGracePeriod,
+		"HEALTH_PROBE_INITIAL_DELAY": c.HealthProbeInitialDelay,
+	}
+	for name, duration := range durations {
+		if duration < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+	if c.HealthProbeInterval <= 0 {
+		errs = append(errs, errors.New("HEALTH_PROBE_INTERVAL must be positive"))
+	}
+	if c.HealthProbeFailureThreshold < 1 || c.HealthProbeHistory < 1 {
+		errs = append(errs, errors.New("HEALTH_PROBE_FAILURE_THRESHOLD and HEALTH_PROBE_HISTORY must be at least 1"))
+	}
+	if c.ExecutionTimeout <= 0 {
+		errs = append(errs, errors.New("EXECUTION_TIMEOUT must be positive"))
+	}
+	if c.JupyterRequestTimeout <= 0 {
+		errs = append(errs, errors.New("JUPYTER_REQUEST_TIMEOUT must be positive"))
+	}
+	limits := map[string]int64{
+		"OUTPUT_MAX_LENGTH":        int64(c.OutputMaxLength),
+		"UPLOAD_MAX_FILE_BYTES":    c.UploadMaxFileBytes,
+		"UPLOAD_MAX_REQUEST_BYTES": c.UploadMaxRequestBytes,
+		"EXTRACT_MAX_TOTAL_BYTES":  c.ExtractMaxTotalBytes,
+		"EXTRACT_MAX_ENTRIES":      int64(c.ExtractMaxEntries),
+		"FILE_VERSIONS_MAX":        int64(c.FileVersionsMax),
+	}
+	for name, limit := range limits {
+		if limit < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+	if c.TenantHeader != "" && len(c.TenantHeaderSubjects) == 0 {
+		errs = append(errs, errors.New("TENANT_HEADER requires TENANT_HEADER_SUBJECTS, the principals trusted to set it"))
+	}
+	if c.TenantUIDBase < 1 {
+		errs = append(errs, errors.New("TENANT_UID_BASE must be positive, tenants can not run as root"))
+	}
+	if c.DefaultAPIVersion != 1 && c.DefaultAPIVersion != 2 {
+		errs = append(errs, fmt.Errorf("DEFAULT_API_VERSION must be 1 or 2, was %d", c.DefaultAPIVersion))
+	}
+	// map iteration order is random, keep the message stable
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// Redacted returns the settings keyed by their config file name, secrets are replaced by RedactedValue
+func (c JupyterPythonConfig) Redacted() map[string]interface{} {
+	settings := map[string]interface{}{}
+	configValue := reflect.ValueOf(c)
+	for _, field := range configFields() {
+		var value interface{}
+		switch fieldValue := configValue.Field(field.index).Interface().(type) {
+		case time.Duration:
+			value = fieldValue.String()
+		case string:
+			value = Redact(fieldValue)
+			if field.secret && fieldValue != "" {
+				value = RedactedValue
+			}
+		case []string:
+			items := make([]string, len(fieldValue))
+			for i, item := range fieldValue {
+				items[i] = Redact(item)
+				if field.secret {
+					items[i] = RedactedValue
+				}
+			}
+			value = items
+		default:
+			value = fieldValue
+		}
+		settings[strings.ToLower(field.name)] = value
+	}
+	return settings
+}
+
+// PrintConfig writes the effective value of every named setting on its own line, secrets redacted and
+// lists comma separated, so scripts read the same settings as the server
+func PrintConfig(w io.Writer, names []string) error {
+	settings := values.Redacted()
+	for _, name := range names {
+		value, ok := settings[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown setting '%s'", name)
+		}
+		if items, ok := value.([]string); ok {
+			value = strings.Join(items, ",")
+		}
+		fmt.Fprintln(w, value)
+	}
+	return nil
+}
+
+// ConfigHandler returns the effective settings with secrets redacted
+func ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	response, err := json.Marshal(values.Redacted())
+	if err != nil {
+		SendHTTPResponse(w, http.StatusInternalServerError, "error marshaling response"+err.Error(), true)
+		return
+	}
+	SendHTTPResponse(w, http.StatusOK, string(response), false)
+}
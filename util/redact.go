@@ -0,0 +1,137 @@
+// Copyright 2023 Microsoft Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	RedactedValue = "[REDACTED]"
+	// shorter values are too likely to appear in normal output
+	minSecretLength = 8
+)
+
+type redactPattern struct {
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// common credential formats, the replacement keeps the prefix so the output stays readable.
+// None of the patterns consume quotes or backslashes so JSON log lines stay valid.
+var redactPatterns = []redactPattern{
+	{regexp.MustCompile(`(?i)(\bbearer\s+)[A-Za-z0-9\-._~+/]+=*`), "${1}" + RedactedValue},
+	{regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), RedactedValue},
+	{regexp.MustCompile(`(?i)(aws_secret_access_key\s*[=:]\s*['"]?)[A-Za-z0-9/+=]{40}`), "${1}" + RedactedValue},
+	{regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.\-]*://[^:/\s"'\\@]+:)[^@\s"'\\/]+@`), "${1}" + RedactedValue + "@"},
+	{regexp.MustCompile(`(?i)(\b(?:AccountKey|SharedAccessKey|SharedAccessSignature|Password|Pwd)=)[^;\s"'\\]+`), "${1}" + RedactedValue},
+	{regexp.MustCompile(`(?i)([?&](?:token|sig|access_token)=)[^&\s"'\\]+`), "${1}" + RedactedValue},
+}
+
+var (
+	secretsLock     sync.RWMutex
+	secrets         = make(map[string]bool)
+	secretsReplacer = strings.NewReplacer()
+	// the config secrets are registered on the first Redact, so they do not depend on the order of the package inits
+	configSecretsOnce sync.Once
+)
+
+func registerConfigSecrets() {
+	cfg := GetConfig()
+	for _, secret := range cfg.RedactSecrets {
+		RegisterSecret(secret)
+	}
+	for _, name := range cfg.RedactSecretEnvVars {
+		RegisterSecret(os.Getenv(name))
+	}
+	configValue := reflect.ValueOf(cfg)
+	for _, field := range configFields() {
+		if secret, ok := configValue.Field(field.index).Interface().(string); ok && field.secret {
+			RegisterSecret(secret)
+		}
+	}
+}
+
+// RegisterSecret adds a value that is masked wherever it appears in output or logs
+func RegisterSecret(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	if secrets[secret] {
+		return
+	}
+	secrets[secret] = true
+
+	// replace longer secrets first so a secret containing another one is fully masked
+	sorted := make([]string, 0, len(secrets))
+	for value := range secrets {
+		sorted = append(sorted, value)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	oldnew := make([]string, 0, 2*len(sorted))
+	for _, value := range sorted {
+		oldnew = append(oldnew, value, RedactedValue)
+	}
+	secretsReplacer = strings.NewReplacer(oldnew...)
+}
+
+// Redact masks registered secrets and common credential patterns in s
+func Redact(s string) string {
+	if s == "" {
+		return s
+	}
+	configSecretsOnce.Do(registerConfigSecrets)
+
+	secretsLock.RLock()
+	replacer := secretsReplacer
+	secretsLock.RUnlock()
+
+	return redactCredentials(replacer.Replace(s))
+}
+
+// redactCredentials masks the common credential patterns only, it is safe to use while the config is loaded
+func redactCredentials(s string) string {
+	for _, pattern := range redactPatterns {
+		s = pattern.regex.ReplaceAllString(s, pattern.replacement)
+	}
+	return s
+}
+
+type redactingWriter struct {
+	out io.Writer
+}
+
+// NewRedactingWriter returns a writer that redacts everything before passing it to out.
+// zerolog writes one event per call so secrets are never split across writes.
+func NewRedactingWriter(out io.Writer) io.Writer {
+	return &redactingWriter{out: out}
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write([]byte(Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -16,12 +16,11 @@ package util
 
 import (
 	"net/http"
-	"time"
 )
 
 func HTTPClient() *http.Client {
 	return &http.Client{
-		Timeout: time.Second * 10,
+		Timeout: values.JupyterRequestTimeout,
 	}
 }
 